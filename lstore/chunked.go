@@ -0,0 +1,306 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package lstore
+
+import (
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"encoding/binary"
+	"bytes"
+	"errors"
+	"sync"
+)
+
+var ErrCorruptChunk = errors.New("ErrCorruptChunk")
+var ErrReservedKey = errors.New("ErrReservedKey")
+
+// The threshold of Chunked, if none is given.
+const DefaultChunkThreshold = 64<<10
+
+/*
+Every key at or above this prefix is reserved for continuation keys.
+Iterators of chunked tables stop before it and writes fail with
+ErrReservedKey.
+*/
+var ChunkPrefix = []byte("\xff\xff\xffchunk\x00")
+
+// A manifest replaces the value of a chunked key.
+var chunkMagic = []byte("\x00\xffCHUNKED\x00")
+
+func chunkKey(key []byte, i int) []byte {
+	k := make([]byte,0,len(ChunkPrefix)+binary.MaxVarintLen64+len(key)+4)
+	k = append(k,ChunkPrefix...)
+	var buf [binary.MaxVarintLen64]byte
+	k = append(k,buf[:binary.PutUvarint(buf[:],uint64(len(key)))]...)
+	k = append(k,key...)
+	binary.BigEndian.PutUint32(buf[:4],uint32(i))
+	return append(k,buf[:4]...)
+}
+
+func chunkManifest(count, size int) []byte {
+	m := make([]byte,len(chunkMagic),len(chunkMagic)+binary.MaxVarintLen64*2)
+	copy(m,chunkMagic)
+	var buf [binary.MaxVarintLen64]byte
+	m = append(m,buf[:binary.PutUvarint(buf[:],uint64(count))]...)
+	m = append(m,buf[:binary.PutUvarint(buf[:],uint64(size))]...)
+	return m
+}
+
+// Returns the number of chunks and the total size, ok is false for plain values.
+func parseChunkManifest(v []byte) (count, size int, ok bool, err error) {
+	if !bytes.HasPrefix(v,chunkMagic) { return }
+	ok = true
+	v = v[len(chunkMagic):]
+	c,n := binary.Uvarint(v)
+	if n<=0 { err = ErrCorruptChunk; return }
+	s,m := binary.Uvarint(v[n:])
+	if m<=0 { err = ErrCorruptChunk; return }
+	count,size = int(c),int(s)
+	return
+}
+
+/*
+Splits values larger than threshold bytes into chunks of threshold bytes, that
+are stored under continuation keys (see ChunkPrefix) in the same table. The
+original key holds a manifest. Manifest and chunks are always written in the
+same batch, so the chunking is atomic and invisible to the callers. When a
+value is overwritten or deleted, its superfluous chunks are deleted within the
+same batch. A threshold<=0 means DefaultChunkThreshold.
+*/
+func Chunked(db Database, threshold int) Database {
+	if threshold<=0 { threshold = DefaultChunkThreshold }
+	return &chunkedDB{inner:db,threshold:threshold}
+}
+
+type chunkedDB struct{
+	inner Database
+	threshold int
+	mu sync.Mutex
+	tables map[string]*chunkedTable
+}
+func (c *chunkedDB) Table(name string) (TableDB,error) {
+	c.mu.Lock(); defer c.mu.Unlock()
+	if t := c.tables[name]; t!=nil { return t,nil }
+	t,err := c.inner.Table(name)
+	if err!=nil { return nil,err }
+	ct := &chunkedTable{chunkedReader:chunkedReader{t},inner:t,threshold:c.threshold}
+	if c.tables==nil { c.tables = make(map[string]*chunkedTable) }
+	c.tables[name] = ct
+	return ct,nil
+}
+
+// --------------------------------------------------------------------------
+
+type chunkedReader struct{
+	r BasicReader
+}
+func (c chunkedReader) assemble(key, manifest []byte, ro *opt.ReadOptions) ([]byte,error) {
+	count,size,_,err := parseChunkManifest(manifest)
+	if err!=nil { return nil,err }
+	buf := make([]byte,0,size)
+	for i := 0; i<count; i++ {
+		v,err := c.r.Get(chunkKey(key,i),ro)
+		if err!=nil { return nil,err }
+		buf = append(buf,v...)
+	}
+	if len(buf)!=size { return nil,ErrCorruptChunk }
+	return buf,nil
+}
+func (c chunkedReader) Get(key []byte, ro *opt.ReadOptions) ([]byte,error) {
+	v,err := c.r.Get(key,ro)
+	if err!=nil || !bytes.HasPrefix(v,chunkMagic) { return v,err }
+	return c.assemble(key,v,ro)
+}
+func (c chunkedReader) Has(key []byte, ro *opt.ReadOptions) (bool,error) {
+	return c.r.Has(key,ro)
+}
+func (c chunkedReader) NewIterator(slice *util.Range, ro *opt.ReadOptions) iterator.Iterator {
+	return &chunkedIterator{Iterator:c.r.NewIterator(chunkRange(slice),ro),rd:c,ro:ro}
+}
+
+// Limits the range, so that the continuation keys are never visible.
+func chunkRange(slice *util.Range) *util.Range {
+	if slice==nil { return &util.Range{Limit:ChunkPrefix} }
+	if slice.Limit==nil || bytes.Compare(slice.Limit,ChunkPrefix)>0 {
+		return &util.Range{Start:slice.Start,Limit:ChunkPrefix}
+	}
+	return slice
+}
+
+type chunkedIterator struct{
+	iterator.Iterator
+	rd chunkedReader
+	ro *opt.ReadOptions
+	sn TableSnapshot
+	err error
+}
+func (i *chunkedIterator) Value() []byte {
+	v := i.Iterator.Value()
+	if !bytes.HasPrefix(v,chunkMagic) { return v }
+	v,err := i.rd.assemble(i.Iterator.Key(),v,i.ro)
+	if err!=nil { i.err = err }
+	return v
+}
+func (i *chunkedIterator) Error() error {
+	if i.err!=nil { return i.err }
+	return i.Iterator.Error()
+}
+func (i *chunkedIterator) Release() {
+	i.Iterator.Release()
+	if i.sn!=nil {
+		i.sn.Release()
+		i.sn = nil
+	}
+}
+
+// --------------------------------------------------------------------------
+
+// Translates the user's writes into writes of manifests and chunks.
+type chunkEncoder struct{
+	r BasicReader
+	out leveldb.Batch
+	threshold int
+	pending map[string]int
+	err error
+}
+func (e *chunkEncoder) oldCount(key []byte) int {
+	if n,ok := e.pending[string(key)]; ok { return n }
+	v,err := e.r.Get(key,nil)
+	if err!=nil { return 0 }
+	n,_,_,err := parseChunkManifest(v)
+	if err!=nil { return 0 }
+	return n
+}
+// Fails the batch, if the key is reserved for continuation keys.
+func (e *chunkEncoder) reserved(key []byte) bool {
+	if bytes.Compare(key,ChunkPrefix)<0 { return false }
+	e.err = ErrReservedKey
+	return true
+}
+func (e *chunkEncoder) Put(key, value []byte) {
+	if e.reserved(key) { return }
+	old := e.oldCount(key)
+	n := 0
+	if len(value)>e.threshold || bytes.HasPrefix(value,chunkMagic) {
+		for pos := 0; pos<len(value); pos += e.threshold {
+			end := pos+e.threshold
+			if end>len(value) { end = len(value) }
+			e.out.Put(chunkKey(key,n),value[pos:end])
+			n++
+		}
+		e.out.Put(key,chunkManifest(n,len(value)))
+	} else {
+		e.out.Put(key,value)
+	}
+	for i := n; i<old; i++ { e.out.Delete(chunkKey(key,i)) }
+	if e.pending==nil { e.pending = make(map[string]int) }
+	e.pending[string(key)] = n
+}
+func (e *chunkEncoder) Delete(key []byte) {
+	if e.reserved(key) { return }
+	old := e.oldCount(key)
+	e.out.Delete(key)
+	for i := 0; i<old; i++ { e.out.Delete(chunkKey(key,i)) }
+	if e.pending==nil { e.pending = make(map[string]int) }
+	e.pending[string(key)] = 0
+}
+
+type chunkedWriter struct{
+	chunkedReader
+	w BasicWriter
+	threshold int
+	mu *sync.Mutex
+}
+func (c chunkedWriter) apply(f func(e *chunkEncoder), wo *opt.WriteOptions) error {
+	if c.mu!=nil {
+		c.mu.Lock(); defer c.mu.Unlock()
+	}
+	e := &chunkEncoder{r:c.w,threshold:c.threshold}
+	f(e)
+	if e.err!=nil { return e.err }
+	return c.w.Write(&e.out,wo)
+}
+func (c chunkedWriter) Put(key, value []byte, wo *opt.WriteOptions) error {
+	return c.apply(func(e *chunkEncoder){ e.Put(key,value) },wo)
+}
+func (c chunkedWriter) Delete(key []byte, wo *opt.WriteOptions) error {
+	return c.apply(func(e *chunkEncoder){ e.Delete(key) },wo)
+}
+func (c chunkedWriter) Write(batch *leveldb.Batch, wo *opt.WriteOptions) error {
+	return c.apply(func(e *chunkEncoder){ batch.Replay(e) },wo)
+}
+
+type chunkedTable struct{
+	chunkedReader
+	inner TableDB
+	threshold int
+	mu sync.Mutex
+}
+func (t *chunkedTable) writer() chunkedWriter { return chunkedWriter{t.chunkedReader,t.inner,t.threshold,&t.mu} }
+
+// Reads of chunked values go through a snapshot, so that manifest and chunks match.
+func (t *chunkedTable) Get(key []byte, ro *opt.ReadOptions) ([]byte,error) {
+	v,err := t.inner.Get(key,ro)
+	if err!=nil || !bytes.HasPrefix(v,chunkMagic) { return v,err }
+	sn,err := t.inner.Snapshot()
+	if err!=nil { return nil,err }
+	defer sn.Release()
+	return chunkedReader{sn}.Get(key,ro)
+}
+func (t *chunkedTable) NewIterator(slice *util.Range, ro *opt.ReadOptions) iterator.Iterator {
+	sn,err := t.inner.Snapshot()
+	if err!=nil { return iterator.NewEmptyIterator(err) }
+	rd := chunkedReader{sn}
+	return &chunkedIterator{Iterator:sn.NewIterator(chunkRange(slice),ro),rd:rd,ro:ro,sn:sn}
+}
+func (t *chunkedTable) Put(key, value []byte, wo *opt.WriteOptions) error { return t.writer().Put(key,value,wo) }
+func (t *chunkedTable) Delete(key []byte, wo *opt.WriteOptions) error { return t.writer().Delete(key,wo) }
+func (t *chunkedTable) Write(batch *leveldb.Batch, wo *opt.WriteOptions) error { return t.writer().Write(batch,wo) }
+func (t *chunkedTable) Snapshot() (TableSnapshot,error) {
+	sn,err := t.inner.Snapshot()
+	if err!=nil { return nil,err }
+	return &chunkedSnapshot{chunkedReader{sn},sn},nil
+}
+func (t *chunkedTable) Begin() (TableTx,error) {
+	tx,err := t.inner.Begin()
+	if err!=nil { return nil,err }
+	return &chunkedTx{chunkedWriter{chunkedReader{tx},tx,t.threshold,nil},tx},nil
+}
+
+var _ TableDB = (*chunkedTable)(nil)
+
+type chunkedSnapshot struct{
+	chunkedReader
+	inner TableSnapshot
+}
+func (s *chunkedSnapshot) Release() { s.inner.Release() }
+
+type chunkedTx struct{
+	chunkedWriter
+	inner TableTx
+}
+func (t *chunkedTx) Commit() error { return t.inner.Commit() }
+func (t *chunkedTx) Discard() { t.inner.Discard() }
@@ -0,0 +1,108 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+package lstore
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// Counts the keys of the raw table, continuation keys included.
+func rawKeys(t *testing.T, st *Storage, table string) int {
+	t.Helper()
+	tbl,err := st.Table(table)
+	if err!=nil { t.Fatal(err) }
+	iter := tbl.NewIterator(nil,nil)
+	defer iter.Release()
+	n := 0
+	for iter.Next() { n++ }
+	return n
+}
+
+func TestChunked(t *testing.T) {
+	st := testStorage(t)
+	m := Complex(Chunked(st,8),0)
+	big := strings.Repeat("0123456789",5)
+	put(t,m,"t","big",big)
+	put(t,m,"t","small","abc")
+	if n := rawKeys(t,st,"t"); n!=2+7 { t.Errorf("got %d raw keys, want 9",n) }
+
+	tx := m.StartTx(READ_SNAPSHOT,WRITE_DISABLED)
+	u,err := tx.UTable("t")
+	if err!=nil { t.Fatal(err) }
+	if v := string(u.Read([]byte("big"))); v!=big { t.Errorf("got %q, want %q",v,big) }
+	var keys []string
+	iter := u.Iter()
+	for iter.Next() {
+		keys = append(keys,string(iter.Key()))
+		if string(iter.Key())=="big" && string(iter.Value())!=big { t.Errorf("iterator: got %q",iter.Value()) }
+	}
+	iter.Release()
+	tx.Discard()
+	if strings.Join(keys,",")!="big,small" { t.Errorf("got keys %v, want [big small]",keys) }
+
+	// Shrinking and deleting remove the superfluous chunks.
+	put(t,m,"t","big",big[:20])
+	if n := rawKeys(t,st,"t"); n!=2+3 { t.Errorf("got %d raw keys, want 5",n) }
+	put(t,m,"t","big","")
+	if n := rawKeys(t,st,"t"); n!=1 { t.Errorf("got %d raw keys, want 1",n) }
+}
+
+// Values, that look like a manifest, are chunked, so that they read back unchanged.
+func TestChunkedMagic(t *testing.T) {
+	m := Complex(Chunked(testStorage(t),64),0)
+	v := string(chunkMagic)+"x"
+	put(t,m,"t","k",v)
+	u,err := m.StartTx(READ_SNAPSHOT,WRITE_DISABLED).UTable("t")
+	if err!=nil { t.Fatal(err) }
+	if r := string(u.Read([]byte("k"))); r!=v { t.Errorf("got %q, want %q",r,v) }
+}
+
+func TestChunkedThreshold(t *testing.T) {
+	m := Complex(Chunked(testStorage(t),0),0)
+	big := bytes.Repeat([]byte("x"),DefaultChunkThreshold*2+1)
+	put(t,m,"t","k",string(big))
+	u,err := m.StartTx(READ_SNAPSHOT,WRITE_DISABLED).UTable("t")
+	if err!=nil { t.Fatal(err) }
+	if r := u.Read([]byte("k")); !bytes.Equal(r,big) { t.Errorf("got %d bytes, want %d",len(r),len(big)) }
+}
+
+func TestChunkedReservedKey(t *testing.T) {
+	db := Chunked(testStorage(t),8)
+	tbl,err := db.Table("t")
+	if err!=nil { t.Fatal(err) }
+	key := append(append([]byte(nil),ChunkPrefix...),'k')
+	if err = tbl.Put(key,[]byte("v"),nil); err!=ErrReservedKey { t.Errorf("Put: got %v, want ErrReservedKey",err) }
+	if err = tbl.Delete(ChunkPrefix,nil); err!=ErrReservedKey { t.Errorf("Delete: got %v, want ErrReservedKey",err) }
+
+	tx := Complex(db,0).StartTx(READ_SNAPSHOT,WRITE_CHECKED)
+	u,err := tx.UTable("t")
+	if err!=nil { t.Fatal(err) }
+	u.Write([]byte("a"),[]byte("v"))
+	u.Write(key,[]byte("v"))
+	if err = tx.Commit(); err!=ErrReservedKey { t.Errorf("Commit: got %v, want ErrReservedKey",err) }
+	if ok,_ := tbl.Has([]byte("a"),nil); ok { t.Error("the batch with the reserved key was written") }
+}
@@ -0,0 +1,130 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package lstore
+
+import (
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"sync/atomic"
+)
+
+// The table, that holds a commit to several tables, while it is applied.
+const CommitLogTable = "lstore-commitlog"
+
+var commitLogKey = []byte("commit")
+
+var syncWrite = &opt.WriteOptions{Sync:true}
+
+/*
+A UDBM, whose commits to several tables are atomic across crashes: such a
+commit is recorded in the commit log, before it is applied. If applying it
+fails, it is finished before anything else is written, or after a restart by
+RecoverCommit.
+*/
+type RecoverableUDBM interface{
+	UDBM
+
+	// Finishes the commit, that a crash interrupted. Call it after a restart,
+	// before starting new transactions.
+	RecoverCommit() error
+}
+
+// The batches of a commit by table, encoded as a batch of table names and batch dumps.
+func encodeCommit(batches map[string]*leveldb.Batch) []byte {
+	var rec leveldb.Batch
+	for name,b := range batches { rec.Put([]byte(name),b.Dump()) }
+	return rec.Dump()
+}
+
+type commitDecoder map[string]*leveldb.Batch
+func (d commitDecoder) Put(key, value []byte) {
+	b := new(leveldb.Batch)
+	if b.Load(bclone(value))==nil { d[string(key)] = b }
+}
+func (d commitDecoder) Delete(key []byte) {}
+
+func decodeCommit(data []byte) (map[string]*leveldb.Batch,error) {
+	var rec leveldb.Batch
+	if err := rec.Load(data); err!=nil { return nil,err }
+	d := make(commitDecoder)
+	if err := rec.Replay(d); err!=nil { return nil,err }
+	return d,nil
+}
+
+/*
+Records the commit in the commit log and applies it. If it could not be
+applied, it stays pending. The caller must hold the writer lock exclusively.
+*/
+func (m *txManager) logCommit(batches map[string]*leveldb.Batch) error {
+	log,err := m.inner.Table(CommitLogTable)
+	if err!=nil { return err }
+	if err = log.Put(commitLogKey,encodeCommit(batches),syncWrite); err!=nil { return err }
+	m.pending = batches
+	atomic.StoreInt32(&m.npending,1)
+	return m.applyPending()
+}
+
+/*
+Finishes the pending commit, that failed after it was logged, before anything
+else is written. The caller must hold the writer lock, shared or exclusively.
+*/
+func (m *txManager) redo() error {
+	if atomic.LoadInt32(&m.npending)==0 { return nil }
+	m.logMu.Lock(); defer m.logMu.Unlock()
+	if m.pending==nil { return nil }
+	return m.applyPending()
+}
+
+// Applies the pending commit again and removes it from the commit log.
+func (m *txManager) applyPending() error {
+	for name,b := range m.pending {
+		t,err := m.inner.Table(name)
+		if err!=nil { return err }
+		if err = t.Write(b,syncWrite); err!=nil { return err }
+	}
+	log,err := m.inner.Table(CommitLogTable)
+	if err!=nil { return err }
+	if err = log.Delete(commitLogKey,syncWrite); err!=nil { return err }
+	m.pending = nil
+	atomic.StoreInt32(&m.npending,0)
+	return nil
+}
+
+func (m *txManager) RecoverCommit() error {
+	m.writer.Lock(); defer m.writer.Unlock()
+	log,err := m.inner.Table(CommitLogTable)
+	if err!=nil { return err }
+	rec,err := log.Get(commitLogKey,&m.ro)
+	if err==leveldb.ErrNotFound {
+		m.pending = nil
+		atomic.StoreInt32(&m.npending,0)
+		return nil
+	}
+	if err!=nil { return err }
+	if m.pending,err = decodeCommit(rec); err!=nil { return err }
+	atomic.StoreInt32(&m.npending,1)
+	return m.applyPending()
+}
+
+var _ RecoverableUDBM = (*txManager)(nil)
@@ -0,0 +1,356 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package lstore
+
+import (
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"github.com/golang/snappy"
+	"compress/flate"
+	"hash/adler32"
+	"encoding/binary"
+	"io/ioutil"
+	"bytes"
+	"errors"
+	"sync"
+)
+
+var ErrUnknownCodec = errors.New("ErrUnknownCodec")
+var ErrUnknownDictionary = errors.New("ErrUnknownDictionary")
+var ErrInvalidLevel = errors.New("ErrInvalidLevel")
+var ErrNoDictionary = errors.New("ErrNoDictionary")
+
+/*
+Every compressed value starts with this header byte, followed by the codec.
+Values without it are read as they are. 0xc1 is never used by msgpack and
+can't start an UTF-8 text, so neither msgpack rows nor JSON documents are
+mistaken for compressed values.
+*/
+const ValueHeader = 0xc1
+
+type Codec uint8
+const (
+	// Stored with header, but uncompressed.
+	CODEC_NONE Codec = iota
+
+	CODEC_SNAPPY
+
+	CODEC_FLATE
+
+	// Flate with a preset dictionary, for small values.
+	// The header is followed by the Adler-32 checksum of the dictionary.
+	CODEC_FLATE_DICT
+)
+
+type CompressOptions struct{
+	Codec Codec
+
+	// Values below this size are stored with CODEC_NONE.
+	MinSize int
+
+	// The flate compression level, 0 means flate.DefaultCompression.
+	Level int
+
+	// The preset dictionary for CODEC_FLATE_DICT, it must not be empty.
+	Dictionary []byte
+
+	// Dictionaries, that were used before. Needed to read old values.
+	OldDictionaries [][]byte
+}
+
+type Compression struct{
+	Default CompressOptions
+
+	// Per-table options, that override the Default.
+	Tables map[string]CompressOptions
+}
+func (c *Compression) options(table string) *CompressOptions {
+	if o,ok := c.Tables[table]; ok { return &o }
+	o := c.Default
+	return &o
+}
+
+// Checks the options, so that encode can not fail.
+func (o *CompressOptions) check() error {
+	if o.Codec>CODEC_FLATE_DICT { return ErrUnknownCodec }
+	if o.Codec==CODEC_FLATE_DICT && len(o.Dictionary)==0 { return ErrNoDictionary }
+	if _,err := flate.NewWriter(ioutil.Discard,o.level()); err!=nil { return ErrInvalidLevel }
+	return nil
+}
+
+func (o *CompressOptions) level() int {
+	if o.Level==0 { return flate.DefaultCompression }
+	return o.Level
+}
+func (o *CompressOptions) dictionary(id uint32) []byte {
+	if o.Dictionary!=nil && adler32.Checksum(o.Dictionary)==id { return o.Dictionary }
+	for _,d := range o.OldDictionaries {
+		if adler32.Checksum(d)==id { return d }
+	}
+	return nil
+}
+
+func (o *CompressOptions) encode(value []byte) []byte {
+	codec := o.Codec
+	if len(value)<o.MinSize { codec = CODEC_NONE }
+	var buf bytes.Buffer
+	buf.WriteByte(ValueHeader)
+	buf.WriteByte(byte(codec))
+	switch codec {
+	case CODEC_SNAPPY:
+		buf.Write(snappy.Encode(nil,value))
+	case CODEC_FLATE,CODEC_FLATE_DICT:
+		var dict []byte
+		if codec==CODEC_FLATE_DICT {
+			dict = o.Dictionary
+			var id [4]byte
+			binary.BigEndian.PutUint32(id[:],adler32.Checksum(dict))
+			buf.Write(id[:])
+		}
+		// The level was checked by Compressed.
+		w,_ := flate.NewWriterDict(&buf,o.level(),dict)
+		w.Write(value)
+		w.Close()
+	default:
+		buf.Write(value)
+	}
+	return buf.Bytes()
+}
+
+func (o *CompressOptions) decode(v []byte) ([]byte,error) {
+	if len(v)<2 || v[0]!=ValueHeader { return v,nil }
+	switch Codec(v[1]) {
+	case CODEC_NONE:
+		return v[2:],nil
+	case CODEC_SNAPPY:
+		return snappy.Decode(nil,v[2:])
+	case CODEC_FLATE:
+		return ioutil.ReadAll(flate.NewReader(bytes.NewReader(v[2:])))
+	case CODEC_FLATE_DICT:
+		if len(v)<6 { return nil,ErrUnknownDictionary }
+		dict := o.dictionary(binary.BigEndian.Uint32(v[2:6]))
+		if dict==nil { return nil,ErrUnknownDictionary }
+		return ioutil.ReadAll(flate.NewReaderDict(bytes.NewReader(v[6:]),dict))
+	}
+	return nil,ErrUnknownCodec
+}
+
+// Reports, whether the raw value is already stored in the configured format.
+func (o *CompressOptions) current(v []byte) bool {
+	if len(v)<2 || v[0]!=ValueHeader { return false }
+	switch Codec(v[1]) {
+	case CODEC_NONE:
+		// Values below MinSize stay uncompressed.
+		return o.Codec==CODEC_NONE || len(v)-2<o.MinSize
+	case CODEC_FLATE_DICT:
+		return o.Codec==CODEC_FLATE_DICT && len(v)>=6 && binary.BigEndian.Uint32(v[2:6])==adler32.Checksum(o.Dictionary)
+	}
+	return Codec(v[1])==o.Codec
+}
+
+/*
+Compresses the values of the tables according to the given options. Every
+value, that is written, carries a header (see ValueHeader), so values, that
+were written without compression stay readable. Use RewriteCompressed to
+convert them.
+
+In order to combine compression with chunking, chunk the compressed values:
+
+	db,err := lstore.Compressed(lstore.Chunked(storage,1<<20),compression)
+
+It fails with ErrUnknownCodec or ErrInvalidLevel, if any of the options are
+invalid.
+*/
+func Compressed(db Database, c *Compression) (Database,error) {
+	if err := c.Default.check(); err!=nil { return nil,err }
+	for _,o := range c.Tables {
+		if err := o.check(); err!=nil { return nil,err }
+	}
+	return &compressedDB{inner:db,c:c},nil
+}
+
+type compressedDB struct{
+	inner Database
+	c *Compression
+	mu sync.Mutex
+	tables map[string]*compressedTable
+}
+func (c *compressedDB) Table(name string) (TableDB,error) {
+	c.mu.Lock(); defer c.mu.Unlock()
+	if t := c.tables[name]; t!=nil { return t,nil }
+	t,err := c.inner.Table(name)
+	if err!=nil { return nil,err }
+	o := c.c.options(name)
+	ct := &compressedTable{compressedWriter{compressedReader{t,o},t},t}
+	if c.tables==nil { c.tables = make(map[string]*compressedTable) }
+	c.tables[name] = ct
+	return ct,nil
+}
+
+// --------------------------------------------------------------------------
+
+type compressedReader struct{
+	r BasicReader
+	o *CompressOptions
+}
+func (c compressedReader) Get(key []byte, ro *opt.ReadOptions) ([]byte,error) {
+	v,err := c.r.Get(key,ro)
+	if err!=nil { return nil,err }
+	return c.o.decode(v)
+}
+func (c compressedReader) Has(key []byte, ro *opt.ReadOptions) (bool,error) {
+	return c.r.Has(key,ro)
+}
+func (c compressedReader) NewIterator(slice *util.Range, ro *opt.ReadOptions) iterator.Iterator {
+	return &compressedIterator{Iterator:c.r.NewIterator(slice,ro),o:c.o}
+}
+
+type compressedIterator struct{
+	iterator.Iterator
+	o *CompressOptions
+	err error
+}
+func (i *compressedIterator) Value() []byte {
+	v,err := i.o.decode(i.Iterator.Value())
+	if err!=nil { i.err = err }
+	return v
+}
+func (i *compressedIterator) Error() error {
+	if i.err!=nil { return i.err }
+	return i.Iterator.Error()
+}
+
+type compressEncoder struct{
+	out leveldb.Batch
+	o *CompressOptions
+}
+func (e *compressEncoder) Put(key, value []byte) { e.out.Put(key,e.o.encode(value)) }
+func (e *compressEncoder) Delete(key []byte) { e.out.Delete(key) }
+
+type compressedWriter struct{
+	compressedReader
+	w BasicWriter
+}
+func (c compressedWriter) Put(key, value []byte, wo *opt.WriteOptions) error {
+	return c.w.Put(key,c.o.encode(value),wo)
+}
+func (c compressedWriter) Delete(key []byte, wo *opt.WriteOptions) error {
+	return c.w.Delete(key,wo)
+}
+func (c compressedWriter) Write(batch *leveldb.Batch, wo *opt.WriteOptions) error {
+	e := &compressEncoder{o:c.o}
+	batch.Replay(e)
+	return c.w.Write(&e.out,wo)
+}
+
+type compressedTable struct{
+	compressedWriter
+	inner TableDB
+}
+func (t *compressedTable) Snapshot() (TableSnapshot,error) {
+	sn,err := t.inner.Snapshot()
+	if err!=nil { return nil,err }
+	return &compressedSnapshot{compressedReader{sn,t.o},sn},nil
+}
+func (t *compressedTable) Begin() (TableTx,error) {
+	tx,err := t.inner.Begin()
+	if err!=nil { return nil,err }
+	return &compressedTx{compressedWriter{compressedReader{tx,t.o},tx},tx},nil
+}
+
+var _ TableDB = (*compressedTable)(nil)
+
+type compressedSnapshot struct{
+	compressedReader
+	inner TableSnapshot
+}
+func (s *compressedSnapshot) Release() { s.inner.Release() }
+
+type compressedTx struct{
+	compressedWriter
+	inner TableTx
+}
+func (t *compressedTx) Commit() error { return t.inner.Commit() }
+func (t *compressedTx) Discard() { t.inner.Discard() }
+
+// --------------------------------------------------------------------------
+
+/*
+Rewrites every value of the table, that is not stored in the configured
+format, in batches of batchSize values. Every batch is rewritten within a
+transaction of the underlying table and only values, that were not changed
+in the meantime, are rewritten. The rewrite stops early, if stop is closed.
+It is meant to be run in the background:
+
+	go lstore.RewriteCompressed(db,"json_docs",256,stop)
+*/
+func RewriteCompressed(db Database, table string, batchSize int, stop <-chan struct{}) error {
+	cdb,ok := db.(*compressedDB)
+	if !ok { return errors.New("RewriteCompressed: not a compressed database") }
+	t,err := cdb.Table(table)
+	if err!=nil { return err }
+	ct := t.(*compressedTable)
+
+	var start []byte
+	for {
+		select {
+		case <-stop: return nil
+		default:
+		}
+
+		// Collect the next batch of keys to convert.
+		var keys,olds [][]byte
+		iter := ct.inner.NewIterator(&util.Range{Start:start},nil)
+		for iter.Next() {
+			start = append(bclone(iter.Key()),0)
+			if ct.o.current(iter.Value()) { continue }
+			keys = append(keys,bclone(iter.Key()))
+			olds = append(olds,bclone(iter.Value()))
+			if len(keys)>=batchSize { break }
+		}
+		err = iter.Error()
+		iter.Release()
+		if err!=nil { return err }
+		if len(keys)==0 { return nil }
+
+		tx,err := ct.inner.Begin()
+		if err!=nil { return err }
+		var batch leveldb.Batch
+		for i,key := range keys {
+			cur,err := tx.Get(key,nil)
+			if err!=nil || !bytes.Equal(cur,olds[i]) { continue } // Changed or deleted.
+			val,err := ct.o.decode(cur)
+			if err!=nil { continue }
+			batch.Put(key,ct.o.encode(val))
+		}
+		if err = tx.Write(&batch,nil); err!=nil {
+			tx.Discard()
+			return err
+		}
+		if err = tx.Commit(); err!=nil { return err }
+		if len(keys)<batchSize { return nil }
+	}
+}
@@ -0,0 +1,124 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+package lstore
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func compressed(t *testing.T, db Database, o CompressOptions) Database {
+	t.Helper()
+	cdb,err := Compressed(db,&Compression{Default:o})
+	if err!=nil { t.Fatal(err) }
+	return cdb
+}
+
+// Returns the codec of the raw value of the key.
+func rawCodec(t *testing.T, st *Storage, table, key string) Codec {
+	t.Helper()
+	tbl,err := st.Table(table)
+	if err!=nil { t.Fatal(err) }
+	v,err := tbl.Get([]byte(key),nil)
+	if err!=nil { t.Fatal(err) }
+	if len(v)<2 || v[0]!=ValueHeader { t.Fatalf("%s: no value header: %q",key,v) }
+	return Codec(v[1])
+}
+
+func read(t *testing.T, m UDBM, table, key string) string {
+	t.Helper()
+	u,err := m.StartTx(READ_SNAPSHOT,WRITE_DISABLED).UTable(table)
+	if err!=nil { t.Fatal(err) }
+	return string(u.Read([]byte(key)))
+}
+
+var testDict = []byte(`{"name":"","value":""}`)
+
+func TestCompressed(t *testing.T) {
+	doc := strings.Repeat(`{"name":"x","value":"abcabcabc"}`,20)
+	for _,o := range []CompressOptions{
+		{Codec:CODEC_NONE},
+		{Codec:CODEC_SNAPPY},
+		{Codec:CODEC_FLATE,Level:9},
+		{Codec:CODEC_FLATE_DICT,Dictionary:testDict},
+	} {
+		st := testStorage(t)
+		m := Complex(compressed(t,st,o),0)
+		put(t,m,"t","k",doc)
+		if c := rawCodec(t,st,"t","k"); c!=o.Codec { t.Errorf("codec %d: stored as %d",o.Codec,c) }
+		if v := read(t,m,"t","k"); v!=doc { t.Errorf("codec %d: got %q",o.Codec,v) }
+	}
+}
+
+func TestCompressedPlain(t *testing.T) {
+	st := testStorage(t)
+	put(t,Complex(st,0),"t","k","plain")
+	if v := read(t,Complex(compressed(t,st,CompressOptions{Codec:CODEC_SNAPPY}),0),"t","k"); v!="plain" { t.Errorf("got %q, want %q",v,"plain") }
+}
+
+func TestCompressedOldDictionary(t *testing.T) {
+	st := testStorage(t)
+	put(t,Complex(compressed(t,st,CompressOptions{Codec:CODEC_FLATE_DICT,Dictionary:testDict}),0),"t","k","value")
+	m := Complex(compressed(t,st,CompressOptions{Codec:CODEC_FLATE_DICT,Dictionary:[]byte("new"),OldDictionaries:[][]byte{testDict}}),0)
+	if v := read(t,m,"t","k"); v!="value" { t.Errorf("got %q, want %q",v,"value") }
+}
+
+func TestCompressedInvalid(t *testing.T) {
+	st := testStorage(t)
+	if _,err := Compressed(st,&Compression{Default:CompressOptions{Codec:CODEC_FLATE,Level:42}}); err!=ErrInvalidLevel { t.Errorf("got %v, want ErrInvalidLevel",err) }
+	c := &Compression{Tables:map[string]CompressOptions{"t":{Codec:CODEC_FLATE_DICT+1}}}
+	if _,err := Compressed(st,c); err!=ErrUnknownCodec { t.Errorf("got %v, want ErrUnknownCodec",err) }
+	c = &Compression{Tables:map[string]CompressOptions{"t":{Codec:CODEC_FLATE_DICT}}}
+	if _,err := Compressed(st,c); err!=ErrNoDictionary { t.Errorf("got %v, want ErrNoDictionary",err) }
+}
+
+func TestRewriteCompressed(t *testing.T) {
+	st := testStorage(t)
+	big := strings.Repeat("abc",100)
+	m := Complex(st,0)
+	put(t,m,"t","plain",big)
+	m = Complex(compressed(t,st,CompressOptions{Codec:CODEC_NONE}),0)
+	put(t,m,"t","none",big)
+	put(t,m,"t","small","abc")
+
+	o := CompressOptions{Codec:CODEC_SNAPPY,MinSize:16}
+	cdb := compressed(t,st,o)
+	if err := RewriteCompressed(cdb,"t",1,nil); err!=nil { t.Fatal(err) }
+	for key,want := range map[string]Codec{"plain":CODEC_SNAPPY,"none":CODEC_SNAPPY,"small":CODEC_NONE} {
+		if c := rawCodec(t,st,"t",key); c!=want { t.Errorf("%s: stored as %d, want %d",key,c,want) }
+	}
+	m = Complex(cdb,0)
+	for key,want := range map[string]string{"plain":big,"none":big,"small":"abc"} {
+		if v := read(t,m,"t",key); v!=want { t.Errorf("%s: got %q",key,v) }
+	}
+
+	// Values, that are current, are left alone.
+	tbl,_ := st.Table("t")
+	before,_ := tbl.Get([]byte("none"),nil)
+	if err := RewriteCompressed(cdb,"t",1,nil); err!=nil { t.Fatal(err) }
+	after,_ := tbl.Get([]byte("none"),nil)
+	if !bytes.Equal(before,after) { t.Error("a current value was rewritten") }
+}
@@ -0,0 +1,154 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package lstore
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// The commit decision is logged, but not every participant has committed yet.
+var ErrInDoubt = errors.New("ErrInDoubt")
+
+var decisionCommit = []byte("C")
+
+/*
+Drives two-phase commits over several participants. The commit decisions are
+logged durably in Log, which should live in its own storage, or in the storage
+of one of the participants. A transaction without a logged decision is
+considered aborted (presumed abort).
+
+After a restart, call Recover() before starting new transactions.
+*/
+type Coordinator struct{
+	Participants []TwoPhaseUDBM
+	Log TableDB
+}
+
+// A distributed transaction, that spans all participants.
+type DistTx struct{
+	c *Coordinator
+	txs []UDB
+}
+
+// Starts a transaction on every participant.
+func (c *Coordinator) StartTx(r ReadIso, w WriteIso) *DistTx {
+	d := &DistTx{c:c,txs:make([]UDB,len(c.Participants))}
+	for i,p := range c.Participants { d.txs[i] = p.StartTx(r,w) }
+	return d
+}
+
+// Returns the transaction on the i-th participant.
+func (d *DistTx) UDB(i int) UDB { return d.txs[i] }
+
+func (d *DistTx) Discard() {
+	for _,tx := range d.txs { tx.Discard() }
+}
+
+func newTxid() []byte {
+	id := make([]byte,16)
+	binary.BigEndian.PutUint64(id,uint64(time.Now().UnixNano()))
+	rand.Read(id[8:])
+	return id
+}
+
+/*
+Prepares the transaction on every participant, logs the decision and commits
+the prepared transactions. If the decision is logged, but not every
+participant could commit, an error wrapping ErrInDoubt is returned and the
+remaining participants are completed by Recover().
+*/
+func (d *DistTx) Commit() error {
+	txid := newTxid()
+	for i,tx := range d.txs {
+		ptx,ok := tx.(PreparableUDB)
+		var err error
+		if !ok {
+			tx.Discard()
+			err = ErrNotPreparable
+		} else {
+			err = ptx.Prepare(txid)
+		}
+		if err==nil { continue }
+		for j := 0; j<i; j++ { d.c.Participants[j].AbortPrepared(txid) }
+		for _,rest := range d.txs[i+1:] { rest.Discard() }
+		return err
+	}
+
+	if err := d.c.Log.Put(txid,decisionCommit,syncWrite); err!=nil {
+		for _,p := range d.c.Participants { p.AbortPrepared(txid) }
+		return err
+	}
+
+	var gerr error
+	for _,p := range d.c.Participants {
+		if err := p.CommitPrepared(txid); err!=nil && gerr==nil { gerr = err }
+	}
+	if gerr!=nil { return fmt.Errorf("%w: %v",ErrInDoubt,gerr) }
+	return d.c.Log.Delete(txid,syncWrite)
+}
+
+/*
+Resolves the in-doubt transactions of all participants: Transactions with a
+logged decision are committed, all others are aborted. Afterwards, the
+decisions, that are no longer needed, are removed from the log.
+*/
+func (c *Coordinator) Recover() error {
+	pending := make(map[string]bool)
+	for _,p := range c.Participants {
+		ids,err := p.Recover()
+		if err!=nil { return err }
+		for _,id := range ids {
+			ok,err := c.Log.Has(id,nil)
+			if err!=nil { return err }
+			if ok {
+				err = p.CommitPrepared(id)
+			} else {
+				err = p.AbortPrepared(id)
+			}
+			if err!=nil {
+				pending[string(id)] = true
+				continue
+			}
+		}
+	}
+
+	iter := c.Log.NewIterator(nil,nil)
+	var done [][]byte
+	for iter.Next() {
+		if pending[string(iter.Key())] { continue }
+		done = append(done,bclone(iter.Key()))
+	}
+	err := iter.Error()
+	iter.Release()
+	if err!=nil { return err }
+	for _,id := range done {
+		if err = c.Log.Delete(id,syncWrite); err!=nil { return err }
+	}
+	if len(pending)>0 { return ErrInDoubt }
+	return nil
+}
@@ -0,0 +1,170 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package faultdb
+
+import (
+	"github.com/mad-day/hobbydb/lstore"
+	"fmt"
+)
+
+var modeNames = map[lstore.WriteIso]string{
+	lstore.WRITE_CHECKED: "WRITE_CHECKED",
+	lstore.WRITE_COMMIT: "WRITE_COMMIT",
+	lstore.WRITE_INSTANT_ATOMIC: "WRITE_INSTANT_ATOMIC",
+	lstore.WRITE_INSTANT: "WRITE_INSTANT",
+	lstore.WRITE_DISABLED: "WRITE_DISABLED",
+}
+
+// A violated atomicity guarantee, as found by CheckAtomicity.
+type Violation struct{
+	Mode  lstore.WriteIso
+	Round int
+	Msg   string
+}
+func (v Violation) String() string {
+	return fmt.Sprintf("%s round %d: %s",modeNames[v.Mode],v.Round,v.Msg)
+}
+
+var checkTables = []string{"a","b"}
+var checkKeys = []string{"k1","k2"}
+
+/*
+Runs the given number of rounds for every WriteIso mode against a
+fault-injecting wrapper around inner, and returns the violated guarantees.
+
+Every round writes a new value into two keys of two tables. Afterwards, the
+state is read back with fault injection disabled and checked:
+
+	WRITE_CHECKED, WRITE_COMMIT: Either all writes or none are visible. If
+	the commit succeeded, all writes are visible.
+
+	WRITE_INSTANT_ATOMIC, WRITE_INSTANT: Every key holds either the old or the
+	new value. If the write succeeded, the new value is visible.
+
+	WRITE_DISABLED: No write succeeds and nothing is changed.
+
+Before the state is read, the restarted txManager finishes the interrupted
+commit (see lstore.RecoverableUDBM).
+*/
+func CheckAtomicity(inner lstore.Database, optim lstore.Flags, s Schedule, rounds int) (vs []Violation) {
+	for mode := lstore.WRITE_CHECKED; mode<=lstore.WRITE_DISABLED; mode++ {
+		ms := s
+		ms.Seed += int64(mode)
+		vs = append(vs,checkMode(inner,optim,ms,rounds,mode)...)
+	}
+	return
+}
+
+func checkMode(inner lstore.Database, optim lstore.Flags, s Schedule, rounds int, mode lstore.WriteIso) (vs []Violation) {
+	fdb := New(inner,s)
+	mgr := lstore.Complex(fdb,optim)
+	tname := func(t string) string { return fmt.Sprintf("fault_%d_%s",mode,t) }
+	report := func(round int, format string, args ...interface{}) {
+		vs = append(vs,Violation{mode,round,fmt.Sprintf(format,args...)})
+	}
+
+	read := func() (map[string]string,error) {
+		st := make(map[string]string)
+		udb := lstore.Simplistic(inner)
+		for _,t := range checkTables {
+			ut,err := udb.UTable(tname(t))
+			if err!=nil { return nil,err }
+			for _,k := range checkKeys {
+				st[t+"/"+k] = string(ut.Read([]byte(k)))
+			}
+		}
+		return st,nil
+	}
+
+	old,err := read()
+	if err!=nil {
+		report(0,"initial read: %v",err)
+		return
+	}
+
+	for round := 1; round<=rounds; round++ {
+		nv := fmt.Sprint(round)
+		written := make(map[string]bool)
+
+		udb := mgr.StartTx(lstore.READ_SNAPSHOT,mode)
+		var cerr error
+		for _,t := range checkTables {
+			ut,err := udb.UTable(tname(t))
+			if err!=nil { cerr = err; break }
+			for _,k := range checkKeys {
+				written[t+"/"+k] = ut.Write([]byte(k),[]byte(nv))==nil
+			}
+		}
+		if cerr==nil {
+			cerr = udb.Commit()
+		} else {
+			udb.Discard()
+		}
+
+		fdb.SetEnabled(false)
+		fdb.Restart()
+		if rm,ok := mgr.(lstore.RecoverableUDBM); ok {
+			if err = rm.RecoverCommit(); err!=nil {
+				fdb.SetEnabled(true)
+				report(round,"recovery: %v",err)
+				return
+			}
+		}
+		cur,err := read()
+		fdb.SetEnabled(true)
+		if err!=nil {
+			report(round,"verification read: %v",err)
+			return
+		}
+
+		nnew := 0
+		for key,v := range cur {
+			switch v {
+			case nv: nnew++
+			case old[key]:
+			default: report(round,"%s holds %q, neither old %q nor new %q",key,v,old[key],nv)
+			}
+		}
+
+		switch mode {
+		case lstore.WRITE_CHECKED,lstore.WRITE_COMMIT:
+			if cerr==nil && nnew!=len(cur) {
+				report(round,"commit succeeded, but only %d of %d writes are visible",nnew,len(cur))
+			} else if nnew!=0 && nnew!=len(cur) {
+				report(round,"torn commit (%v): %d of %d writes are visible",cerr,nnew,len(cur))
+			}
+		case lstore.WRITE_INSTANT_ATOMIC,lstore.WRITE_INSTANT:
+			for key,ok := range written {
+				if ok && cur[key]!=nv { report(round,"write to %s succeeded, but is not visible",key) }
+			}
+		case lstore.WRITE_DISABLED:
+			for key,ok := range written {
+				if ok { report(round,"write to %s succeeded on a read-only transaction",key) }
+			}
+			if nnew!=0 { report(round,"read-only transaction changed %d keys",nnew) }
+		}
+		old = cur
+	}
+	return
+}
@@ -0,0 +1,298 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+/*
+A fault-injecting lstore.Database for crash-consistency testing.
+
+Every operation on the wrapped tables consults a seeded schedule, that decides,
+whether the operation fails, is applied only partially, is delayed or whether
+the simulated process dies. After a simulated crash, every operation fails with
+ErrCrashed until Restart() is called. The data, that was written before the
+crash, stays in the inner database, just like it would on disk.
+*/
+package faultdb
+
+import (
+	"github.com/mad-day/hobbydb/lstore"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"math/rand"
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrInjected = errors.New("ErrInjected")
+var ErrCrashed = errors.New("ErrCrashed")
+
+/*
+The fault schedule. All rates are probabilities between 0 and 1, that are
+evaluated for each operation.
+*/
+type Schedule struct{
+	Seed int64
+
+	// Failing reads (Get, Has, NewIterator).
+	ReadErrorRate float64
+
+	// Failing writes, nothing is applied.
+	WriteErrorRate float64
+
+	// Batch writes, that apply a prefix of the batch and fail. Batches are
+	// atomic in goleveldb, so this only models storage, that is not. Without
+	// O_UseTransaction, the txManager can not commit atomically on top of it.
+	PartialRate float64
+
+	// Simulated process death at a write. The write itself is either applied
+	// completely or not at all.
+	CrashRate float64
+
+	// Every operation is delayed up to MaxLatency.
+	MaxLatency time.Duration
+}
+
+type fault uint8
+const (
+	fNone fault = iota
+	fError
+	fPartial
+	fCrash
+)
+
+type Database struct{
+	Inner lstore.Database
+	sched Schedule
+
+	mu sync.Mutex
+	rnd *rand.Rand
+	crashed bool
+	disabled bool
+}
+
+func New(inner lstore.Database, s Schedule) *Database {
+	return &Database{Inner:inner,sched:s,rnd:rand.New(rand.NewSource(s.Seed))}
+}
+
+// Reports, whether the simulated process has died.
+func (d *Database) Crashed() bool {
+	d.mu.Lock(); defer d.mu.Unlock()
+	return d.crashed
+}
+
+// Simulates a restart of the process after a crash.
+func (d *Database) Restart() {
+	d.mu.Lock(); defer d.mu.Unlock()
+	d.crashed = false
+}
+
+// Disables or re-enables fault injection. Useful for verifying the state.
+func (d *Database) SetEnabled(on bool) {
+	d.mu.Lock(); defer d.mu.Unlock()
+	d.disabled = !on
+}
+
+func (d *Database) coin(rate float64) bool {
+	return rate>0 && d.rnd.Float64()<rate
+}
+
+func (d *Database) decide(write bool) (f fault, err error) {
+	var delay time.Duration
+	d.mu.Lock()
+	switch {
+	case d.crashed:
+		err = ErrCrashed
+	case d.disabled:
+	case !write:
+		if d.coin(d.sched.ReadErrorRate) { f,err = fError,ErrInjected }
+	case d.coin(d.sched.CrashRate):
+		f,err = fCrash,ErrCrashed
+		d.crashed = true
+	case d.coin(d.sched.WriteErrorRate):
+		f,err = fError,ErrInjected
+	case d.coin(d.sched.PartialRate):
+		f,err = fPartial,ErrInjected
+	}
+	if !d.disabled && d.sched.MaxLatency>0 {
+		delay = time.Duration(d.rnd.Int63n(int64(d.sched.MaxLatency)))
+	}
+	d.mu.Unlock()
+	if delay>0 { time.Sleep(delay) }
+	return
+}
+func (d *Database) intn(n int) int {
+	d.mu.Lock(); defer d.mu.Unlock()
+	return d.rnd.Intn(n)
+}
+
+func (d *Database) Table(name string) (lstore.TableDB,error) {
+	if _,err := d.decide(false); err!=nil { return nil,err }
+	t,err := d.Inner.Table(name)
+	if err!=nil { return nil,err }
+	return &table{faultReader{d,t},t},nil
+}
+
+var _ lstore.Database = (*Database)(nil)
+
+// --------------------------------------------------------------------------
+
+type faultReader struct{
+	db *Database
+	r lstore.BasicReader
+}
+func (f faultReader) Get(key []byte, ro *opt.ReadOptions) ([]byte, error) {
+	if _,err := f.db.decide(false); err!=nil { return nil,err }
+	return f.r.Get(key,ro)
+}
+func (f faultReader) Has(key []byte, ro *opt.ReadOptions) (bool, error) {
+	if _,err := f.db.decide(false); err!=nil { return false,err }
+	return f.r.Has(key,ro)
+}
+func (f faultReader) NewIterator(slice *util.Range, ro *opt.ReadOptions) iterator.Iterator {
+	if _,err := f.db.decide(false); err!=nil { return iterator.NewEmptyIterator(err) }
+	return f.r.NewIterator(slice,ro)
+}
+
+// Copies the first n operations of a batch.
+type prefixReplay struct{
+	leveldb.Batch
+	n int
+}
+func (p *prefixReplay) Put(key, value []byte) {
+	if p.n<=0 { return }
+	p.n--
+	p.Batch.Put(key,value)
+}
+func (p *prefixReplay) Delete(key []byte) {
+	if p.n<=0 { return }
+	p.n--
+	p.Batch.Delete(key)
+}
+
+type faultWriter struct{
+	faultReader
+	w lstore.BasicWriter
+}
+func (f faultWriter) Put(key, value []byte, wo *opt.WriteOptions) error {
+	flt,err := f.db.decide(true)
+	switch flt {
+	case fNone:
+		if err!=nil { return err }
+		return f.w.Put(key,value,wo)
+	case fCrash:
+		if f.db.intn(2)==0 { f.w.Put(key,value,wo) }
+	}
+	return err
+}
+func (f faultWriter) Delete(key []byte, wo *opt.WriteOptions) error {
+	flt,err := f.db.decide(true)
+	switch flt {
+	case fNone:
+		if err!=nil { return err }
+		return f.w.Delete(key,wo)
+	case fCrash:
+		if f.db.intn(2)==0 { f.w.Delete(key,wo) }
+	}
+	return err
+}
+func (f faultWriter) Write(batch *leveldb.Batch, wo *opt.WriteOptions) error {
+	flt,err := f.db.decide(true)
+	switch flt {
+	case fNone:
+		if err!=nil { return err }
+		return f.w.Write(batch,wo)
+	case fPartial:
+		if batch.Len()==0 { break }
+		p := &prefixReplay{n:f.db.intn(batch.Len())}
+		batch.Replay(p)
+		f.w.Write(&p.Batch,wo)
+	case fCrash:
+		if f.db.intn(2)==0 { f.w.Write(batch,wo) }
+	}
+	return err
+}
+
+type table struct{
+	faultReader
+	inner lstore.TableDB
+}
+func (t *table) writer() faultWriter { return faultWriter{t.faultReader,t.inner} }
+func (t *table) Put(key, value []byte, wo *opt.WriteOptions) error { return t.writer().Put(key,value,wo) }
+func (t *table) Delete(key []byte, wo *opt.WriteOptions) error { return t.writer().Delete(key,wo) }
+func (t *table) Write(batch *leveldb.Batch, wo *opt.WriteOptions) error { return t.writer().Write(batch,wo) }
+func (t *table) Snapshot() (lstore.TableSnapshot,error) {
+	if _,err := t.db.decide(false); err!=nil { return nil,err }
+	sn,err := t.inner.Snapshot()
+	if err!=nil { return nil,err }
+	return &snapshot{faultReader{t.db,sn},sn},nil
+}
+func (t *table) Begin() (lstore.TableTx,error) {
+	if _,err := t.db.decide(true); err!=nil { return nil,err }
+	tx,err := t.inner.Begin()
+	if err!=nil { return nil,err }
+	return &tableTx{faultWriter{faultReader{t.db,tx},tx},tx},nil
+}
+
+var _ lstore.TableDB = (*table)(nil)
+
+type snapshot struct{
+	faultReader
+	inner lstore.TableSnapshot
+}
+func (s *snapshot) Release() { s.inner.Release() }
+
+/*
+A transaction of the inner table. Every failed operation discards it, so that
+it never outlives the error (an open goleveldb transaction blocks the next
+one).
+*/
+type tableTx struct{
+	faultWriter
+	inner lstore.TableTx
+}
+func (t *tableTx) fail(err error) error {
+	if err!=nil { t.inner.Discard() }
+	return err
+}
+func (t *tableTx) Put(key, value []byte, wo *opt.WriteOptions) error { return t.fail(t.faultWriter.Put(key,value,wo)) }
+func (t *tableTx) Delete(key []byte, wo *opt.WriteOptions) error { return t.fail(t.faultWriter.Delete(key,wo)) }
+func (t *tableTx) Write(batch *leveldb.Batch, wo *opt.WriteOptions) error { return t.fail(t.faultWriter.Write(batch,wo)) }
+func (t *tableTx) Commit() error {
+	flt,err := t.db.decide(true)
+	switch flt {
+	case fNone:
+		if err!=nil { break }
+		return t.inner.Commit()
+	case fCrash:
+		if t.db.intn(2)==0 {
+			t.inner.Commit()
+			return err
+		}
+	}
+	t.inner.Discard()
+	return err
+}
+func (t *tableTx) Discard() { t.inner.Discard() }
+
+var _ lstore.TableTx = (*tableTx)(nil)
@@ -0,0 +1,164 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+package faultdb
+
+import (
+	"github.com/mad-day/hobbydb/lstore"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func testStorage(t *testing.T) *lstore.Storage {
+	d,err := ioutil.TempDir("","faultdb")
+	if err!=nil { t.Fatal(err) }
+	t.Cleanup(func(){ os.RemoveAll(d) })
+	return &lstore.Storage{Basepath:d}
+}
+
+var testSchedule = Schedule{
+	Seed: 1,
+	ReadErrorRate: 0.05,
+	WriteErrorRate: 0.05,
+	CrashRate: 0.05,
+}
+
+func TestCheckAtomicity(t *testing.T) {
+	for _,optim := range []lstore.Flags{0,lstore.O_ConcurrentCommit,lstore.O_UseTransaction} {
+		for _,v := range CheckAtomicity(testStorage(t),optim,testSchedule,200) { t.Errorf("optim=%d: %v",optim,v) }
+	}
+}
+
+// Torn batches are rolled back with the transaction, that they were written to.
+func TestCheckAtomicityPartial(t *testing.T) {
+	s := testSchedule
+	s.PartialRate = 0.05
+	for _,v := range CheckAtomicity(testStorage(t),lstore.O_UseTransaction,s,200) { t.Error(v) }
+}
+
+func (d *Database) crash() {
+	d.mu.Lock(); defer d.mu.Unlock()
+	d.crashed = true
+}
+
+// Begins a transaction on the table, failing the test, if it blocks.
+func beginTimeout(t *testing.T, tbl lstore.TableDB) lstore.TableTx {
+	t.Helper()
+	ch := make(chan lstore.TableTx,1)
+	go func() {
+		tx,err := tbl.Begin()
+		if err!=nil { t.Error(err) }
+		ch <- tx
+	}()
+	select {
+	case tx := <-ch: return tx
+	case <-time.After(5*time.Second): t.Fatal("Begin blocks, the previous transaction leaked")
+	}
+	return nil
+}
+
+func TestCrashDiscardsTx(t *testing.T) {
+	d := New(testStorage(t),Schedule{})
+	tbl,err := d.Table("t")
+	if err!=nil { t.Fatal(err) }
+
+	// Crash at the commit.
+	tx := beginTimeout(t,tbl)
+	if err = tx.Put([]byte("k"),[]byte("v"),nil); err!=nil { t.Fatal(err) }
+	d.crash()
+	if err = tx.Commit(); err!=ErrCrashed { t.Fatalf("got %v, want ErrCrashed",err) }
+	d.Restart()
+
+	// Crash at a write.
+	tx = beginTimeout(t,tbl)
+	d.crash()
+	if err = tx.Put([]byte("k"),[]byte("v"),nil); err!=ErrCrashed { t.Fatalf("got %v, want ErrCrashed",err) }
+	d.Restart()
+
+	tx = beginTimeout(t,tbl)
+	tx.Discard()
+	if ok,_ := tbl.Has([]byte("k"),nil); ok { t.Error("the writes of the crashed transactions are visible") }
+}
+
+var errWrite = errors.New("write failed")
+
+// A Database, whose table "b" fails every write, while fail is set.
+type failB struct{
+	lstore.Database
+	fail *bool
+}
+func (f failB) Table(name string) (lstore.TableDB,error) {
+	t,err := f.Database.Table(name)
+	if err!=nil || name!="b" { return t,err }
+	return failWrites{t,f.fail},nil
+}
+type failWrites struct{
+	lstore.TableDB
+	fail *bool
+}
+func (f failWrites) Write(batch *leveldb.Batch, wo *opt.WriteOptions) error {
+	if *f.fail { return errWrite }
+	return f.TableDB.Write(batch,wo)
+}
+
+/*
+A commit to several tables, that fails half-way, is finished before anything
+else is written, or by RecoverCommit.
+*/
+func TestCommitAtomic(t *testing.T) {
+	st := testStorage(t)
+	fail := true
+	m := lstore.Complex(failB{st,&fail},0)
+	write := func(v string) error {
+		tx := m.StartTx(lstore.READ_SNAPSHOT,lstore.WRITE_CHECKED)
+		for _,tn := range []string{"a","b"} {
+			u,err := tx.UTable(tn)
+			if err!=nil { t.Fatal(err) }
+			for _,k := range []string{"k1","k2"} { u.Write([]byte(k),[]byte(v)) }
+		}
+		return tx.Commit()
+	}
+	read := func(tn string) (string,string) {
+		u,err := lstore.Simplistic(st).UTable(tn)
+		if err!=nil { t.Fatal(err) }
+		return string(u.Read([]byte("k1"))),string(u.Read([]byte("k2")))
+	}
+	if err := write("1"); err!=errWrite { t.Fatalf("got %v, want errWrite",err) }
+	if err := write("2"); err!=errWrite { t.Fatalf("a commit succeeded before the failed one was finished: %v",err) }
+
+	// After a restart.
+	fail = false
+	m = lstore.Complex(failB{st,&fail},0)
+	if err := m.(lstore.RecoverableUDBM).RecoverCommit(); err!=nil { t.Fatal(err) }
+	if b1,b2 := read("b"); b1!="1" || b2!="1" { t.Errorf("table b: got %q %q, want the failed commit",b1,b2) }
+	if err := write("3"); err!=nil { t.Fatal(err) }
+	for _,tn := range []string{"a","b"} {
+		if v1,v2 := read(tn); v1!="3" || v2!="3" { t.Errorf("table %s: got %q %q",tn,v1,v2) }
+	}
+}
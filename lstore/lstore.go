@@ -25,6 +25,7 @@ package lstore
 
 import (
 	"path/filepath"
+	"io/ioutil"
 	"github.com/syndtr/goleveldb/leveldb"
 	lerr "github.com/syndtr/goleveldb/leveldb/errors"
 	"sync"
@@ -73,6 +74,24 @@ func (s *Storage) RawTable(name string) (*leveldb.DB,error) {
 	s.tables[name] = ldb
 	return ldb,nil
 }
+// Returns the names of all tables, that exist on disk or are opened.
+func (s *Storage) TableNames() ([]string,error) {
+	s.Lock(); defer s.Unlock()
+	fis,err := ioutil.ReadDir(s.Basepath)
+	if err!=nil && !os.IsNotExist(err) { return nil,err }
+	var names []string
+	seen := make(map[string]bool)
+	for _,fi := range fis {
+		if !fi.IsDir() { continue }
+		seen[fi.Name()] = true
+		names = append(names,fi.Name())
+	}
+	for name := range s.tables {
+		if seen[name] { continue }
+		names = append(names,name)
+	}
+	return names,nil
+}
 func (s *Storage) Table(name string) (TableDB,error) {
 	l,err := s.RawTable(name)
 	if err!=nil { return nil,err }
@@ -85,4 +104,5 @@ type levelTable struct{
 func (l levelTable) Begin() (TableTx,error) { return l.OpenTransaction() }
 func (l levelTable) Snapshot() (TableSnapshot,error) { return l.GetSnapshot() }
 var _ TableDB = levelTable{}
+var _ TableLister = (*Storage)(nil)
 
@@ -0,0 +1,231 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package lstore
+
+import (
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"sync"
+	"time"
+	"errors"
+)
+
+var ErrNoSnapshot = errors.New("ErrNoSnapshot")
+var ErrSnapshotExists = errors.New("ErrSnapshotExists")
+var ErrNoTableList = errors.New("ErrNoTableList")
+var ErrNotInSnapshot = errors.New("ErrNotInSnapshot")
+
+// Implemented by Databases, that can enumerate their tables.
+type TableLister interface{
+	TableNames() ([]string,error)
+}
+
+/*
+A UDBM with named snapshots. A named snapshot captures several tables at the
+same point in time. Every transaction started from the same named snapshot
+sees exactly the same data, regardless of the table it reads.
+*/
+type SnapshotUDBM interface{
+	UDBM
+
+	// Captures the given tables, or all tables, if none are given, under the
+	// given name. If lease is non-zero, the snapshot is released automatically
+	// after it expired. Reading other tables than the given ones fails with
+	// ErrNotInSnapshot.
+	CreateSnapshot(name string, lease time.Duration, tables ...string) error
+
+	// Extends the lease of a named snapshot.
+	RenewSnapshot(name string, lease time.Duration) error
+
+	// Releases a named snapshot. Transactions that already read from it
+	// keep their view until they commit or discard.
+	ReleaseSnapshot(name string) error
+
+	// Starts a transaction, that reads from the named snapshot.
+	StartTxAt(name string, w WriteIso) (UDB,error)
+}
+
+// An empty table, for tables that did not exist when all tables were captured.
+type emptySnapshot struct{}
+func (emptySnapshot) Get(key []byte, ro *opt.ReadOptions) ([]byte, error) { return nil,leveldb.ErrNotFound }
+func (emptySnapshot) Has(key []byte, ro *opt.ReadOptions) (bool, error) { return false,nil }
+func (emptySnapshot) NewIterator(slice *util.Range, ro *opt.ReadOptions) iterator.Iterator { return iterator.NewEmptyIterator(nil) }
+func (emptySnapshot) Release() {}
+
+type namedSnapshot struct{
+	sync.Mutex
+	refs   int
+	tables map[string]TableSnapshot
+	timer  *time.Timer
+
+	// Whether only the listed tables were captured.
+	listed bool
+}
+func (n *namedSnapshot) acquire(name string) (TableSnapshot,error) {
+	n.Lock(); defer n.Unlock()
+	if n.refs==0 { return nil,ErrNoSnapshot }
+	sn := n.tables[name]
+	if sn==nil {
+		if n.listed { return nil,ErrNotInSnapshot }
+		sn = emptySnapshot{}
+	}
+	n.refs++
+	return &sharedSnapshot{TableSnapshot:sn,owner:n},nil
+}
+func (n *namedSnapshot) unref() {
+	n.Lock(); defer n.Unlock()
+	n.refs--
+	if n.refs>0 { return }
+	for _,sn := range n.tables { sn.Release() }
+	n.tables = nil
+}
+
+type sharedSnapshot struct{
+	TableSnapshot
+	owner *namedSnapshot
+	done bool
+}
+func (s *sharedSnapshot) Release() {
+	if s.done { return }
+	s.done = true
+	s.owner.unref()
+}
+
+// A Database, that hands out the named snapshot instead of a fresh one.
+type snapView struct{
+	inner Database
+	ns *namedSnapshot
+}
+func (v *snapView) Table(name string) (TableDB,error) {
+	t,err := v.inner.Table(name)
+	if err!=nil { return nil,err }
+	return snapTable{t,v.ns,name},nil
+}
+
+type snapTable struct{
+	TableDB
+	ns *namedSnapshot
+	name string
+}
+func (t snapTable) Snapshot() (TableSnapshot,error) { return t.ns.acquire(t.name) }
+
+// --------------------------------------------------------------------------
+
+// Returns the names of the tables of the Database, if it is a TableLister.
+func (m *txManager) TableNames() ([]string,error) {
+	tl,ok := m.inner.(TableLister)
+	if !ok { return nil,ErrNoTableList }
+	return tl.TableNames()
+}
+
+func (m *txManager) CreateSnapshot(name string, lease time.Duration, tables ...string) (err error) {
+	listed := len(tables)!=0
+	if !listed {
+		tl,ok := m.inner.(TableLister)
+		if !ok { return ErrNoTableList }
+		tables,err = tl.TableNames()
+		if err!=nil { return }
+	}
+
+	// Open the tables in advance, so we hold the writer lock as short as possible.
+	tdbs := make(map[string]TableDB,len(tables))
+	for _,tn := range tables {
+		tdbs[tn],err = m.inner.Table(tn)
+		if err!=nil { return }
+	}
+
+	ns := &namedSnapshot{refs:1,tables:make(map[string]TableSnapshot,len(tables)),listed:listed}
+
+	m.snapMu.Lock(); defer m.snapMu.Unlock()
+	if m.snaps[name]!=nil { return ErrSnapshotExists }
+
+	// Block all writers, so that every table is captured at the same point in time.
+	m.writer.Lock()
+	for tn,t := range tdbs {
+		var sn TableSnapshot
+		sn,err = t.Snapshot()
+		if err!=nil { break }
+		ns.tables[tn] = sn
+	}
+	m.writer.Unlock()
+
+	if err!=nil {
+		ns.unref()
+		return
+	}
+
+	if lease>0 {
+		ns.timer = time.AfterFunc(lease,func(){ m.dropSnapshot(name,ns) })
+	}
+	if m.snaps==nil { m.snaps = make(map[string]*namedSnapshot) }
+	m.snaps[name] = ns
+	return nil
+}
+func (m *txManager) dropSnapshot(name string, ns *namedSnapshot) {
+	m.snapMu.Lock()
+	if m.snaps[name]!=ns {
+		m.snapMu.Unlock()
+		return
+	}
+	delete(m.snaps,name)
+	m.snapMu.Unlock()
+	ns.unref()
+}
+func (m *txManager) RenewSnapshot(name string, lease time.Duration) error {
+	m.snapMu.Lock(); defer m.snapMu.Unlock()
+	ns := m.snaps[name]
+	if ns==nil { return ErrNoSnapshot }
+	if ns.timer!=nil {
+		if !ns.timer.Stop() { return ErrNoSnapshot } // Expiry is under way.
+		ns.timer = nil
+	}
+	if lease>0 {
+		ns.timer = time.AfterFunc(lease,func(){ m.dropSnapshot(name,ns) })
+	}
+	return nil
+}
+func (m *txManager) ReleaseSnapshot(name string) error {
+	m.snapMu.Lock()
+	ns := m.snaps[name]
+	if ns==nil {
+		m.snapMu.Unlock()
+		return ErrNoSnapshot
+	}
+	if ns.timer!=nil { ns.timer.Stop() }
+	delete(m.snaps,name)
+	m.snapMu.Unlock()
+	ns.unref()
+	return nil
+}
+func (m *txManager) StartTxAt(name string, w WriteIso) (UDB,error) {
+	m.snapMu.Lock()
+	ns := m.snaps[name]
+	m.snapMu.Unlock()
+	if ns==nil { return nil,ErrNoSnapshot }
+	return &udbWrapper{m.tximplFor(READ_SNAPSHOT,w),&snapView{m.inner,ns},nil},nil
+}
+
+var _ SnapshotUDBM = (*txManager)(nil)
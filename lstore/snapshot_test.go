@@ -0,0 +1,99 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package lstore
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// Returns a fresh Storage in a temporary directory.
+func testStorage(t *testing.T) *Storage {
+	d,err := ioutil.TempDir("","lstore")
+	if err!=nil { t.Fatal(err) }
+	t.Cleanup(func(){ os.RemoveAll(d) })
+	return &Storage{Basepath:d}
+}
+
+func put(t *testing.T, m UDBM, table, key, value string) {
+	t.Helper()
+	tx := m.StartTx(READ_SNAPSHOT,WRITE_CHECKED)
+	u,err := tx.UTable(table)
+	if err!=nil { t.Fatal(err) }
+	if err = u.Write([]byte(key),[]byte(value)); err!=nil { t.Fatal(err) }
+	if err = tx.Commit(); err!=nil { t.Fatal(err) }
+}
+
+func TestNamedSnapshot(t *testing.T) {
+	m := Complex(testStorage(t),0).(SnapshotUDBM)
+	put(t,m,"a","k","1")
+	put(t,m,"b","k","1")
+	if err := m.CreateSnapshot("s",0); err!=nil { t.Fatal(err) }
+	if err := m.CreateSnapshot("s",0); err!=ErrSnapshotExists { t.Fatalf("got %v, want ErrSnapshotExists",err) }
+	put(t,m,"a","k","2")
+	put(t,m,"b","k","2")
+
+	for i := 0; i<2; i++ {
+		tx,err := m.StartTxAt("s",WRITE_DISABLED)
+		if err!=nil { t.Fatal(err) }
+		for _,tn := range []string{"a","b"} {
+			u,err := tx.UTable(tn)
+			if err!=nil { t.Fatal(err) }
+			if v := string(u.Read([]byte("k"))); v!="1" { t.Errorf("%s: got %q, want %q",tn,v,"1") }
+		}
+		// Created after the snapshot: empty.
+		u,err := tx.UTable("c")
+		if err!=nil { t.Fatal(err) }
+		if v := u.Read([]byte("k")); v!=nil { t.Errorf("c: got %q, want nil",v) }
+		tx.Discard()
+	}
+
+	if err := m.ReleaseSnapshot("s"); err!=nil { t.Fatal(err) }
+	if _,err := m.StartTxAt("s",WRITE_DISABLED); err!=ErrNoSnapshot { t.Fatalf("got %v, want ErrNoSnapshot",err) }
+}
+
+func TestNamedSnapshotListed(t *testing.T) {
+	m := Complex(testStorage(t),0).(SnapshotUDBM)
+	put(t,m,"a","k","1")
+	put(t,m,"b","k","1")
+	if err := m.CreateSnapshot("s",0,"a"); err!=nil { t.Fatal(err) }
+	tx,err := m.StartTxAt("s",WRITE_DISABLED)
+	if err!=nil { t.Fatal(err) }
+	defer tx.Discard()
+	if _,err = tx.UTable("a"); err!=nil { t.Fatal(err) }
+	if _,err = tx.UTable("b"); err!=ErrNotInSnapshot { t.Fatalf("got %v, want ErrNotInSnapshot",err) }
+}
+
+func TestNamedSnapshotLease(t *testing.T) {
+	m := Complex(testStorage(t),0).(SnapshotUDBM)
+	put(t,m,"a","k","1")
+	if err := m.CreateSnapshot("s",20*time.Millisecond); err!=nil { t.Fatal(err) }
+	if err := m.RenewSnapshot("s",time.Hour); err!=nil { t.Fatal(err) }
+	time.Sleep(50*time.Millisecond)
+	if err := m.RenewSnapshot("s",20*time.Millisecond); err!=nil { t.Fatal(err) }
+	time.Sleep(100*time.Millisecond)
+	if _,err := m.StartTxAt("s",WRITE_DISABLED); err!=ErrNoSnapshot { t.Fatalf("got %v, want ErrNoSnapshot",err) }
+}
@@ -0,0 +1,323 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package lstore
+
+import (
+	"github.com/syndtr/goleveldb/leveldb"
+	"encoding/binary"
+	"bytes"
+	"errors"
+)
+
+var ErrNotPreparable = errors.New("ErrNotPreparable")
+var ErrUnknownTx = errors.New("ErrUnknownTx")
+var ErrBadPrepareRecord = errors.New("ErrBadPrepareRecord")
+
+// The table, that holds the durable prepare records.
+const PreparedTable = "lstore-prepared"
+
+/*
+A UDB, that supports the first phase of a two-phase commit.
+*/
+type PreparableUDB interface{
+	UDB
+
+	/*
+	Checks the transaction for conflicts and durably records its writes
+	under txid. The keys, that were read or written, stay locked until the
+	transaction is completed by CommitPrepared or AbortPrepared.
+
+	Only transactions with WRITE_CHECKED or WRITE_COMMIT can be prepared,
+	others return ErrNotPreparable.
+	*/
+	Prepare(txid []byte) error
+}
+
+/*
+A UDBM, that participates in two-phase commits.
+*/
+type TwoPhaseUDBM interface{
+	RecoverableUDBM
+	CommitPrepared(txid []byte) error
+	AbortPrepared(txid []byte) error
+
+	// Finishes the interrupted commit (see RecoverableUDBM), loads the
+	// prepare records, that survived a restart, and returns the ids of all
+	// prepared transactions, that are not completed yet.
+	Recover() ([][]byte,error)
+}
+
+type preparer interface{
+	prepare(txid []byte, utm map[string]UTable) error
+}
+
+func (i *udbWrapper) Prepare(txid []byte) error {
+	p,ok := i.tximpl.(preparer)
+	if !ok {
+		i.Discard()
+		return ErrNotPreparable
+	}
+	ts := i.tables
+	i.tables = nil
+	return p.prepare(txid,ts)
+}
+
+var _ PreparableUDB = (*udbWrapper)(nil)
+
+// --------------------------------------------------------------------------
+
+type preparedTable struct{
+	writes map[string][]byte
+	reads []string
+}
+type preparedTx struct{
+	id string
+	tables map[string]*preparedTable
+}
+
+func appendBytes(b, s []byte) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	b = append(b,buf[:binary.PutUvarint(buf[:],uint64(len(s)))]...)
+	return append(b,s...)
+}
+func appendUvarint(b []byte, u int) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b,buf[:binary.PutUvarint(buf[:],uint64(u))]...)
+}
+
+func (p *preparedTx) encode() (b []byte) {
+	b = appendUvarint(b,len(p.tables))
+	for name,pt := range p.tables {
+		b = appendBytes(b,[]byte(name))
+		b = appendUvarint(b,len(pt.writes))
+		for k,v := range pt.writes {
+			b = appendBytes(b,[]byte(k))
+			b = appendBytes(b,v)
+		}
+		b = appendUvarint(b,len(pt.reads))
+		for _,k := range pt.reads {
+			b = appendBytes(b,[]byte(k))
+		}
+	}
+	return
+}
+
+type recordReader struct{
+	b []byte
+	err error
+}
+func (r *recordReader) uvarint() int {
+	u,n := binary.Uvarint(r.b)
+	if n<=0 { r.err = ErrBadPrepareRecord; return 0 }
+	r.b = r.b[n:]
+	return int(u)
+}
+func (r *recordReader) bytes() []byte {
+	n := r.uvarint()
+	if n>len(r.b) { r.err = ErrBadPrepareRecord; return nil }
+	s := r.b[:n]
+	r.b = r.b[n:]
+	return s
+}
+
+func decodePrepared(id, data []byte) (*preparedTx,error) {
+	r := &recordReader{b:data}
+	p := &preparedTx{id:string(id),tables:make(map[string]*preparedTable)}
+	nt := r.uvarint()
+	for i := 0; i<nt && r.err==nil; i++ {
+		pt := &preparedTable{writes:make(map[string][]byte)}
+		p.tables[string(r.bytes())] = pt
+		nw := r.uvarint()
+		for j := 0; j<nw && r.err==nil; j++ {
+			k := r.bytes()
+			pt.writes[string(k)] = bclone(r.bytes())
+		}
+		nr := r.uvarint()
+		for j := 0; j<nr && r.err==nil; j++ {
+			pt.reads = append(pt.reads,string(r.bytes()))
+		}
+	}
+	return p,r.err
+}
+
+// --------------------------------------------------------------------------
+
+func lockName(table string, key []byte) string { return table+"\x00"+string(key) }
+
+/*
+Reports, whether the key is locked by a prepared transaction, that read or
+wrote it. Such keys must not be written. The caller must hold the writer lock.
+*/
+func (m *txManager) isLocked(table string, key []byte) bool {
+	name := lockName(table,key)
+	_,ok := m.locks[name]
+	return ok || m.shared[name]>0
+}
+
+// Reports, whether a prepared transaction writes the key. The caller must hold the writer lock.
+func (m *txManager) isWriteLocked(table string, key []byte) bool {
+	_,ok := m.locks[lockName(table,key)]
+	return ok
+}
+
+/*
+Locks the written keys exclusively and the keys, that were only read, shared.
+The caller must hold the writer lock exclusively.
+*/
+func (m *txManager) install(p *preparedTx) {
+	if m.prepared==nil { m.prepared = make(map[string]*preparedTx) }
+	if m.locks==nil { m.locks = make(map[string]string) }
+	if m.shared==nil { m.shared = make(map[string]int) }
+	m.prepared[p.id] = p
+	for name,pt := range p.tables {
+		for k := range pt.writes { m.locks[lockName(name,[]byte(k))] = p.id }
+		for _,k := range pt.reads {
+			if _,ok := pt.writes[k]; ok { continue }
+			m.shared[lockName(name,[]byte(k))]++
+		}
+	}
+}
+
+// The caller must hold the writer lock exclusively.
+func (m *txManager) uninstall(p *preparedTx) {
+	delete(m.prepared,p.id)
+	for name,pt := range p.tables {
+		for k := range pt.writes { delete(m.locks,lockName(name,[]byte(k))) }
+		for _,k := range pt.reads {
+			if _,ok := pt.writes[k]; ok { continue }
+			ln := lockName(name,[]byte(k))
+			if m.shared[ln]--; m.shared[ln]<=0 { delete(m.shared,ln) }
+		}
+	}
+}
+
+func (m *txManagerSerializable) prepare(txid []byte, utm map[string]UTable) error {
+	for _,ut := range utm {
+		sr := ut.(*uTableSR)
+		if sr.itsSN!=nil {
+			sr.itsSN.Release()
+			sr.itsSN = nil
+		}
+	}
+
+	m.writer.Lock(); defer m.writer.Unlock()
+	if err := m.redo(); err!=nil { return err }
+	if m.prepared[string(txid)]!=nil { return ErrConcurrentUpdate }
+
+	p := &preparedTx{id:string(txid),tables:make(map[string]*preparedTable)}
+	for tabnam,ut := range utm {
+		sr := ut.(*uTableSR)
+		pt := &preparedTable{writes:make(map[string][]byte)}
+		for key,value := range sr.w {
+			if m.isLocked(tabnam,[]byte(key)) { return ErrConcurrentUpdate }
+			if m.f.Has(F_DiscardWrites) { continue }
+			pt.writes[key] = value
+		}
+		for key,value := range sr.rm {
+			// Other prepared transactions may read the key as well.
+			if m.isWriteLocked(tabnam,[]byte(key)) { return ErrConcurrentUpdate }
+			if _,ok := sr.um[key]; ok || m.f.Has(F_NoCheck) { continue }
+			v,_ := sr.tt.Get([]byte(key),&m.ro)
+			if !bytes.Equal(value,v) { return ErrConcurrentUpdate }
+			pt.reads = append(pt.reads,key)
+		}
+		for key,value := range sr.um {
+			if m.isWriteLocked(tabnam,[]byte(key)) { return ErrConcurrentUpdate }
+			v,_ := sr.tt.Get([]byte(key),&m.ro)
+			if !bytes.Equal(value,v) { return ErrConcurrentUpdate }
+			pt.reads = append(pt.reads,key)
+		}
+		p.tables[tabnam] = pt
+	}
+
+	log,err := m.inner.Table(PreparedTable)
+	if err!=nil { return err }
+	if err = log.Put(txid,p.encode(),syncWrite); err!=nil { return err }
+	m.install(p)
+	return nil
+}
+
+func (m *txManager) CommitPrepared(txid []byte) error {
+	m.writer.Lock(); defer m.writer.Unlock()
+	p := m.prepared[string(txid)]
+	if p==nil { return ErrUnknownTx }
+
+	// If we fail in between, the record stays, and a later attempt (or the
+	// recovery) applies all writes again. The writes are synced, before the
+	// record is removed.
+	if err := m.redo(); err!=nil { return err }
+	var batch leveldb.Batch
+	for name,pt := range p.tables {
+		if len(pt.writes)==0 { continue }
+		t,err := m.inner.Table(name)
+		if err!=nil { return err }
+		batch.Reset()
+		for key,value := range pt.writes {
+			if len(value)==0 {
+				batch.Delete([]byte(key))
+			} else {
+				batch.Put([]byte(key),value)
+			}
+		}
+		if err = t.Write(&batch,syncWrite); err!=nil { return err }
+	}
+	return m.forget(p)
+}
+
+func (m *txManager) AbortPrepared(txid []byte) error {
+	m.writer.Lock(); defer m.writer.Unlock()
+	p := m.prepared[string(txid)]
+	if p==nil { return ErrUnknownTx }
+	return m.forget(p)
+}
+
+// The caller must hold the writer lock exclusively.
+func (m *txManager) forget(p *preparedTx) error {
+	log,err := m.inner.Table(PreparedTable)
+	if err!=nil { return err }
+	if err = log.Delete([]byte(p.id),syncWrite); err!=nil { return err }
+	m.uninstall(p)
+	return nil
+}
+
+func (m *txManager) Recover() (ids [][]byte,err error) {
+	if err = m.RecoverCommit(); err!=nil { return nil,err }
+	log,err := m.inner.Table(PreparedTable)
+	if err!=nil { return nil,err }
+
+	m.writer.Lock(); defer m.writer.Unlock()
+	iter := log.NewIterator(nil,&m.ro)
+	defer iter.Release()
+	for iter.Next() {
+		if m.prepared[string(iter.Key())]!=nil { continue }
+		p,err := decodePrepared(iter.Key(),iter.Value())
+		if err!=nil { return nil,err }
+		m.install(p)
+	}
+	if err = iter.Error(); err!=nil { return nil,err }
+	for id := range m.prepared { ids = append(ids,[]byte(id)) }
+	return
+}
+
+var _ TwoPhaseUDBM = (*txManager)(nil)
@@ -0,0 +1,176 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+package lstore
+
+import (
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"testing"
+)
+
+// Starts a transaction, that reads and writes the given keys of table "t", and prepares it.
+func prepare(t *testing.T, m UDBM, txid string, reads, writes []string) error {
+	t.Helper()
+	tx := m.StartTx(READ_SNAPSHOT,WRITE_CHECKED)
+	u,err := tx.UTable("t")
+	if err!=nil { t.Fatal(err) }
+	for _,k := range reads { u.Read([]byte(k)) }
+	for _,k := range writes { u.Write([]byte(k),[]byte(txid)) }
+	return tx.(PreparableUDB).Prepare([]byte(txid))
+}
+
+func TestTwoPhase(t *testing.T) {
+	st := testStorage(t)
+	m := Complex(st,0).(TwoPhaseUDBM)
+	if err := prepare(t,m,"tx1",nil,[]string{"a"}); err!=nil { t.Fatal(err) }
+	if err := prepare(t,m,"tx2",nil,[]string{"b"}); err!=nil { t.Fatal(err) }
+	if v := read(t,m,"t","a"); v!="" { t.Errorf("prepared write is visible: %q",v) }
+	if err := m.CommitPrepared([]byte("tx1")); err!=nil { t.Fatal(err) }
+	if v := read(t,m,"t","a"); v!="tx1" { t.Errorf("got %q, want %q",v,"tx1") }
+	if err := m.CommitPrepared([]byte("tx1")); err!=ErrUnknownTx { t.Errorf("got %v, want ErrUnknownTx",err) }
+
+	// tx2 survives a restart.
+	m = Complex(st,0).(TwoPhaseUDBM)
+	ids,err := m.Recover()
+	if err!=nil { t.Fatal(err) }
+	if len(ids)!=1 || string(ids[0])!="tx2" { t.Fatalf("got %q, want [tx2]",ids) }
+	if err = prepare(t,m,"tx3",nil,[]string{"b"}); err!=ErrConcurrentUpdate { t.Errorf("got %v, want ErrConcurrentUpdate",err) }
+	if err = m.AbortPrepared([]byte("tx2")); err!=nil { t.Fatal(err) }
+	if v := read(t,m,"t","b"); v!="" { t.Errorf("aborted write is visible: %q",v) }
+	if err = prepare(t,m,"tx3",nil,[]string{"b"}); err!=nil { t.Fatal(err) }
+}
+
+// A Database, that records the tables written without syncing.
+type syncCheck struct{
+	Database
+	unsynced map[string]bool
+}
+func (s *syncCheck) Table(name string) (TableDB,error) {
+	t,err := s.Database.Table(name)
+	if err!=nil { return nil,err }
+	return syncCheckTable{t,s,name},nil
+}
+type syncCheckTable struct{
+	TableDB
+	s *syncCheck
+	name string
+}
+func (t syncCheckTable) Write(batch *leveldb.Batch, wo *opt.WriteOptions) error {
+	if wo==nil || !wo.Sync { t.s.unsynced[t.name] = true }
+	return t.TableDB.Write(batch,wo)
+}
+
+// The prepared writes are durable, before the prepare record is removed.
+func TestCommitPreparedSync(t *testing.T) {
+	sc := &syncCheck{testStorage(t),make(map[string]bool)}
+	m := Complex(sc,0).(TwoPhaseUDBM)
+	if err := prepare(t,m,"tx",nil,[]string{"a"}); err!=nil { t.Fatal(err) }
+	if err := m.CommitPrepared([]byte("tx")); err!=nil { t.Fatal(err) }
+	if sc.unsynced["t"] { t.Error("the prepared writes were not synced") }
+}
+
+func TestTwoPhaseNotPreparable(t *testing.T) {
+	m := Complex(testStorage(t),0)
+	tx := m.StartTx(READ_ANY,WRITE_INSTANT)
+	if err := tx.(PreparableUDB).Prepare([]byte("x")); err!=ErrNotPreparable { t.Errorf("got %v, want ErrNotPreparable",err) }
+}
+
+// Writes the key of table "t" with the given isolation, returning the error of the write or the commit.
+func writeWith(t *testing.T, m UDBM, r ReadIso, w WriteIso, key string) error {
+	t.Helper()
+	tx := m.StartTx(r,w)
+	u,err := tx.UTable("t")
+	if err!=nil { t.Fatal(err) }
+	if err = u.Write([]byte(key),[]byte("x")); err!=nil {
+		tx.Discard()
+		return err
+	}
+	return tx.Commit()
+}
+
+func TestTwoPhaseLocks(t *testing.T) {
+	m := Complex(testStorage(t),0).(TwoPhaseUDBM)
+	put(t,m,"t","r","0")
+	if err := prepare(t,m,"w",nil,[]string{"w"}); err!=nil { t.Fatal(err) }
+
+	// Keys, that only are read, are locked shared.
+	if err := prepare(t,m,"r1",[]string{"r"},[]string{"x1"}); err!=nil { t.Fatal(err) }
+	if err := prepare(t,m,"r2",[]string{"r"},[]string{"x2"}); err!=nil { t.Fatalf("second reader: %v",err) }
+	if err := prepare(t,m,"r3",[]string{"w"},nil); err!=ErrConcurrentUpdate { t.Errorf("reading a written key: got %v, want ErrConcurrentUpdate",err) }
+	if err := prepare(t,m,"r4",nil,[]string{"r"}); err!=ErrConcurrentUpdate { t.Errorf("writing a read key: got %v, want ErrConcurrentUpdate",err) }
+
+	// No write path may overwrite locked keys.
+	for _,iso := range []struct{ r ReadIso; w WriteIso }{
+		{READ_SNAPSHOT,WRITE_CHECKED},
+		{READ_SNAPSHOT,WRITE_COMMIT},
+		{READ_SNAPSHOT,WRITE_INSTANT_ATOMIC},
+		{READ_SNAPSHOT,WRITE_INSTANT},
+		{READ_ANY,WRITE_INSTANT},
+	} {
+		for _,key := range []string{"r","w"} {
+			if err := writeWith(t,m,iso.r,iso.w,key); err!=ErrConcurrentUpdate { t.Errorf("%v/%v %s: got %v, want ErrConcurrentUpdate",iso.r,iso.w,key,err) }
+		}
+	}
+	tx := m.StartTx(READ_ANY,WRITE_INSTANT)
+	u,err := tx.UTable("t")
+	if err!=nil { t.Fatal(err) }
+	if err = u.(CASTable).WriteIf([]byte("r"),[]byte("0"),[]byte("1")); err!=ErrConcurrentUpdate { t.Errorf("WriteIf: got %v, want ErrConcurrentUpdate",err) }
+	tx.Discard()
+
+	// The shared lock is held, until the last reader completes.
+	m.CommitPrepared([]byte("r1"))
+	if err := writeWith(t,m,READ_ANY,WRITE_INSTANT,"r"); err!=ErrConcurrentUpdate { t.Errorf("got %v, want ErrConcurrentUpdate",err) }
+	m.AbortPrepared([]byte("r2"))
+	if err := writeWith(t,m,READ_ANY,WRITE_INSTANT,"r"); err!=nil { t.Error(err) }
+}
+
+func TestCoordinator(t *testing.T) {
+	st1,st2 := testStorage(t),testStorage(t)
+	p1,p2 := Complex(st1,0).(TwoPhaseUDBM),Complex(st2,0).(TwoPhaseUDBM)
+	log,err := st1.Table("decisions")
+	if err!=nil { t.Fatal(err) }
+	c := &Coordinator{Participants:[]TwoPhaseUDBM{p1,p2},Log:log}
+
+	d := c.StartTx(READ_SNAPSHOT,WRITE_CHECKED)
+	for i := 0; i<2; i++ {
+		u,err := d.UDB(i).UTable("t")
+		if err!=nil { t.Fatal(err) }
+		u.Write([]byte("k"),[]byte("v"))
+	}
+	if err = d.Commit(); err!=nil { t.Fatal(err) }
+	if read(t,p1,"t","k")!="v" || read(t,p2,"t","k")!="v" { t.Error("the commit is not visible on every participant") }
+
+	// A conflict on one participant aborts the transaction on all.
+	d = c.StartTx(READ_SNAPSHOT,WRITE_CHECKED)
+	for i := 0; i<2; i++ {
+		u,_ := d.UDB(i).UTable("t")
+		u.Read([]byte("k"))
+		u.Write([]byte("k"),[]byte("w"))
+	}
+	put(t,p2,"t","k","x")
+	if err = d.Commit(); err!=ErrConcurrentUpdate { t.Fatalf("got %v, want ErrConcurrentUpdate",err) }
+	if v := read(t,p1,"t","k"); v!="v" { t.Errorf("participant 1: got %q, want %q",v,"v") }
+	if err = c.Recover(); err!=nil { t.Fatal(err) }
+}
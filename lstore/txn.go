@@ -92,6 +92,31 @@ type UTable interface{
 	Iter() UIterator
 }
 
+/*
+Optionally implemented by UTables, whose writes take effect instantly
+(WRITE_INSTANT and WRITE_INSTANT_ATOMIC). WriteIf atomically writes value, if
+the current value of key equals old (an empty old means, that the key does not
+exist). Otherwise it returns ErrConcurrentUpdate. ReadCurrent returns the
+current value, bypassing the snapshot and the reads of the transaction, so a
+failed WriteIf can be retried with it.
+*/
+type CASTable interface{
+	UTable
+	WriteIf(key,old,value []byte) error
+	ReadCurrent(key []byte) []byte
+}
+
+/*
+Optionally implemented by the UTables of transactions, that are committed at
+once (WRITE_CHECKED and WRITE_COMMIT). ReadForUpdate reads the key like Read,
+but the commit fails with ErrConcurrentUpdate, if the key was changed since,
+even if the transaction does not check its reads otherwise.
+*/
+type UpdateReader interface{
+	UTable
+	ReadForUpdate(key []byte) []byte
+}
+
 type UDBM interface{
 	StartTx(r ReadIso, w WriteIso) UDB
 }
@@ -81,6 +81,7 @@ func (i *uIteratorAug) Seek(key []byte) (ok bool) {
 	if ok { i.state = 1 } else {
 		if len(i.ptr)>0 {
 			i.state = 2
+			ok = true
 		} else {
 			i.state = 3
 		}
@@ -103,7 +104,14 @@ func (i *uIteratorAug) Next() (ok bool) {
 				ok = true
 			}
 		}
-		if !ok { ok = i.iter.Next() }
+		if !ok {
+			ok = i.iter.Next()
+			// The iterator is exhausted, but pending keys remain.
+			if !ok && len(i.ptr)>0 {
+				i.state = 2
+				return true
+			}
+		}
 	case 2:
 		if len(i.ptr)>0 {
 			i.ptr = i.ptr[1:]
@@ -161,9 +169,28 @@ type uTableDs struct{
 	wo opt.WriteOptions
 	w BasicWriter
 	wp *sync.RWMutex
+	tm *txManager
+	name string
 }
 func (t *uTableDs) Write(key,value []byte) error {
 	t.wp.RLock(); defer t.wp.RUnlock()
+	if err := t.tm.redo(); err!=nil { return err }
+	if t.tm.isLocked(t.name,key) { return ErrConcurrentUpdate }
+	if len(value)==0 {
+		return t.w.Delete(key,&t.wo)
+	}
+	return t.w.Put(key,value,&t.wo)
+}
+
+func (t *uTableDs) ReadCurrent(key []byte) []byte { return t.Read(key) }
+
+func (t *uTableDs) WriteIf(key,old,value []byte) error {
+	// Excludes the other writers, that only hold the read lock.
+	t.wp.Lock(); defer t.wp.Unlock()
+	if err := t.tm.redo(); err!=nil { return err }
+	if t.tm.isLocked(t.name,key) { return ErrConcurrentUpdate }
+	cur,_ := t.w.Get(key,&t.ro)
+	if !bytes.Equal(cur,old) { return ErrConcurrentUpdate }
 	if len(value)==0 {
 		return t.w.Delete(key,&t.wo)
 	}
@@ -174,6 +201,8 @@ type uTableSR struct{
 	uTableRO
 	f Flags
 	rm map[string][]byte
+	// The keys read for update, they are checked even with F_NoCheck.
+	um map[string][]byte
 	w map[string][]byte
 	k [][]byte
 	sorted bool
@@ -192,6 +221,13 @@ func (t *uTableSR) Read(key []byte) []byte {
 	}
 	return r
 }
+func (t *uTableSR) ReadForUpdate(key []byte) []byte {
+	if _,ok := t.w[string(key)]; ok { return t.Read(key) }
+	r := t.Read(key)
+	if t.um==nil { t.um = make(map[string][]byte) }
+	t.um[string(key)] = bclone(r)
+	return r
+}
 func (t *uTableSR) Write(key,value []byte) error {
 	if t.f.Has(F_DiscardWrites) { return ERO }
 	if t.w==nil { t.w = make(map[string][]byte) }
@@ -253,6 +289,8 @@ type uTableIW struct{
 	outopt opt.WriteOptions
 	writer *sync.RWMutex
 	optim Flags
+	tm *txManager
+	name string
 }
 func (t *uTableIW) Write(key,value []byte) (rerr error) {
 	if t.optim.Has(O_ConcurrentCommit) {
@@ -260,6 +298,8 @@ func (t *uTableIW) Write(key,value []byte) (rerr error) {
 	} else {
 		t.writer.Lock(); defer t.writer.Unlock()
 	}
+	if err := t.tm.redo(); err!=nil { return err }
+	if t.tm.isLocked(t.name,key) { return ErrConcurrentUpdate }
 	var myw BasicWriter = t.tt
 	if t.optim.Has(O_UseTransaction) {
 		if tx,err := t.tt.Begin(); err!=nil {
@@ -286,18 +326,52 @@ func (t *uTableIW) Write(key,value []byte) (rerr error) {
 	t.uTableSR.Write(key,value)
 	return
 }
+func (t *uTableIW) ReadCurrent(key []byte) []byte {
+	r,_ := t.tt.Get(key,&t.ro)
+	return r
+}
+func (t *uTableIW) WriteIf(key,old,value []byte) error {
+	t.writer.Lock(); defer t.writer.Unlock()
+	if err := t.tm.redo(); err!=nil { return err }
+	if t.tm.isLocked(t.name,key) { return ErrConcurrentUpdate }
+	cur,_ := t.tt.Get(key,&t.ro)
+	if !bytes.Equal(cur,old) { return ErrConcurrentUpdate }
+	if err := t.tt.Put(key,value,&t.outopt); err!=nil { return err }
+	t.uTableSR.Write(key,value)
+	return nil
+}
 
 
 // --------------------------------------------------------------------------
 
 
 
+var _ CASTable = (*uTableDs)(nil)
+var _ CASTable = (*uTableIW)(nil)
+var _ UpdateReader = (*uTableSR)(nil)
+
 type txManager struct{
 	writer sync.RWMutex
 	inner Database
 	ro opt.ReadOptions
 	wo opt.WriteOptions
 	optim Flags
+	
+	snapMu sync.Mutex
+	snaps map[string]*namedSnapshot
+	
+	// Prepared transactions, the keys they write (exclusive locks) and the
+	// number of prepared transactions, that only read a key (shared locks).
+	// Guarded by writer.
+	prepared map[string]*preparedTx
+	locks map[string]string
+	shared map[string]int
+
+	// The commit, that failed after it was logged. Set under the writer lock
+	// exclusively, or under logMu with the shared writer lock.
+	logMu sync.Mutex
+	pending map[string]*leveldb.Batch
+	npending int32
 }
 
 func Complex(db Database,optim Flags) UDBM {
@@ -305,6 +379,10 @@ func Complex(db Database,optim Flags) UDBM {
 }
 
 func (m *txManager) StartTx(r ReadIso, w WriteIso) UDB {
+	return &udbWrapper{m.tximplFor(r,w),m.inner,nil}
+}
+
+func (m *txManager) tximplFor(r ReadIso, w WriteIso) tximpl {
 	var txm tximpl
 	var f Flags
 	switch w {
@@ -356,17 +434,18 @@ func (m *txManager) StartTx(r ReadIso, w WriteIso) UDB {
 	if txm==nil {
 		txm = &txManagerSerializable{m,f}
 	}
-	return &udbWrapper{txm,m.inner,nil}
+	return txm
 }
 
 // --------------------------------------------------------------------------
 
 type txManagerDirect txManager
 
-func (m *txManagerDirect) open(t TableDB,e error) (UTable,error) {
+func (m *txManagerDirect) open(name string,t TableDB,e error) (UTable,error) {
 	if e!=nil { return nil,e }
 	ut := new(uTableDs)
 	ut.ro,ut.wo,ut.wp = m.ro,m.wo,&m.writer
+	ut.tm,ut.name = (*txManager)(m),name
 	ut.r,ut.w = t,t
 	return ut,nil
 }
@@ -379,7 +458,7 @@ type txManagerReckless struct{
 	f Flags
 }
 
-func (m *txManagerReckless) open(t TableDB,e error) (UTable,error) {
+func (m *txManagerReckless) open(name string,t TableDB,e error) (UTable,error) {
 	if e!=nil { return nil,e }
 	ut := new(uTableIW)
 	ut.ro = m.ro
@@ -388,6 +467,7 @@ func (m *txManagerReckless) open(t TableDB,e error) (UTable,error) {
 	ut.outopt = m.wo
 	ut.writer = &m.writer
 	ut.optim = m.optim
+	ut.tm,ut.name = m.txManager,name
 	if m.f.Has(F_NoSnapshot) {
 		ut.r = t
 	} else {
@@ -419,7 +499,7 @@ func (m *txManagerReckless) discard(utm map[string]UTable) {
 
 type txManagerSnapshot txManager
 
-func (m *txManagerSnapshot) open(t TableDB,e error) (UTable,error) {
+func (m *txManagerSnapshot) open(name string,t TableDB,e error) (UTable,error) {
 	if e!=nil { return nil,e }
 	sn,e := t.Snapshot()
 	if e!=nil { return nil,e }
@@ -442,7 +522,7 @@ func (m *txManagerSnapshot) discard(utm map[string]UTable) {
 
 type txManagerReadOnly txManager
 
-func (m *txManagerReadOnly) open(t TableDB,e error) (UTable,error) {
+func (m *txManagerReadOnly) open(name string,t TableDB,e error) (UTable,error) {
 	if e!=nil { return nil,e }
 	ut := new(uTableRO)
 	ut.ro = m.ro
@@ -456,7 +536,7 @@ type txManagerSerializable struct{
 	*txManager
 	f Flags
 }
-func (m *txManagerSerializable) open(t TableDB,e error) (UTable,error) {
+func (m *txManagerSerializable) open(name string,t TableDB,e error) (UTable,error) {
 	if e!=nil { return nil,e }
 	ut := new(uTableSR)
 	ut.ro = m.ro
@@ -512,8 +592,9 @@ func (m *txManagerSerializable) commit(utm map[string]UTable) error {
 	}
 	var gerr error
 	myws := make(map[string]BasicWriter)
+	batches := make(map[string]*leveldb.Batch)
+	if gerr = m.redo(); gerr!=nil { return gerr }
 	
-	var batch leveldb.Batch
 	// Step 1: Check all dependencies. Fail if they're not fullfilled.
 	for tabnam,ut := range utm {
 		sr := ut.(*uTableSR)
@@ -523,6 +604,16 @@ func (m *txManagerSerializable) commit(utm map[string]UTable) error {
 			if gerr!=nil { goto loopdone }
 		}
 		myws[tabnam] = myw
+		
+		// Keys, that are locked by a prepared transaction, must not be overwritten.
+		for key := range sr.w {
+			if m.isLocked(tabnam,[]byte(key)) { gerr = ErrConcurrentUpdate; goto loopdone }
+		}
+
+		for key,value := range sr.um {
+			v,_ := myw.Get([]byte(key),&m.ro)
+			if !bytes.Equal(value,v) { gerr = ErrConcurrentUpdate; goto loopdone }
+		}
 
 		// F_NoCheck: Always commit the changes, ignoring conflicts!
 		if m.f.Has(F_NoCheck) { continue }
@@ -532,10 +623,12 @@ func (m *txManagerSerializable) commit(utm map[string]UTable) error {
 			if !bytes.Equal(value,v) { gerr = ErrConcurrentUpdate; goto loopdone }
 		}
 	}
-	// Step 2: Apply all changes.
+	// Step 2: Apply all changes. A commit to several tables is logged first
+	//         and applied by logCommit, see RecoverableUDBM.
 	for tabnam,ut := range utm {
 		sr := ut.(*uTableSR)
-		myw := myws[tabnam]
+		if len(sr.w)==0 { continue }
+		batch := new(leveldb.Batch)
 		for key,value := range sr.w {
 			if len(value)==0 {
 				batch.Delete([]byte(key))
@@ -543,16 +636,25 @@ func (m *txManagerSerializable) commit(utm map[string]UTable) error {
 				batch.Put([]byte(key),value)
 			}
 		}
-		gerr = myw.Write(&batch,&m.wo)
-		if gerr!=nil { break }
-		batch.Reset()
+		batches[tabnam] = batch
+	}
+	if len(batches)>1 {
+		for _,myw := range myws {
+			if tx,ok := myw.(TableTx); ok { tx.Discard() }
+		}
+		return m.logCommit(batches)
+	}
+	for tabnam,batch := range batches {
+		gerr = myws[tabnam].Write(batch,&m.wo)
 	}
 	loopdone:
 	// Step 3: Commit transactions, if transactions are used in underlying
 	//         datastore.
 	if m.optim.Has(O_UseTransaction) {
 		if gerr==nil {
-			for _,myw := range myws { myw.(TableTx).Commit() }
+			for _,myw := range myws {
+				if err := myw.(TableTx).Commit(); err!=nil && gerr==nil { gerr = err }
+			}
 		} else {
 			for _,myw := range myws { myw.(TableTx).Discard() }
 		}
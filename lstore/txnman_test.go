@@ -0,0 +1,82 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package lstore
+
+import (
+	"testing"
+)
+
+func table(t *testing.T, tx UDB, name string) UTable {
+	t.Helper()
+	u,err := tx.UTable(name)
+	if err!=nil { t.Fatal(err) }
+	return u
+}
+
+// The keys read for update are checked at commit, even by WRITE_COMMIT, that ignores other reads.
+func TestReadForUpdate(t *testing.T) {
+	for _,w := range []WriteIso{WRITE_CHECKED,WRITE_COMMIT} {
+		m := Complex(testStorage(t),0)
+		put(t,m,"a","k","1")
+		tx := m.StartTx(READ_SNAPSHOT,w)
+		u := table(t,tx,"a").(UpdateReader)
+		if v := u.ReadForUpdate([]byte("k")); string(v)!="1" { t.Fatalf("got %q",v) }
+		u.Write([]byte("k"),[]byte("2"))
+		put(t,m,"a","k","3")
+		if err := tx.Commit(); err!=ErrConcurrentUpdate { t.Errorf("write iso %d: got %v, want ErrConcurrentUpdate",w,err) }
+
+		// Keys written by the transaction itself are not checked.
+		tx = m.StartTx(READ_SNAPSHOT,w)
+		u = table(t,tx,"a").(UpdateReader)
+		u.Write([]byte("k"),[]byte("4"))
+		if v := u.ReadForUpdate([]byte("k")); string(v)!="4" { t.Fatalf("got %q",v) }
+		put(t,m,"a","k","5")
+		if err := tx.Commit(); err!=nil { t.Errorf("write iso %d: %v",w,err) }
+	}
+}
+
+func TestReadForUpdatePrepare(t *testing.T) {
+	m := Complex(testStorage(t),0)
+	put(t,m,"a","k","1")
+	tx := m.StartTx(READ_SNAPSHOT,WRITE_COMMIT)
+	table(t,tx,"a").(UpdateReader).ReadForUpdate([]byte("k"))
+	table(t,tx,"b").Write([]byte("x"),[]byte("1"))
+	put(t,m,"a","k","2")
+	if err := tx.(PreparableUDB).Prepare([]byte("t1")); err!=ErrConcurrentUpdate { t.Errorf("got %v, want ErrConcurrentUpdate",err) }
+}
+
+// ReadCurrent sees the writes after the snapshot of the transaction.
+func TestReadCurrent(t *testing.T) {
+	for _,r := range []ReadIso{READ_SNAPSHOT,READ_ANY} {
+		m := Complex(testStorage(t),0)
+		put(t,m,"a","k","1")
+		tx := m.StartTx(r,WRITE_INSTANT)
+		u := table(t,tx,"a").(CASTable)
+		u.Read([]byte("k"))
+		put(t,m,"a","k","2")
+		if v := u.ReadCurrent([]byte("k")); string(v)!="2" { t.Errorf("read iso %d: got %q",r,v) }
+		if err := u.WriteIf([]byte("k"),[]byte("2"),[]byte("3")); err!=nil { t.Error(err) }
+		tx.Discard()
+	}
+}
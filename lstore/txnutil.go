@@ -26,7 +26,7 @@ package lstore
 import "github.com/syndtr/goleveldb/leveldb/opt"
 
 type tximpl interface{
-	open(TableDB,error) (UTable,error)
+	open(string,TableDB,error) (UTable,error)
 	commit(map[string]UTable) error
 	discard(map[string]UTable)
 }
@@ -38,11 +38,12 @@ type udbWrapper struct {
 }
 func (i *udbWrapper) UTable(name string) (UTable,error) {
 	if t := i.tables[name]; t!=nil { return t,nil }
-	t,e := i.open(i.inner.Table(name))
+	t,e := i.inner.Table(name)
+	ut,e := i.open(name,t,e)
 	if e!=nil { return nil,e }
 	if i.tables==nil { i.tables = make(map[string]UTable) }
-	i.tables[name] = t
-	return t,nil
+	i.tables[name] = ut
+	return ut,nil
 }
 func (i *udbWrapper) Commit() error {
 	ts := i.tables
@@ -61,7 +62,7 @@ type txnDirect struct{
 	ro opt.ReadOptions
 	wo opt.WriteOptions
 }
-func (d txnDirect) open(t TableDB,e error) (UTable,error) {
+func (d txnDirect) open(name string,t TableDB,e error) (UTable,error) {
 	if e!=nil { return nil,e }
 	ut := new(uTableD)
 	ut.ro,ut.r,ut.wo,ut.w = d.ro,t,d.wo,t
@@ -0,0 +1,261 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package protocol
+
+import (
+	"github.com/mad-day/hobbydb/lstore"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+)
+
+// The table, that holds the users.
+const usersTable = "jsondb_users"
+
+// The PBKDF2 iterations of new password hashes.
+const pbkdf2Iter = 10000
+
+var (
+	ErrNoUser = errors.New("protocol: no such user")
+	errAuthFailed = &Error{Code:931,Msg:"Authentication failed"}
+)
+
+/*
+Grants access to the collections, whose names match the pattern. The pattern
+has the syntax of path.Match, eg. "orders_*".
+*/
+type Grant struct{
+	Pattern string `json:"pattern"`
+	// Read access is always granted, Write grants write access too.
+	Write bool `json:"write,omitempty"`
+}
+
+// A user, as stored in the users table.
+type userRecord struct{
+	Salt []byte `json:"salt"`
+	Hash []byte `json:"hash"`
+	Iter int `json:"iter"`
+	// Admins have full access and may manage users.
+	Admin bool `json:"admin,omitempty"`
+	Grants []Grant `json:"grants,omitempty"`
+	// The storage quota in bytes, 0 means that of the Limits, negative ones unlimited.
+	Quota int64 `json:"quota,omitempty"`
+}
+
+// PBKDF2 with HMAC-SHA256 (RFC 8018), yielding one block.
+func pbkdf2(password, salt []byte, iter int) []byte {
+	prf := hmac.New(sha256.New,password)
+	var idx [4]byte
+	binary.BigEndian.PutUint32(idx[:],1)
+	prf.Write(salt)
+	prf.Write(idx[:])
+	u := prf.Sum(nil)
+	t := append([]byte(nil),u...)
+	for i := 1; i<iter; i++ {
+		prf.Reset()
+		prf.Write(u)
+		u = prf.Sum(u[:0])
+		for j := range t { t[j] ^= u[j] }
+	}
+	return t
+}
+
+func (u *userRecord) check(password string) bool {
+	if u.Iter<1 { return false }
+	return hmac.Equal(pbkdf2([]byte(password),u.Salt,u.Iter),u.Hash)
+}
+
+// Reports whether the user may access the collection.
+func (u *userRecord) allowed(coll string, write bool) bool {
+	if u.Admin { return true }
+	for _,g := range u.Grants {
+		if write && !g.Write { continue }
+		if ok,_ := path.Match(g.Pattern,coll); ok { return true }
+	}
+	return false
+}
+
+func newUserRecord(password string, admin bool, grants []Grant) (*userRecord,error) {
+	for _,g := range grants {
+		if _,err := path.Match(g.Pattern,""); err!=nil { return nil,err }
+	}
+	u := &userRecord{Salt:make([]byte,16),Iter:pbkdf2Iter,Admin:admin,Grants:grants}
+	if _,err := rand.Read(u.Salt); err!=nil { return nil,err }
+	u.Hash = pbkdf2([]byte(password),u.Salt,u.Iter)
+	return u,nil
+}
+
+func loadUser(tx lstore.UDB, name string) (*userRecord,error) {
+	t,err := tx.UTable(usersTable)
+	if err!=nil { return nil,err }
+	b := t.Read([]byte(name))
+	if len(b)==0 { return nil,ErrNoUser }
+	u := new(userRecord)
+	if err = json.Unmarshal(b,u); err!=nil { return nil,err }
+	return u,nil
+}
+
+func storeUser(tx lstore.UDB, name string, u *userRecord) error {
+	t,err := tx.UTable(usersTable)
+	if err!=nil { return err }
+	if u==nil { return t.Write([]byte(name),nil) }
+	b,err := json.Marshal(u)
+	if err!=nil { return err }
+	return t.Write([]byte(name),b)
+}
+
+/*
+Creates or replaces a user. Use it to create the first admin, before starting
+a Server with RequireAuth.
+*/
+func SetUser(ds lstore.UDBM, name, password string, admin bool, grants ...Grant) error {
+	u,err := newUserRecord(password,admin,grants)
+	if err!=nil { return err }
+	tx := ds.StartTx(lstore.READ_SNAPSHOT,lstore.WRITE_CHECKED)
+	if err = storeUser(tx,name,u); err!=nil {
+		tx.Discard()
+		return err
+	}
+	return tx.Commit()
+}
+
+func DeleteUser(ds lstore.UDBM, name string) error {
+	tx := ds.StartTx(lstore.READ_SNAPSHOT,lstore.WRITE_CHECKED)
+	if err := storeUser(tx,name,nil); err!=nil {
+		tx.Discard()
+		return err
+	}
+	return tx.Commit()
+}
+
+// The access, that the commands need: 'r'ead, 'w'rite or 'a'dmin.
+var cmdAccess = map[string]byte{
+	"get": 'r', "list": 'r', "find": 'r', "range": 'r', "query": 'r', "watch": 'r', "export": 'r', "get_schema": 'r', "stats": 'r', "history": 'r', "search": 'r',
+	"put": 'w', "delete": 'w', "merge": 'w', "patch": 'w', "update": 'w',
+	"create_index": 'w', "drop_index": 'w', "create_text_index": 'w', "drop_text_index": 'w', "import": 'w',
+	"user_set": 'a', "user_delete": 'a', "set_schema": 'a', "create": 'a', "drop": 'a', "set_history": 'a',
+}
+
+// The commands, that are followed by a dot body.
+var cmdBody = map[string]bool{
+	"put": true, "merge": true, "patch": true, "update": true, "query": true, "user_set": true, "import": true, "set_schema": true, "batch": true,
+}
+
+// Rejects the command. Its body was read ahead.
+func (c *cctx) deny(reason string) error {
+	return c.C.PrintfLine("930 Permission denied: %s",reason)
+}
+
+// Reports whether the session may issue commands at all.
+func (c *Session) authenticated() bool {
+	return c.user!=nil || !c.requireAuth
+}
+
+// Checks the grants of the authenticated user, if any.
+func (c *Session) authorize(cmd, coll string) bool {
+	if c.user==nil { return c.authenticated() }
+	switch cmdAccess[cmd] {
+	case 'r': return c.user.allowed(coll,false)
+	case 'w': return c.user.allowed(coll,true)
+	case 'a': return c.user.Admin
+	}
+	return true
+}
+
+// Authenticates the session as the user.
+func (c *Session) Auth(name, password string) error {
+	tx := c.DS.StartTx(lstore.READ_SNAPSHOT,lstore.WRITE_DISABLED)
+	u,err := loadUser(tx,name)
+	tx.Discard()
+	if err==ErrNoUser || (err==nil && !u.check(password)) {
+		c.logf("event=auth-failed user=%q",name)
+		return errAuthFailed
+	}
+	if err!=nil { return opError(800,"IO Error",err) }
+	c.user,c.userName = u,name
+	c.logf("event=auth user=%q",name)
+	return nil
+}
+
+// Reloads the record of the authenticated user. Fails, if the user was deleted.
+func (c *Session) reloadUser() error {
+	if c.user==nil { return nil }
+	tx := c.DS.StartTx(lstore.READ_SNAPSHOT,lstore.WRITE_DISABLED)
+	u,err := loadUser(tx,c.userName)
+	tx.Discard()
+	if err==ErrNoUser { return opError(930,"Permission denied",fmt.Errorf("user %s was deleted",c.userName)) }
+	if err!=nil { return opError(800,"IO Error",err) }
+	c.user = u
+	return nil
+}
+
+/*
+Authenticates the session as the user, whose identity was verified otherwise,
+eg. by a TLS client certificate. The user must exist.
+*/
+func (c *Session) Login(name string) error {
+	tx := c.DS.StartTx(lstore.READ_SNAPSHOT,lstore.WRITE_DISABLED)
+	u,err := loadUser(tx,name)
+	tx.Discard()
+	if err==ErrNoUser {
+		c.logf("event=auth-failed user=%q method=cert",name)
+		return errAuthFailed
+	}
+	if err!=nil { return opError(800,"IO Error",err) }
+	c.user,c.userName = u,name
+	c.logf("event=auth user=%q method=cert",name)
+	return nil
+}
+
+/*
+Handles the user management of admins:
+
+	user_set <name>       followed by {"password":"...", "admin":false, "grants":[{"pattern":"a*","write":true}], "quota":<bytes>}
+	user_delete <name>
+*/
+func (c *cctx) performUser(cmd, name string) error {
+	if cmd=="user_delete" {
+		if err := storeUser(c.TX,name,nil); err!=nil { return c.replyWrite(cmd,err) }
+		return c.C.PrintfLine("201 updated")
+	}
+	body,err := c.readBody()
+	if err!=nil { return err }
+	var req struct{
+		Password string `json:"password"`
+		Admin bool `json:"admin"`
+		Grants []Grant `json:"grants"`
+		Quota int64 `json:"quota"`
+	}
+	if err = json.Unmarshal(body,&req); err!=nil { return c.C.PrintfLine("904 Invalid value: %v",err) }
+	u,err := newUserRecord(req.Password,req.Admin,req.Grants)
+	if err!=nil { return c.C.PrintfLine("904 Invalid value: %v",err) }
+	u.Quota = req.Quota
+	if err = storeUser(c.TX,name,u); err!=nil { return c.replyWrite(cmd,err) }
+	return c.C.PrintfLine("201 updated")
+}
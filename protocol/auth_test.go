@@ -0,0 +1,112 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package protocol
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Test vector of RFC 7914, section 11.
+func TestPBKDF2(t *testing.T) {
+	want := []byte{0x55,0xac,0x04,0x6e,0x56,0xe3,0x08,0x9f,0xec,0x16,0x91,0xc2,0x25,0x44,0xb6,0x05,0xf9,0x41,0x85,0x21,0x6d,0xde,0x04,0x65,0xe6,0x8b,0x9d,0x57,0xc2,0x0d,0xac,0xbc}
+	if got := pbkdf2([]byte("passwd"),[]byte("salt"),1); !bytes.Equal(got,want) { t.Errorf("got %x",got) }
+}
+
+func TestAuth(t *testing.T) {
+	ds := testDS(t)
+	if err := SetUser(ds,"root","secret",true); err!=nil { t.Fatal(err) }
+	if err := SetUser(ds,"bob","pw",false,Grant{Pattern:"pub_*"},Grant{Pattern:"bob_*",Write:true}); err!=nil { t.Fatal(err) }
+	if err := SetUser(ds,"bad","pw",false,Grant{Pattern:"["}); err==nil { t.Error("an invalid pattern was accepted") }
+	s := &Server{DS:ds,RequireAuth:true}
+	c := testSession(t,s)
+	c.must("930","","tx_full snapshot")
+	c.must("931","","auth bob wrong")
+	c.must("931","","auth nobody pw")
+	c.must("200","","auth bob pw")
+	c.must("200","","tx_full snapshot")
+	c.list("list pub_docs")
+	c.must("930","1",`put pub_docs "a"`)
+	c.must("201","1",`put bob_docs "a"`)
+	c.must("930","",`get other "a"`)
+	c.must("930","","create bob_x")
+	c.must("930",`{"password":"x"}`,"user_set eve")
+	c.must("200","","commit")
+
+	a := testSession(t,&Server{DS:ds,RequireAuth:true})
+	a.must("200","","auth root secret")
+	a.must("200","","tx_full snapshot")
+	a.must("201",`1`,`put other "a"`)
+	a.must("201",`{"password":"x","grants":[{"pattern":"other"}]}`,"user_set eve")
+	a.must("904",`{"password":"x","grants":[{"pattern":"["}]}`,"user_set eve")
+	a.must("201","","user_delete bob")
+	a.must("200","","commit")
+
+	e := testSession(t,&Server{DS:ds,RequireAuth:true})
+	e.must("200","","auth eve x")
+	e.must("931","","auth bob pw")
+	e.must("200","","tx_read snapshot")
+	e.must("290","",`get other "a"`)
+	if doc := e.body(); doc!="1" { t.Errorf("got %q",doc) }
+}
+
+// Changed grants and deleted users take effect with the next transaction.
+func TestAuthReload(t *testing.T) {
+	ds := testDS(t)
+	if err := SetUser(ds,"root","secret",true); err!=nil { t.Fatal(err) }
+	if err := SetUser(ds,"bob","pw",false,Grant{Pattern:"docs",Write:true}); err!=nil { t.Fatal(err) }
+	c := testSession(t,&Server{DS:ds})
+	c.must("200","","auth bob pw")
+	c.must("200","","tx_full snapshot")
+	c.must("201","1",`put docs "a"`)
+
+	a := testSession(t,&Server{DS:ds})
+	a.must("200","","auth root secret")
+	a.must("200","","tx_full snapshot")
+	a.must("201",`{"password":"pw","grants":[{"pattern":"docs"}]}`,"user_set bob")
+	a.must("200","","commit")
+
+	// The running transaction keeps its grants.
+	c.must("201","2",`put docs "a"`)
+	c.must("200","","commit")
+	c.must("200","","tx_full snapshot")
+	c.must("930","3",`put docs "a"`)
+	c.must("290","",`get docs "a"`)
+	c.body()
+	c.must("200","","commit")
+
+	a.must("200","","tx_full snapshot")
+	a.must("201","","user_delete bob")
+	a.must("200","","commit")
+	c.must("930","","tx_full snapshot")
+}
+
+// Without RequireAuth, anonymous sessions have full access.
+func TestAuthAnonymous(t *testing.T) {
+	c := testSession(t,&Server{})
+	c.must("200","","tx_full snapshot")
+	c.must("201",`{"password":"x"}`,"user_set eve")
+	c.must("201",`1`,`put docs "a"`)
+	c.must("200","","commit")
+}
@@ -0,0 +1,148 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package protocol
+
+import (
+	"github.com/mad-day/hobbydb/lstore"
+	"encoding/json"
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// The attempts of a batch, that conflicts with concurrent transactions.
+const batchAttempts = 5
+
+/*
+An operation of a batch. Op is one of get, put, merge, patch, update or delete.
+Doc is the document of put, the patch of merge and patch, or the operators of
+update. If IfMatch is set, the document must have this ETag.
+*/
+type BatchOp struct{
+	Op string `json:"op"`
+	Coll string `json:"coll"`
+	Key json.RawMessage `json:"key"`
+	Doc json.RawMessage `json:"doc,omitempty"`
+	IfMatch string `json:"if_match,omitempty"`
+}
+
+// The result of a batch operation. Only gets have a document and an ETag.
+type BatchResult struct{
+	Doc json.RawMessage `json:"doc,omitempty"`
+	ETag string `json:"etag,omitempty"`
+}
+
+func retryable(err error) bool { return errors.Is(err,lstore.ErrConcurrentUpdate) }
+
+/*
+Performs the operations in one transaction. If the transaction conflicts with
+concurrent ones, it is retried up to batchAttempts times. If an operation
+fails, the transaction is rolled back and the error names the operation.
+*/
+func (s *Session) Batch(r lstore.ReadIso, w lstore.WriteIso, ops []BatchOp) (res []BatchResult, err error) {
+	for attempt := 1; ; attempt++ {
+		res,err = s.batch(r,w,ops)
+		if err==nil || attempt>=batchAttempts || !retryable(err) { return }
+		s.logf("event=batch-retry attempt=%d error=%q",attempt,err)
+	}
+}
+
+func (s *Session) batch(r lstore.ReadIso, w lstore.WriteIso, ops []BatchOp) ([]BatchResult,error) {
+	if err := s.Begin(r,w); err!=nil { return nil,err }
+	res := make([]BatchResult,len(ops))
+	for i,op := range ops {
+		var err error
+		if op.Op=="get" {
+			res[i].Doc,res[i].ETag,err = s.Get(op.Coll,op.Key)
+		} else {
+			err = s.Write(op.Op,op.Coll,op.Key,op.IfMatch,op.Doc)
+		}
+		if err!=nil {
+			s.Rollback()
+			if e,ok := err.(*Error); ok {
+				e2 := *e
+				e2.Msg = fmt.Sprintf("Batch failed at operation %d: %s",i+1,e.Msg)
+				return nil,&e2
+			}
+			return nil,err
+		}
+	}
+	if err := s.Commit(); err!=nil { return nil,err }
+	return res,nil
+}
+
+/*
+Handles batch <snapshot|repeatable|any> [full|batch]. The dot body holds one
+BatchOp per line:
+
+	{"op":"put","coll":"users","key":"bob","doc":{"age":20}}
+	{"op":"get","coll":"users","key":"alice"}
+
+The operations run in one transaction, by default a tx_full one. On success,
+the reply is followed by one BatchResult per operation:
+
+	204 batch committed
+	{}
+	{"doc":{"age":30},"etag":"..."}
+	.
+
+Otherwise the reply is the error of the failed operation or of the commit.
+*/
+func (c *cctx) performBatch(iso string, arg []byte) error {
+	body,err := c.readBody()
+	if err!=nil { return err }
+	if c.TX!=nil { return c.C.PrintfLine("981 Active transaction") }
+	var ri lstore.ReadIso
+	switch iso {
+	case "snapshot": ri = lstore.READ_SNAPSHOT
+	case "repeatable": ri = lstore.READ_REPEATABLE
+	case "any": ri = lstore.READ_ANY
+	default: return c.C.PrintfLine("990 unknown isolation level: %v",iso)
+	}
+	wi := lstore.WRITE_CHECKED
+	switch mode,_ := nextArg(arg); string(mode) {
+	case "","full":
+	case "batch": wi = lstore.WRITE_COMMIT
+	default: return c.C.PrintfLine("990 unknown isolation level: %s",mode)
+	}
+	var ops []BatchOp
+	for n,line := range bytes.Split(body,[]byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line)==0 { continue }
+		var op BatchOp
+		if err = json.Unmarshal(line,&op); err!=nil { return c.C.PrintfLine("904 Invalid value at line %d: %v",n+1,err) }
+		ops = append(ops,op)
+	}
+	res,err := c.Batch(ri,wi,ops)
+	if err!=nil { return c.reply(err,"") }
+	if err = c.C.PrintfLine("204 batch committed"); err!=nil { return err }
+	dw := c.bodyWriter()
+	defer dw.Close()
+	for _,r := range res {
+		b,err := json.Marshal(r)
+		if err!=nil { return err }
+		if _,err = dw.Write(append(b,'\n')); err!=nil { return err }
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package protocol
+
+import (
+	"github.com/mad-day/hobbydb/lstore"
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestBatch(t *testing.T) {
+	c := testSession(t,&Server{})
+	c.must("204","{\"op\":\"put\",\"coll\":\"docs\",\"key\":\"a\",\"doc\":{\"v\":1}}\n{\"op\":\"get\",\"coll\":\"docs\",\"key\":\"a\"}\n","batch snapshot")
+	if res := c.body(); !strings.HasPrefix(res,"{}\n{\"doc\":{\"v\":1},\"etag\":\"") { t.Errorf("got %q",res) }
+
+	// The failed operation rolls back the ones before it.
+	line := c.must("712","{\"op\":\"put\",\"coll\":\"docs\",\"key\":\"b\",\"doc\":1}\n{\"op\":\"delete\",\"coll\":\"docs\",\"key\":\"a\",\"if_match\":\"none\"}\n","batch snapshot batch")
+	if !strings.Contains(line,"operation 2") { t.Errorf("got %q",line) }
+	c.must("204","{\"op\":\"get\",\"coll\":\"docs\",\"key\":\"b\"}\n","batch any")
+	if res := c.body(); res!=`{"etag":"none"}` { t.Errorf("the failed batch wrote b: %q",res) }
+
+	c.must("996","{\"op\":\"copy\",\"coll\":\"docs\",\"key\":\"a\"}\n","batch snapshot")
+	c.must("904","{\"op\":\n","batch snapshot")
+	c.must("990","\n","batch dirty")
+	c.must("990","\n","batch snapshot instant")
+	c.must("200","","tx_read snapshot")
+	c.must("981","\n","batch snapshot")
+}
+
+// Concurrent batches, that are retried on conflicts, do not lose updates.
+func TestBatchConcurrent(t *testing.T) {
+	ds := testDS(t)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	ok := 0
+	for i := 0; i<4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s := NewSession(ds,false)
+			for j := 0; j<10; j++ {
+				ops := []BatchOp{{Op:"update",Coll:"docs",Key:json.RawMessage(`"n"`),Doc:json.RawMessage(`{"$inc":{"/n":1}}`)}}
+				if _,err := s.Batch(lstore.READ_SNAPSHOT,lstore.WRITE_CHECKED,ops); err!=nil {
+					if !retryable(err) { t.Error(err) }
+					continue
+				}
+				mu.Lock()
+				ok++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	s := NewSession(ds,false)
+	res,err := s.Batch(lstore.READ_SNAPSHOT,lstore.WRITE_DISABLED,[]BatchOp{{Op:"get",Coll:"docs",Key:json.RawMessage(`"n"`)}})
+	if err!=nil { t.Fatal(err) }
+	var doc struct{ N int `json:"n"` }
+	json.Unmarshal(res[0].Doc,&doc)
+	if ok==0 || doc.N!=ok { t.Errorf("%d batches succeeded, but n is %d",ok,doc.N) }
+}
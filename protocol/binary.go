@@ -0,0 +1,184 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package protocol
+
+import (
+	"github.com/mad-day/hobbydb/remotedoc"
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+/*
+The binary mode of the jsondb protocol. The client switches a connection into
+it with the "binary" command, usually right after connecting:
+
+	binary
+	200 binary mode
+
+The command and reply lines stay text lines, but keys and bodies no longer
+travel inline and as dot bodies. Instead, every key and every body is one
+msgpack frame (bin, or nil for absent documents) through remotedoc, holding
+the raw bytes. The frames are length-prefixed, so they are cheap to split and
+may hold anything, eg. newlines and dots, without escaping.
+
+Only the framing is msgpack: the keys and documents inside the frames are the
+same JSON text as in text mode, they are not converted to msgpack values.
+
+	put users [if-match <etag>]       followed by a key frame and a document frame
+	get users                         followed by a key frame
+	290 content follows ETag=<etag>   followed by a document frame
+	> [<seq> <op>]                    listing and watch items, followed by a key and a document frame
+
+The frames of a command are read right after its line, before the command is
+checked, so they never get out of sync with the command lines (dot bodies are
+read ahead the same way). All other commands and replies are those of the
+text mode.
+*/
+type binConn struct{
+	br *bufio.Reader
+	r *remotedoc.Reader
+	w *remotedoc.Writer
+	key,body []byte
+}
+
+// The commands, that are followed by a key frame in binary mode.
+var cmdKey = map[string]bool{
+	"get": true, "put": true, "delete": true, "merge": true, "patch": true, "update": true, "history": true,
+}
+
+func (c *cctx) startBinary() {
+	c.bin = &binConn{br:c.C.R,r:remotedoc.NewReader(c.C.R),w:remotedoc.NewWriter(c.C.W)}
+}
+
+// Reads a frame of up to max bytes. Larger frames are skipped and fail with errBodyTooLarge.
+func (b *binConn) readFrame(max int) ([]byte,error) {
+	if max<=0 { return b.r.DecodeBytes() }
+	n,err := b.r.DecodeBytesLen()
+	if err!=nil || n<0 { return nil,err }
+	if n>max {
+		if _,err = io.CopyN(ioutil.Discard,b.br,int64(n)); err!=nil { return nil,err }
+		return nil,errBodyTooLarge
+	}
+	p := make([]byte,n)
+	if _,err = io.ReadFull(b.br,p); err!=nil { return nil,err }
+	return p,nil
+}
+
+func (b *binConn) writeFrame(p []byte) error {
+	if err := b.w.EncodeBytes(p); err!=nil { return err }
+	return b.w.W.Flush()
+}
+
+// Reads the frames of the command. All frames are read, even if one is too large.
+func (b *binConn) prefetch(cmd string, max int) (err error) {
+	b.key,b.body = nil,nil
+	if cmdKey[cmd] {
+		if b.key,err = b.readFrame(max); err!=nil && err!=errBodyTooLarge { return }
+	}
+	if cmdBody[cmd] {
+		var berr error
+		if b.body,berr = b.readFrame(max); berr!=nil { err = berr }
+	}
+	return
+}
+
+/*
+Reads the key and the body of the command ahead, right after its line, so
+that the body is consumed, whatever the reply.
+*/
+func (c *cctx) prefetch(cmd string) (err error) {
+	max := c.limits().MaxBodySize
+	if c.bin!=nil { return c.bin.prefetch(cmd,max) }
+	c.body = nil
+	if cmdBody[cmd] { c.body,err = c.readDot(max) }
+	return
+}
+
+// Returns the body of the command, which is a dot body in text mode.
+func (c *cctx) readBody() ([]byte,error) {
+	if c.bin!=nil { return c.bin.body,nil }
+	return c.body,nil
+}
+
+// Parses the key of the command and the condition, that follows it.
+func (c *cctx) readKey(arg []byte) (key []byte, ifmatch string, err error) {
+	if c.bin==nil { return splitKey(arg) }
+	if key,err = normalizeJson(c.bin.key); err!=nil { return }
+	ifmatch,err = splitCond(arg)
+	return
+}
+
+// Parses the key of the command and returns the arguments, that follow it.
+func (c *cctx) readKeyArgs(arg []byte) (key, rest []byte, err error) {
+	if c.bin!=nil {
+		key,err = normalizeJson(c.bin.key)
+		return key,arg,err
+	}
+	raw,rest,err := nextJSON(arg)
+	if err!=nil { return }
+	key,err = normalizeJson(raw)
+	return
+}
+
+type frameWriter struct{
+	bytes.Buffer
+	b *binConn
+}
+func (f *frameWriter) Close() error { return f.b.writeFrame(f.Bytes()) }
+
+/*
+Returns the writer of a reply body, a DotWriter in text mode. In binary mode,
+the body is buffered and written as one frame on Close.
+*/
+func (c *cctx) bodyWriter() io.WriteCloser {
+	if c.bin!=nil { return &frameWriter{b:c.bin} }
+	return c.C.DotWriter()
+}
+
+// Writes the body of a reply.
+func (c *cctx) writeBody(p []byte) error {
+	if c.bin!=nil { return c.bin.writeFrame(p) }
+	dw := c.C.DotWriter()
+	if _,err := dw.Write(p); err!=nil {
+		dw.Close()
+		return err
+	}
+	return dw.Close()
+}
+
+// Writes an item line followed by the key and the document.
+func (c *cctx) writeItem(head string, key, doc []byte) error {
+	if c.bin==nil {
+		if err := c.C.PrintfLine("> %s%s",head,key); err!=nil { return err }
+		return c.writeBody(doc)
+	}
+	line := ">"
+	if head!="" { line += " "+strings.TrimSpace(head) }
+	if err := c.C.PrintfLine("%s",line); err!=nil { return err }
+	if err := c.bin.writeFrame(key); err!=nil { return err }
+	return c.bin.writeFrame(doc)
+}
@@ -0,0 +1,211 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package protocol
+
+import (
+	"github.com/mad-day/hobbydb/lstore"
+	"encoding/json"
+	"bytes"
+	"fmt"
+)
+
+// The documents per transaction of an import outside of a transaction.
+const importBatch = 500
+
+// Sets the value at the JSON pointer, creating objects as needed.
+func setPointer(doc map[string]interface{}, ptr string, v interface{}) {
+	toks := pointerTokens(ptr)
+	for _,tok := range toks[:len(toks)-1] {
+		n,ok := doc[tok].(map[string]interface{})
+		if !ok {
+			n = make(map[string]interface{})
+			doc[tok] = n
+		}
+		doc = n
+	}
+	doc[toks[len(toks)-1]] = v
+}
+
+/*
+Handles import <coll> <key-pointer> [skip|overwrite|fail]. The dot body holds
+one JSON object per line, the key of a document is taken from the field at
+key-pointer. Existing documents are overwritten by default, skip keeps them
+and fail stops the import.
+
+Within a transaction, the documents are written by it. Otherwise they are
+written by transactions of importBatch documents each, so a failed import
+keeps the batches before the failure.
+*/
+func (c *cctx) performImport(coll string, arg []byte) error {
+	body,err := c.readBody()
+	if err!=nil { return err }
+	if !c.authorize("import",coll) { return c.C.PrintfLine("930 Permission denied: no access to %s",coll) }
+	p,rest := nextArg(arg)
+	kp := string(p)
+	if kp=="" || !validPointer(kp) { return c.C.PrintfLine("902 Invalid JSON pointer: %q",kp) }
+	mode,_ := nextArg(rest)
+	switch string(mode) {
+	case "": mode = []byte("overwrite")
+	case "skip","overwrite","fail":
+	default: return c.C.PrintfLine("904 Invalid value: unknown mode %q",mode)
+	}
+
+	own := c.TX==nil
+	var u lstore.UTable
+	begin := func() error {
+		if own {
+			c.TX = c.DS.StartTx(lstore.READ_SNAPSHOT,lstore.WRITE_CHECKED)
+			c.instant = false
+		}
+		u,err = c.TX.UTable(docTable(coll))
+		return err
+	}
+	end := func(commit bool) error {
+		if !own || c.TX==nil { return nil }
+		tx := c.TX
+		c.TX = nil
+		if !commit {
+			tx.Discard()
+			c.changes = nil
+			return nil
+		}
+		if err := tx.Commit(); err!=nil {
+			c.changes = nil
+			return err
+		}
+		c.publishChanges()
+		return nil
+	}
+	if err = begin(); err!=nil {
+		end(false)
+		return c.C.PrintfLine("800 IO Error: %v",err)
+	}
+
+	var written,skipped,pending int
+	// Discards the current batch, the documents within a transaction stay.
+	fail := func(line int, code int, format string, args ...interface{}) error {
+		if own {
+			end(false)
+			written -= pending
+		}
+		return c.C.PrintfLine("%d Import failed at line %d (imported %d, skipped %d): %s",
+			code,line,written,skipped,fmt.Sprintf(format,args...))
+	}
+	for n,line := range bytes.Split(body,[]byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line)==0 { continue }
+		var doc interface{}
+		if err = json.Unmarshal(line,&doc); err!=nil { return fail(n+1,904,"%v",err) }
+		kv,ok := resolvePointer(doc,kp)
+		if !ok { return fail(n+1,904,"no key at %s",kp) }
+		key,err := json.Marshal(kv)
+		if err!=nil { return fail(n+1,901,"%v",err) }
+		old := u.Read(key)
+		if len(old)!=0 {
+			switch string(mode) {
+			case "skip":
+				skipped++
+				continue
+			case "fail":
+				return fail(n+1,713,"document %s exists",key)
+			}
+		}
+		if !own {
+			if err = c.checkWrites(); err!=nil { return fail(n+1,942,"%v",err) }
+		}
+		if err = c.writeDocIf(coll,u,key,old,line,false); err!=nil {
+			if se,ok := err.(*schemaError); ok {
+				if err = fail(n+1,960,"schema validation failed"); err!=nil { return err }
+				return c.schemaErrorBody(se)
+			}
+			if e,ok := err.(*Error); ok { return fail(n+1,e.Code,"%v",e) }
+			return fail(n+1,700,"%v",err)
+		}
+		written++
+		pending++
+		if !own { c.writes++ }
+		if own && pending>=importBatch {
+			if err = end(true); err!=nil { return fail(n+1,writeError(710,"Abort",err).Code,"%v",err) }
+			pending = 0
+			if err = begin(); err!=nil { return fail(n+1,800,"%v",err) }
+		}
+	}
+	if err = end(true); err!=nil {
+		written -= pending
+		e := writeError(710,"Abort",err)
+		return c.C.PrintfLine("%d %s (imported %d, skipped %d): %v",e.Code,e.Msg,written,skipped,err)
+	}
+	return c.C.PrintfLine("201 imported %d skipped %d",written,skipped)
+}
+
+/*
+Handles export <coll> [key-pointer]. The documents follow in key order as dot
+body, one JSON object per line. If key-pointer is given, the key is stored
+into the field of object documents.
+
+A stored document, that is not valid JSON, fails the export: the connection
+is closed without ending the body, so that the export is not taken as complete.
+*/
+func (c *cctx) performExport(coll string, arg []byte) error {
+	if !c.authorize("export",coll) { return c.deny("no access to "+coll) }
+	p,_ := nextArg(arg)
+	kp := string(p)
+	if kp!="" && !validPointer(kp) { return c.C.PrintfLine("902 Invalid JSON pointer: %q",kp) }
+	tx := c.TX
+	if tx==nil {
+		tx = c.DS.StartTx(lstore.READ_SNAPSHOT,lstore.WRITE_DISABLED)
+		defer tx.Discard()
+	}
+	u,err := tx.UTable(docTable(coll))
+	if err!=nil { return c.C.PrintfLine("800 IO Error: %v",err) }
+	iter := u.Iter()
+	defer iter.Release()
+	if err = c.C.PrintfLine("290 content follows"); err!=nil { return err }
+	dw := c.bodyWriter()
+	var buf bytes.Buffer
+	for iter.Next() {
+		buf.Reset()
+		doc := iter.Value()
+		if kp!="" {
+			var m map[string]interface{}
+			var kv interface{}
+			if unmarshalNumber(doc,&m)==nil && m!=nil && unmarshalNumber(iter.Key(),&kv)==nil {
+				setPointer(m,kp,kv)
+				enc := json.NewEncoder(&buf)
+				enc.SetEscapeHTML(false)
+				if err = enc.Encode(m); err!=nil { return fmt.Errorf("export %s: document %s: %v",coll,iter.Key(),err) }
+				doc = bclone(buf.Bytes())
+				buf.Reset()
+			}
+		}
+		// Documents may contain newlines.
+		if err = json.Compact(&buf,doc); err!=nil {
+			c.logf("event=export-failed collection=%q key=%q error=%q",coll,iter.Key(),err)
+			return fmt.Errorf("export %s: document %s: %v",coll,iter.Key(),err)
+		}
+		buf.WriteByte('\n')
+		if _,err = dw.Write(buf.Bytes()); err!=nil { return err }
+	}
+	return dw.Close()
+}
@@ -0,0 +1,91 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package protocol
+
+import (
+	"github.com/mad-day/hobbydb/lstore"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestImportExport(t *testing.T) {
+	c := testSession(t,&Server{})
+	c.must("201","{\"id\":\"a\",\"v\":1}\n{\"id\":\"b\",\"v\":2}\n\n","import docs /id")
+	if line := c.must("201","{\"id\":\"a\",\"v\":3}\n{\"id\":\"c\",\"v\":3}\n","import docs /id skip"); line!="201 imported 1 skipped 1" { t.Errorf("skip: got %q",line) }
+	if line := c.must("713","{\"id\":\"d\"}\n{\"id\":\"a\"}\n","import docs /id fail"); !strings.Contains(line,"line 2 (imported 0, skipped 0)") { t.Errorf("fail: got %q",line) }
+	c.must("904","{\"v\":1}\n","import docs /id")
+	c.must("904","{\"id\":1}\n","import docs /id merge")
+	c.must("902","{\"id\":1}\n","import docs id")
+
+	c.must("290","","export docs")
+	if got := c.body(); got!="{\"id\":\"a\",\"v\":1}\n{\"id\":\"b\",\"v\":2}\n{\"id\":\"c\",\"v\":3}" { t.Errorf("export: got %q",got) }
+	c.must("200","","tx_full snapshot")
+	c.must("201","{\"k\":{\"id\":\"x\"},\"v\":[1,\n2]}","put other \"x\"")
+	c.must("200","","commit")
+	c.must("290","","export other /k/id")
+	if got := c.body(); got!=`{"k":{"id":"x"},"v":[1,2]}` { t.Errorf("export with key: got %q",got) }
+	c.must("200","","tx_full snapshot")
+	c.must("201",`{"n":9007199254740993,"s":"<&>"}`,`put big "y"`)
+	c.must("200","","commit")
+	c.must("290","","export big /id")
+	if got := c.body(); got!=`{"id":"y","n":9007199254740993,"s":"<&>"}` { t.Errorf("export with key: got %q",got) }
+
+	// Within a transaction, the import is rolled back with it.
+	c.must("200","","tx_full snapshot")
+	c.must("201","{\"id\":\"z\"}\n","import docs /id")
+	c.must("200","","rollback")
+	c.must("200","","tx_read snapshot")
+	c.must("290","",`get docs "z"`)
+	if doc := c.body(); doc!="" { t.Errorf("the rolled back import wrote %s",doc) }
+	c.must("200","","rollback")
+}
+
+// A failed import outside of a transaction keeps the batches before the failure.
+func TestImportBatches(t *testing.T) {
+	c := testSession(t,&Server{})
+	var b strings.Builder
+	for i := 0; i<importBatch+10; i++ { fmt.Fprintf(&b,"{\"id\":%d}\n",i) }
+	b.WriteString("{}\n")
+	if line := c.must("904",b.String(),"import docs /id"); !strings.Contains(line,fmt.Sprintf("(imported %d,",importBatch)) { t.Errorf("got %q",line) }
+	c.must("200","","tx_read snapshot")
+	c.must("290","",`get docs %d`,importBatch-1)
+	if doc := c.body(); doc=="" { t.Error("the first batch was lost") }
+	c.must("290","",`get docs %d`,importBatch)
+	if doc := c.body(); doc!="" { t.Errorf("the failed batch was kept: %s",doc) }
+}
+
+// A document, that is not valid JSON, fails the export, instead of being left out.
+func TestExportInvalid(t *testing.T) {
+	s := &Server{}
+	c := testSession(t,s)
+	tx := s.DS.StartTx(lstore.READ_SNAPSHOT,lstore.WRITE_CHECKED)
+	u,err := tx.UTable(docTable("docs"))
+	if err!=nil { t.Fatal(err) }
+	u.Write([]byte(`"a"`),[]byte(`{"v":1}`))
+	u.Write([]byte(`"b"`),[]byte(`{"v":`))
+	if err = tx.Commit(); err!=nil { t.Fatal(err) }
+	c.must("290","","export docs")
+	if b,err := c.ReadDotBytes(); err==nil { t.Errorf("the export ended with %q",b) }
+}
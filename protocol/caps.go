@@ -0,0 +1,136 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package protocol
+
+import (
+	"crypto/tls"
+	"sort"
+	"strconv"
+)
+
+/*
+The versions of the jsondb protocol, that the server speaks. A new version is
+only needed, if the meaning of existing commands or replies changes; new
+commands are announced as capabilities.
+*/
+const (
+	ProtocolVersion = 1
+	MinProtocolVersion = 1
+)
+
+// The commands of the protocol, as announced by the capabilities.
+var commands = []string{
+	"auth", "batch", "binary", "capabilities", "collections", "commit", "create", "create_index",
+	"create_text_index", "delete", "drop", "drop_index", "drop_text_index", "export", "find", "get",
+	"get_schema", "hello", "history", "import", "list", "merge", "patch", "put", "query", "quit",
+	"range", "rollback", "search", "set_history", "set_schema", "starttls", "stats", "tx_auto",
+	"tx_batch", "tx_blind", "tx_full", "tx_read", "update", "user_delete", "user_set", "watch",
+}
+
+// Reports whether the command is one of the protocol, even before authentication.
+func knownCommand(cmd string) bool {
+	i := sort.SearchStrings(commands,cmd)
+	return i<len(commands) && commands[i]==cmd
+}
+
+/*
+The reply of the hello and capabilities commands. Clients should ignore
+fields, they do not know.
+*/
+type Capabilities struct{
+	// The negotiated protocol version and the range of the server.
+	Version int `json:"version"`
+	MinVersion int `json:"min_version"`
+	MaxVersion int `json:"max_version"`
+
+	Commands []string `json:"commands"`
+
+	// The isolation levels of the tx_* commands and the tx_* commands themselves.
+	ReadIsolation []string `json:"read_isolation"`
+	Transactions []string `json:"transactions"`
+
+	// The authentication mechanisms: "password" (auth) and "certificate" (TLS client certificates).
+	Auth []string `json:"auth"`
+	AuthRequired bool `json:"auth_required"`
+	User string `json:"user,omitempty"`
+
+	Binary bool `json:"binary"`
+	StartTLS bool `json:"starttls"`
+	TLS bool `json:"tls"`
+
+	Limits *Limits `json:"limits,omitempty"`
+}
+
+func (c *cctx) capabilities(version int) *Capabilities {
+	cp := &Capabilities{
+		Version: version,
+		MinVersion: MinProtocolVersion,
+		MaxVersion: ProtocolVersion,
+		Commands: commands,
+		ReadIsolation: []string{"snapshot","repeatable","any"},
+		Transactions: []string{"tx_full","tx_batch","tx_auto","tx_blind","tx_read"},
+		Auth: []string{"password"},
+		AuthRequired: c.requireAuth,
+		User: c.User(),
+		Binary: c.bin!=nil,
+		Limits: c.Limits,
+	}
+	_,cp.TLS = c.conn.(*tls.Conn)
+	if c.srv!=nil && c.srv.TLSConfig!=nil {
+		cp.StartTLS = !cp.TLS && c.conn!=nil && c.bin==nil
+		if c.srv.TLSConfig.ClientAuth>=tls.VerifyClientCertIfGiven { cp.Auth = append(cp.Auth,"certificate") }
+	}
+	return cp
+}
+
+/*
+Handles the handshake of the protocol:
+
+	hello [<version> [<option>...]]
+	capabilities
+
+Hello negotiates the protocol version: the server speaks the version of the
+client, if it supports it, otherwise its newest one, if that is older. Newer
+clients then fall back to the reply version, older ones, that the server no
+longer supports, get "991 Unsupported protocol version". The options are
+reserved for later versions and unknown ones are ignored. Both commands reply
+the Capabilities as JSON:
+
+	hello 1
+	290 content follows
+	{"version":1,"min_version":1,"max_version":1,"commands":["auth",...],...}
+	.
+
+Unknown commands are always answered with 996, so clients may probe for them.
+*/
+func (c *cctx) performHello(cmd, v string) error {
+	version := ProtocolVersion
+	if cmd=="hello" && v!="" {
+		n,err := strconv.Atoi(v)
+		if err!=nil || n<1 { return c.C.PrintfLine("999 Invalid command") }
+		if n<MinProtocolVersion { return c.C.PrintfLine("991 Unsupported protocol version: %d",n) }
+		if n<version { version = n }
+	}
+	return c.replyJSON(c.capabilities(version))
+}
@@ -0,0 +1,63 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package protocol
+
+import (
+	"encoding/json"
+	"sort"
+	"testing"
+)
+
+func (c *testConn) hello(line string) *Capabilities {
+	c.t.Helper()
+	c.must("290","","%s",line)
+	cp := new(Capabilities)
+	if err := json.Unmarshal([]byte(c.body()),cp); err!=nil { c.t.Fatal(err) }
+	return cp
+}
+
+func TestHello(t *testing.T) {
+	c := testSession(t,&Server{RequireAuth:true,Limits:Limits{MaxListKeys:10}})
+	cp := c.hello("hello")
+	if cp.Version!=ProtocolVersion || cp.MinVersion!=MinProtocolVersion || cp.MaxVersion!=ProtocolVersion { t.Errorf("got versions %+v",cp) }
+	if !cp.AuthRequired || cp.Binary || cp.TLS || cp.StartTLS || cp.Limits==nil || cp.Limits.MaxListKeys!=10 { t.Errorf("got %+v",cp) }
+	if cp = c.hello("hello 99 some-option"); cp.Version!=ProtocolVersion { t.Errorf("newer client: got version %d",cp.Version) }
+	c.must("999","","hello x")
+	c.must("999","","hello 0")
+	c.hello("capabilities")
+	c.must("996","","frobnicate")
+}
+
+// The announced commands are sorted and include those, that need grants or bodies.
+func TestCommands(t *testing.T) {
+	if !sort.StringsAreSorted(commands) { t.Error("the commands are not sorted") }
+	known := make(map[string]bool)
+	for _,cmd := range commands { known[cmd] = true }
+	for cmd := range cmdAccess {
+		if !known[cmd] { t.Errorf("%s is not announced",cmd) }
+	}
+	for cmd := range cmdBody {
+		if !known[cmd] { t.Errorf("%s is not announced",cmd) }
+	}
+}
@@ -0,0 +1,125 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package protocol
+
+import (
+	"github.com/mad-day/hobbydb/lstore"
+	"encoding/binary"
+	"encoding/json"
+	"regexp"
+)
+
+// The table, that holds the metadata of the collections.
+const catalogTable = "jsondb_catalog"
+
+var collName = regexp.MustCompile(`^[a-z0-9_]+$`)
+
+/*
+Reports whether the name is a valid collection name: lower-case letters,
+digits and underscores. Other names could reach tables outside of the
+collection, so every front end must check them.
+*/
+func ValidCollection(name string) bool { return collName.MatchString(name) }
+
+// The tables of a collection.
+func docTable(coll string) string { return "json_"+coll }
+func indexTable(coll string) string { return "jidx_"+coll }
+func ttlTable(coll string) string { return "jttl_"+coll }
+func histTable(coll string) string { return "jhist_"+coll }
+func ftsTable(coll string) string { return "jfts_"+coll }
+func ownerTable(coll string) string { return "jown_"+coll }
+
+// The metadata of a collection, stored as JSON in the catalog.
+type collMeta struct{
+	// JSON pointers of the indexed fields.
+	Indexes []string `json:"indexes,omitempty"`
+
+	// JSON pointers of the fields in the full-text index.
+	Text []string `json:"text,omitempty"`
+
+	// The JSON Schema of the documents.
+	Schema json.RawMessage `json:"schema,omitempty"`
+
+	// The seconds, a document lives after its last write, 0 means forever.
+	TTL int64 `json:"ttl,omitempty"`
+
+	// If set, the revisions of the documents are recorded.
+	History *historyOpts `json:"history,omitempty"`
+
+	// Whether the collection was created by the create command.
+	Created bool `json:"created,omitempty"`
+}
+
+func (m *collMeta) hasIndex(path string) bool {
+	for _,p := range m.Indexes {
+		if p==path { return true }
+	}
+	return false
+}
+
+// Loads the metadata of the collection. Unknown collections have empty metadata.
+func loadMeta(tx lstore.UDB, coll string) (*collMeta,error) {
+	t,err := tx.UTable(catalogTable)
+	if err!=nil { return nil,err }
+	m := new(collMeta)
+	if b := t.Read([]byte(coll)); len(b)!=0 {
+		if err = json.Unmarshal(b,m); err!=nil { return nil,err }
+	}
+	return m,nil
+}
+
+func storeMeta(tx lstore.UDB, coll string, m *collMeta) error {
+	t,err := tx.UTable(catalogTable)
+	if err!=nil { return err }
+	b,err := json.Marshal(m)
+	if err!=nil { return err }
+	return t.Write([]byte(coll),b)
+}
+
+/*
+Replaces the counter at the key (a big endian uint64) by fn of it and returns
+the old value. Instant transactions update it atomically, the others read it
+for update, so that concurrent updates conflict at commit.
+*/
+func updateCounter(t lstore.UTable, key []byte, fn func(n uint64) uint64) (uint64,error) {
+	for attempt := 1; ; attempt++ {
+		var cur []byte
+		ct,cas := t.(lstore.CASTable)
+		if cas {
+			cur = ct.ReadCurrent(key)
+		} else if ur,ok := t.(lstore.UpdateReader); ok {
+			cur = ur.ReadForUpdate(key)
+		} else {
+			cur = t.Read(key)
+		}
+		var n uint64
+		if len(cur)==8 { n = binary.BigEndian.Uint64(cur) }
+		b := make([]byte,8)
+		binary.BigEndian.PutUint64(b,fn(n))
+		if !cas { return n,t.Write(key,b) }
+		err := ct.WriteIf(key,cur,b)
+		if err==nil { return n,nil }
+		if err!=lstore.ErrConcurrentUpdate || attempt>=updateAttempts { return 0,err }
+	}
+}
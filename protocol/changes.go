@@ -0,0 +1,298 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package protocol
+
+import (
+	"github.com/mad-day/hobbydb/lstore"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+The table of the change log. The changes are stored under their sequence
+number (big endian), in the order of the commits.
+*/
+const changesTable = "jsondb_changes"
+
+type change struct{
+	Seq uint64 `json:"-"`
+	Coll string `json:"coll"`
+	Key json.RawMessage `json:"key"`
+	Doc json.RawMessage `json:"doc,omitempty"`
+}
+
+func (ch *change) op() string {
+	if len(ch.Doc)==0 { return "delete" }
+	return "put"
+}
+
+func seqKey(seq uint64) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:],seq)
+	return b[:]
+}
+
+/*
+The change log of a UDBM, shared by all connections. Changes are appended
+after their transaction committed, so a crash in between loses them.
+*/
+type changeHub struct{
+	ds lstore.UDBM
+	mu sync.Mutex
+	loaded bool
+	seq uint64
+	retention uint64
+	watchers map[chan struct{}]bool
+}
+
+// The number of changes, that the change log keeps, unless SetChangeRetention says otherwise.
+var DefaultChangeRetention uint64 = 100000
+
+var hubsMu sync.Mutex
+var hubs = make(map[lstore.UDBM]*changeHub)
+
+func hubFor(ds lstore.UDBM) *changeHub {
+	hubsMu.Lock(); defer hubsMu.Unlock()
+	h := hubs[ds]
+	if h==nil {
+		h = &changeHub{ds:ds,watchers:make(map[chan struct{}]bool)}
+		hubs[ds] = h
+	}
+	return h
+}
+
+/*
+Keeps only the last n changes of the UDBM, older ones are deleted, as new ones
+are appended. 0 means DefaultChangeRetention.
+*/
+func SetChangeRetention(ds lstore.UDBM, n uint64) {
+	h := hubFor(ds)
+	h.mu.Lock()
+	h.retention = n
+	h.mu.Unlock()
+}
+
+/*
+Releases the change log state of the UDBM, once it is closed. Its retention
+setting is forgotten, and its watchers are no longer woken up.
+*/
+func ReleaseChanges(ds lstore.UDBM) {
+	hubsMu.Lock()
+	delete(hubs,ds)
+	hubsMu.Unlock()
+}
+
+// Finds the last sequence number by a binary search. Must hold mu.
+func (h *changeHub) load() error {
+	if h.loaded { return nil }
+	tx := h.ds.StartTx(lstore.READ_SNAPSHOT,lstore.WRITE_DISABLED)
+	defer tx.Discard()
+	t,err := tx.UTable(changesTable)
+	if err!=nil { return err }
+	iter := t.Iter()
+	defer iter.Release()
+	var seq uint64
+	for bit := uint(63); ; bit-- {
+		if iter.Seek(seqKey(seq|1<<bit)) { seq |= 1<<bit }
+		if bit==0 { break }
+	}
+	h.seq,h.loaded = seq,true
+	return nil
+}
+
+// Returns the last sequence number.
+func (h *changeHub) last() (uint64,error) {
+	h.mu.Lock(); defer h.mu.Unlock()
+	err := h.load()
+	return h.seq,err
+}
+
+// Appends the changes to the log and wakes up the watchers.
+func (h *changeHub) publish(chs []*change) error {
+	if len(chs)==0 { return nil }
+	h.mu.Lock(); defer h.mu.Unlock()
+	if err := h.load(); err!=nil { return err }
+	tx := h.ds.StartTx(lstore.READ_ANY,lstore.WRITE_COMMIT)
+	t,err := tx.UTable(changesTable)
+	if err!=nil {
+		tx.Discard()
+		return err
+	}
+	seq := h.seq
+	for _,ch := range chs {
+		seq++
+		b,err := json.Marshal(ch)
+		if err==nil { err = t.Write(seqKey(seq),b) }
+		if err!=nil {
+			tx.Discard()
+			return err
+		}
+	}
+	retention := h.retention
+	if retention==0 { retention = DefaultChangeRetention }
+	if seq>retention {
+		if err = h.expire(t,seq-retention); err!=nil {
+			tx.Discard()
+			return err
+		}
+	}
+	if err = tx.Commit(); err!=nil { return err }
+	for _,ch := range chs {
+		h.seq++
+		ch.Seq = h.seq
+	}
+	for w := range h.watchers {
+		select {
+		case w <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+/*
+Deletes the changes up to seq. These are usually just the ones, that the last
+appends pushed out, but also the older ones, if the retention was lowered.
+*/
+func (h *changeHub) expire(t lstore.UTable, seq uint64) error {
+	var keys [][]byte
+	iter := t.Iter()
+	for ok := iter.Next(); ok && bytes.Compare(iter.Key(),seqKey(seq))<=0; ok = iter.Next() {
+		keys = append(keys,bclone(iter.Key()))
+	}
+	iter.Release()
+	for _,k := range keys {
+		if err := t.Write(k,nil); err!=nil { return err }
+	}
+	return nil
+}
+
+func (h *changeHub) subscribe() chan struct{} {
+	w := make(chan struct{},1)
+	h.mu.Lock()
+	h.watchers[w] = true
+	h.mu.Unlock()
+	return w
+}
+func (h *changeHub) unsubscribe(w chan struct{}) {
+	h.mu.Lock()
+	delete(h.watchers,w)
+	h.mu.Unlock()
+}
+
+// Calls fn with the logged changes, starting at seq.
+func (h *changeHub) read(seq uint64, fn func(ch *change) error) error {
+	tx := h.ds.StartTx(lstore.READ_SNAPSHOT,lstore.WRITE_DISABLED)
+	defer tx.Discard()
+	t,err := tx.UTable(changesTable)
+	if err!=nil { return err }
+	iter := t.Iter()
+	defer iter.Release()
+	for ok := iter.Seek(seqKey(seq)); ok; ok = iter.Next() {
+		if len(iter.Key())!=8 { continue }
+		ch := new(change)
+		if json.Unmarshal(iter.Value(),ch)!=nil { continue }
+		ch.Seq = binary.BigEndian.Uint64(iter.Key())
+		if err = fn(ch); err!=nil { return err }
+	}
+	return nil
+}
+
+// Records a change of the current transaction.
+func (c *Session) recordChange(coll string, key, doc []byte) error {
+	ch := &change{Coll:coll,Key:bclone(key),Doc:bclone(doc)}
+	if c.instant { return hubFor(c.DS).publish([]*change{ch}) }
+	c.changes = append(c.changes,ch)
+	return nil
+}
+
+// Publishes the changes of the committed transaction.
+func (c *Session) publishChanges() {
+	chs := c.changes
+	c.changes = nil
+	if err := hubFor(c.DS).publish(chs); err!=nil {
+		c.logf("event=changes-lost count=%d error=%q",len(chs),err)
+	}
+}
+
+/*
+Handles watch <coll> [from-seq]. The connection streams the changes of the
+collection:
+
+	203 watching <coll>
+	> <seq> <put|delete> <key>
+	<document as dot body, empty for deletes>
+	...
+
+Any line of the client ends the stream with "! <next-seq>", which resumes it
+later on. Without from-seq, only new changes are streamed.
+*/
+func (c *cctx) performWatch(coll string, arg []byte) error {
+	if c.TX!=nil { return c.C.PrintfLine("981 Active transaction") }
+	if !c.authorize("watch",coll) { return c.deny("no access to "+coll) }
+	h := hubFor(c.DS)
+	next,err := h.last()
+	if err!=nil { return c.C.PrintfLine("800 IO Error: %v",err) }
+	next++
+	if a,_ := nextArg(arg); len(a)!=0 {
+		if next,err = strconv.ParseUint(string(a),10,64); err!=nil { return c.C.PrintfLine("904 Invalid value: %v",err) }
+	}
+	w := h.subscribe()
+	defer h.unsubscribe(w)
+	if err = c.C.PrintfLine("203 watching %s",coll); err!=nil { return err }
+
+	// The stream is idle, while it waits for the client, so Shutdown() ends it.
+	c.deadline(0)
+	atomic.StoreInt32(&c.idle,1)
+	defer atomic.StoreInt32(&c.idle,0)
+	stop := make(chan error,1)
+	go func() {
+		_,err := c.C.ReadLine()
+		stop <- err
+	}()
+
+	emit := func(ch *change) error {
+		next = ch.Seq+1
+		if ch.Coll!=coll { return nil }
+		return c.writeItem(fmt.Sprintf("%d %s ",ch.Seq,ch.op()),ch.Key,ch.Doc)
+	}
+	for {
+		if c.srv!=nil && c.srv.closing() { return errShutdown }
+		if err = h.read(next,emit); err!=nil { return err }
+		select {
+		case <-w:
+		case err = <-stop:
+			if err!=nil {
+				if c.srv!=nil && c.srv.closing() { return errShutdown }
+				return err
+			}
+			return c.C.PrintfLine("! %d",next)
+		}
+	}
+}
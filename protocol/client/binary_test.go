@@ -0,0 +1,82 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package client
+
+import (
+	"github.com/mad-day/hobbydb/lstore"
+	"github.com/mad-day/hobbydb/protocol"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// Both modes return the same documents, keys and listings.
+func TestBinary(t *testing.T) {
+	addr := testServer(t,&protocol.Server{Limits:protocol.Limits{MaxBodySize:64}})
+	for _,binary := range []bool{false,true} {
+		c := testDial(t,addr)
+		if binary { must(t,c.Binary()) }
+		coll := "text"
+		if binary { coll = "bin" }
+		key := "a b\n.c"
+		must(t,c.Begin(lstore.READ_SNAPSHOT,lstore.WRITE_CHECKED))
+		must(t,c.Put(coll,key,json.RawMessage("{\"s\":\".\\n.\"}")))
+		doc,err := c.Get(coll,key)
+		must(t,err)
+		if string(doc)!=`{"s":".\n."}` { t.Errorf("binary %v: got %s",binary,doc) }
+		if doc,_ = c.Get(coll,"missing"); doc!=nil { t.Errorf("binary %v: missing document: got %q",binary,doc) }
+
+		// The too large body is skipped, the connection stays in sync.
+		err = c.Put(coll,"big",strings.Repeat("x",100))
+		var e *Error
+		if !errors.As(err,&e) || e.Code!=945 { t.Errorf("binary %v: got %v, want 945",binary,err) }
+		must(t,c.Delete(coll,"nothing"))
+
+		var keys []string
+		must(t,c.List(coll,func(k, v json.RawMessage) error {
+			var s string
+			json.Unmarshal(k,&s)
+			keys = append(keys,s)
+			return nil
+		}))
+		if len(keys)!=1 || keys[0]!=key { t.Errorf("binary %v: got keys %q",binary,keys) }
+		must(t,c.Commit())
+
+		var buf bytes.Buffer
+		must(t,c.Export(coll,"",&buf))
+		if buf.String()!="{\"s\":\".\\n.\"}\n" { t.Errorf("binary %v: export: got %q",binary,buf.String()) }
+		res,err := c.Batch(lstore.READ_SNAPSHOT,lstore.WRITE_CHECKED,[]BatchOp{{Op:"get",Coll:coll,Key:key}})
+		must(t,err)
+		if len(res)!=1 || string(res[0].Doc)!=`{"s":".\n."}` { t.Errorf("binary %v: batch: got %+v",binary,res) }
+	}
+}
+
+func TestBinaryInTx(t *testing.T) {
+	c := testDial(t,testServer(t,&protocol.Server{}))
+	must(t,c.Begin(lstore.READ_SNAPSHOT,lstore.WRITE_CHECKED))
+	var e *Error
+	if err := c.Binary(); !errors.As(err,&e) || e.Code!=981 { t.Errorf("got %v, want 981",err) }
+}
@@ -0,0 +1,42 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package client
+
+import (
+	"github.com/mad-day/hobbydb/protocol"
+	"testing"
+)
+
+// The capabilities tell the negotiated version and whether the connection is in binary mode.
+func TestHello(t *testing.T) {
+	addr := testServer(t,&protocol.Server{})
+	for _,binary := range []bool{false,true} {
+		c := testDial(t,addr)
+		if binary { must(t,c.Binary()) }
+		cp,err := c.Hello()
+		must(t,err)
+		if cp.Version!=ProtocolVersion || len(cp.Commands)==0 { t.Errorf("binary %v: got %+v",binary,cp) }
+		if cp.Binary!=binary { t.Errorf("binary %v: the capabilities announce binary %v",binary,cp.Binary) }
+	}
+}
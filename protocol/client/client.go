@@ -0,0 +1,850 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+/*
+A client for the jsondb protocol.
+*/
+package client
+
+import (
+	"github.com/mad-day/hobbydb/lstore"
+	"github.com/mad-day/hobbydb/remotedoc"
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/textproto"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// The server failed to read or write its storage (8xx replies).
+var ErrServerIO = errors.New("jsondb: server IO error")
+
+// The document did not match the ETag of a conditional write (712 replies).
+var ErrPrecondition = errors.New("jsondb: precondition failed")
+
+// The ETag, that matches absent documents.
+const NoETag = "none"
+
+// The reply did not follow the protocol.
+var ErrProtocol = errors.New("jsondb: protocol error")
+
+// An error reply of the server.
+type Error struct{
+	Code int
+	Msg string
+	// The details, that follow some errors, eg. schema validation errors.
+	Details []string
+}
+func (e *Error) Error() string {
+	if len(e.Details)!=0 { return fmt.Sprintf("jsondb: %d %s: %s",e.Code,e.Msg,strings.Join(e.Details,"; ")) }
+	return fmt.Sprintf("jsondb: %d %s",e.Code,e.Msg)
+}
+
+/*
+Conflicts with concurrent updates (711 replies) unwrap to
+lstore.ErrConcurrentUpdate, so they can be told apart from IO errors, which
+unwrap to ErrServerIO:
+
+	if errors.Is(err,lstore.ErrConcurrentUpdate) { retry() }
+*/
+func (e *Error) Unwrap() error {
+	switch {
+	case e.Code==711: return lstore.ErrConcurrentUpdate
+	case e.Code==712: return ErrPrecondition
+	case e.Code/100==8: return ErrServerIO
+	}
+	return nil
+}
+
+type Conn struct{
+	c *textproto.Conn
+	conn net.Conn
+	pool *Pool
+	inTx bool
+	broken bool
+
+	// Set in binary mode.
+	br *remotedoc.Reader
+	bw *remotedoc.Writer
+}
+
+func Dial(network, addr string) (*Conn,error) {
+	conn,err := net.Dial(network,addr)
+	if err!=nil { return nil,err }
+	return NewConn(conn),nil
+}
+func NewConn(conn net.Conn) *Conn {
+	return &Conn{c:textproto.NewConn(conn),conn:conn}
+}
+
+// Connects to a server, that listens with TLS (Server.ListenAndServeTLS).
+func DialTLS(network, addr string, cfg *tls.Config) (*Conn,error) {
+	conn,err := tls.Dial(network,addr,cfg)
+	if err!=nil { return nil,err }
+	return NewConn(conn),nil
+}
+
+/*
+Upgrades a cleartext connection to TLS with the starttls command. If cfg has
+no ServerName, the host of the remote address is verified. Client certificates
+of cfg may authenticate the connection as a user, depending on the server.
+STARTTLS must precede Binary.
+*/
+func (c *Conn) StartTLS(cfg *tls.Config) error {
+	if _,ok := c.conn.(*tls.Conn); ok { return nil }
+	if c.bw!=nil { return errors.New("jsondb: STARTTLS in binary mode") }
+	if cfg.ServerName=="" && !cfg.InsecureSkipVerify {
+		host,_,err := net.SplitHostPort(c.conn.RemoteAddr().String())
+		if err!=nil { return err }
+		cfg = cfg.Clone()
+		cfg.ServerName = host
+	}
+	if err := c.cmd("starttls"); err!=nil { return err }
+	if _,err := c.reply(200); err!=nil { return err }
+	tc := tls.Client(c.conn,cfg)
+	if err := tc.Handshake(); err!=nil { return c.fail(err) }
+	c.c,c.conn = textproto.NewConn(tc),tc
+	return nil
+}
+
+// Closes the connection, or returns it to its pool.
+func (c *Conn) Close() error {
+	if c.pool!=nil { return c.pool.put(c) }
+	return c.close()
+}
+func (c *Conn) close() error {
+	if !c.broken { c.cmd("quit") }
+	return c.c.Close()
+}
+
+// Reports whether a transaction is active.
+func (c *Conn) InTx() bool { return c.inTx }
+
+// Marks the connection as broken on transport errors.
+func (c *Conn) fail(err error) error {
+	if _,ok := err.(*Error); !ok && err!=nil { c.broken = true }
+	return err
+}
+
+func (c *Conn) cmd(format string, args ...interface{}) error {
+	return c.fail(c.c.PrintfLine(format,args...))
+}
+func (c *Conn) body(b []byte) error {
+	if c.bw!=nil { return c.frame(b) }
+	dw := c.c.DotWriter()
+	if _,err := dw.Write(b); err!=nil {
+		dw.Close()
+		return c.fail(err)
+	}
+	return c.fail(dw.Close())
+}
+
+/*
+Switches the connection into the binary mode of the protocol, in which keys
+and documents travel in msgpack bin frames instead of text lines and dot
+bodies. The frames hold the JSON text. The methods stay the same.
+*/
+func (c *Conn) Binary() error {
+	if c.bw!=nil { return nil }
+	if err := c.cmd("binary"); err!=nil { return err }
+	if _,err := c.reply(200); err!=nil { return err }
+	c.br,c.bw = remotedoc.NewReader(c.c.R),remotedoc.NewWriter(c.c.W)
+	return nil
+}
+
+func (c *Conn) frame(b []byte) error {
+	if err := c.bw.EncodeBytes(b); err!=nil { return c.fail(err) }
+	return c.fail(c.bw.W.Flush())
+}
+
+/*
+Reads the body of a reply, a frame in binary mode. In text mode the final
+newline, that the dot-encoding adds, is stripped, so both modes return the
+same bytes.
+*/
+func (c *Conn) readBody() ([]byte,error) {
+	var b []byte
+	var err error
+	if c.br!=nil {
+		b,err = c.br.DecodeBytes()
+	} else {
+		b,err = c.c.ReadDotBytes()
+		b = bytes.TrimSuffix(b,[]byte("\n"))
+	}
+	return b,c.fail(err)
+}
+
+// Reads a body of lines.
+func (c *Conn) readBodyLines() ([]string,error) {
+	if c.br==nil {
+		lines,err := c.c.ReadDotLines()
+		return lines,c.fail(err)
+	}
+	b,err := c.readBody()
+	if err!=nil { return nil,err }
+	lines := strings.Split(strings.TrimSuffix(string(b),"\n"),"\n")
+	if len(b)==0 { lines = nil }
+	return lines,nil
+}
+
+// Sends a command, that refers to a key, which is a frame in binary mode.
+func (c *Conn) keyCmd(op, coll, key, cond string) error {
+	if c.bw==nil { return c.cmd("%s %s %s%s",op,coll,key,cond) }
+	if err := c.cmd("%s %s%s",op,coll,cond); err!=nil { return err }
+	return c.frame([]byte(key))
+}
+
+// Reads the key and the document of a listing item, whose line ends in the key in text mode.
+func (c *Conn) readItem(rest string) (key, doc json.RawMessage, err error) {
+	if c.br!=nil {
+		if key,err = c.readBody(); err!=nil { return }
+	} else {
+		key = json.RawMessage(rest)
+	}
+	doc,err = c.readBody()
+	return
+}
+
+// Reads a reply line and fails, unless it has the expected code.
+func (c *Conn) reply(expect int) (msg string,err error) {
+	line,err := c.c.ReadLine()
+	if err!=nil { return "",c.fail(err) }
+	code,msg,err := parseReply(line)
+	if err!=nil { return "",c.fail(err) }
+	if code!=expect {
+		e := &Error{Code:code,Msg:msg}
+		// Schema validation errors are followed by a dot body.
+		if code==960 {
+			lines,err := c.readBodyLines()
+			if err!=nil { return msg,err }
+			e.Details = lines
+		}
+		// The server rolled the expired transaction back.
+		if code==941 { c.inTx = false }
+		return msg,e
+	}
+	return
+}
+func parseReply(line string) (code int, msg string, err error) {
+	if len(line)<3 { return 0,"",ErrProtocol }
+	code,err = strconv.Atoi(line[:3])
+	if err!=nil { return 0,"",ErrProtocol }
+	msg = strings.TrimPrefix(line[3:]," ")
+	return
+}
+
+func encodeKey(key interface{}) (string,error) {
+	switch k := key.(type) {
+	case json.RawMessage:
+		return string(k),nil
+	}
+	b,err := json.Marshal(key)
+	return string(b),err
+}
+func encodeDoc(doc interface{}) ([]byte,error) {
+	switch d := doc.(type) {
+	case json.RawMessage: return d,nil
+	case []byte: return d,nil
+	}
+	return json.Marshal(doc)
+}
+
+var writeCmds = map[lstore.WriteIso]string{
+	lstore.WRITE_CHECKED: "tx_full",
+	lstore.WRITE_COMMIT: "tx_batch",
+	lstore.WRITE_INSTANT_ATOMIC: "tx_auto",
+	lstore.WRITE_INSTANT: "tx_blind",
+	lstore.WRITE_DISABLED: "tx_read",
+}
+var readNames = map[lstore.ReadIso]string{
+	lstore.READ_SNAPSHOT: "snapshot",
+	lstore.READ_REPEATABLE: "repeatable",
+	lstore.READ_ANY: "any",
+}
+
+func (c *Conn) Auth(user, password string) error {
+	if err := c.cmd("auth %s %s",user,password); err!=nil { return err }
+	_,err := c.reply(200)
+	return err
+}
+
+func (c *Conn) Begin(r lstore.ReadIso, w lstore.WriteIso) error {
+	wc,ok := writeCmds[w]
+	if !ok { return fmt.Errorf("jsondb: invalid WriteIso %d",w) }
+	rn,ok := readNames[r]
+	if !ok { return fmt.Errorf("jsondb: invalid ReadIso %d",r) }
+	if err := c.cmd("%s %s",wc,rn); err!=nil { return err }
+	_,err := c.reply(200)
+	if err==nil { c.inTx = true }
+	return err
+}
+
+func (c *Conn) Commit() error {
+	if err := c.cmd("commit"); err!=nil { return err }
+	c.inTx = false
+	_,err := c.reply(200)
+	return err
+}
+
+func (c *Conn) Rollback() error {
+	if err := c.cmd("rollback"); err!=nil { return err }
+	c.inTx = false
+	_,err := c.reply(200)
+	return err
+}
+
+// Returns the document or nil, if it does not exist.
+func (c *Conn) Get(coll string, key interface{}) (json.RawMessage,error) {
+	doc,_,err := c.GetETag(coll,key)
+	return doc,err
+}
+
+// Returns the document and its ETag, which is NoETag, if it does not exist.
+func (c *Conn) GetETag(coll string, key interface{}) (doc json.RawMessage, etag string, err error) {
+	doc,etag,_,err = c.get(coll,key,"")
+	return
+}
+
+func (c *Conn) get(coll string, key interface{}, cond string) (doc json.RawMessage, etag string, rev uint64, err error) {
+	k,err := encodeKey(key)
+	if err!=nil { return }
+	if err = c.keyCmd("get",coll,k,cond); err!=nil { return }
+	msg,err := c.reply(290)
+	if err!=nil { return }
+	etag = NoETag
+	if i := strings.Index(msg,"ETag="); i>=0 { etag = msg[i+5:] }
+	if i := strings.Index(msg,"Rev="); i>=0 {
+		f := strings.Fields(msg[i+4:])
+		if len(f)!=0 { rev,_ = strconv.ParseUint(f[0],10,64) }
+	}
+	b,err := c.readBody()
+	if err!=nil { return nil,"",0,err }
+	if len(b)!=0 { doc = json.RawMessage(b) }
+	return
+}
+
+func (c *Conn) write(op, coll string, key, doc interface{}) error {
+	return c.writeIf(op,coll,key,"",doc)
+}
+
+// Writes, if etag is empty or the ETag of the current document.
+func (c *Conn) writeIf(op, coll string, key interface{}, etag string, doc interface{}) error {
+	k,err := encodeKey(key)
+	if err!=nil { return err }
+	var b []byte
+	if op!="delete" {
+		b,err = encodeDoc(doc)
+		if err!=nil { return err }
+	}
+	cond := ""
+	if etag!="" { cond = " if-match "+etag }
+	if err = c.keyCmd(op,coll,k,cond); err!=nil { return err }
+	if op!="delete" {
+		if err = c.body(b); err!=nil { return err }
+	}
+	_,err = c.reply(201)
+	return err
+}
+
+func (c *Conn) Put(coll string, key, doc interface{}) error { return c.write("put",coll,key,doc) }
+
+// Applies a JSON merge patch (RFC 7386).
+func (c *Conn) Merge(coll string, key, patch interface{}) error { return c.write("merge",coll,key,patch) }
+
+// Applies a JSON patch (RFC 6902).
+func (c *Conn) Patch(coll string, key, patch interface{}) error { return c.write("patch",coll,key,patch) }
+
+// Applies update operators like {"$inc":{"/n":1}} to the document.
+func (c *Conn) Update(coll string, key, ops interface{}) error { return c.write("update",coll,key,ops) }
+
+func (c *Conn) Delete(coll string, key interface{}) error { return c.write("delete",coll,key,nil) }
+
+/*
+The conditional writes fail with ErrPrecondition, unless the document has the
+given ETag. Use NoETag to write only if the document does not exist.
+*/
+func (c *Conn) PutIf(coll string, key interface{}, etag string, doc interface{}) error { return c.writeIf("put",coll,key,etag,doc) }
+func (c *Conn) MergeIf(coll string, key interface{}, etag string, patch interface{}) error { return c.writeIf("merge",coll,key,etag,patch) }
+func (c *Conn) PatchIf(coll string, key interface{}, etag string, patch interface{}) error { return c.writeIf("patch",coll,key,etag,patch) }
+func (c *Conn) UpdateIf(coll string, key interface{}, etag string, ops interface{}) error { return c.writeIf("update",coll,key,etag,ops) }
+func (c *Conn) DeleteIf(coll string, key interface{}, etag string) error { return c.writeIf("delete",coll,key,etag,nil) }
+
+// Calls fn for every document of the collection in key order.
+func (c *Conn) List(coll string, fn func(key, doc json.RawMessage) error) error {
+	if err := c.cmd("list %s",coll); err!=nil { return err }
+	if _,err := c.reply(202); err!=nil { return err }
+	return c.readList(fn)
+}
+
+/*
+The options of ListRange. Keys are ordered by their JSON encoding, Start is
+included and End is excluded. Prefix applies to string keys.
+*/
+type ListOptions struct{
+	Start interface{} `json:"start,omitempty"`
+	End interface{} `json:"end,omitempty"`
+	Prefix *string `json:"prefix,omitempty"`
+	Limit int `json:"limit,omitempty"`
+	Reverse bool `json:"reverse,omitempty"`
+
+	// The cursor of the previous page.
+	Cursor string `json:"cursor,omitempty"`
+}
+
+/*
+Calls fn for the documents in the key range. If the limit cut the listing
+short, the returned cursor continues it:
+
+	for {
+		cur,err := c.ListRange(coll,opts,fn)
+		if err!=nil || cur=="" { break }
+		opts.Cursor = cur
+	}
+*/
+func (c *Conn) ListRange(coll string, opts ListOptions, fn func(key, doc json.RawMessage) error) (cursor string,err error) {
+	b,err := json.Marshal(opts)
+	if err!=nil { return "",err }
+	if err = c.cmd("list %s %s",coll,b); err!=nil { return "",err }
+	if _,err = c.reply(202); err!=nil { return "",err }
+	return c.readListCursor(fn)
+}
+
+func (c *Conn) readList(fn func(key, doc json.RawMessage) error) error {
+	_,err := c.readListCursor(fn)
+	return err
+}
+
+func (c *Conn) readListCursor(fn func(key, doc json.RawMessage) error) (cursor string,gerr error) {
+	for {
+		line,err := c.c.ReadLine()
+		if err!=nil { return "",c.fail(err) }
+		if line=="!" { return "",gerr }
+		if strings.HasPrefix(line,"! ") { return line[2:],gerr }
+		if line!=">" && !strings.HasPrefix(line,"> ") { return "",c.fail(ErrProtocol) }
+		key,doc,err := c.readItem(strings.TrimPrefix(line,"> "))
+		if err!=nil { return "",err }
+		// Keep reading after an error of fn, to keep the connection in sync.
+		if gerr==nil { gerr = fn(key,doc) }
+	}
+}
+
+// Creates a secondary index on the JSON pointer path.
+func (c *Conn) CreateIndex(coll, path string) error {
+	if err := c.cmd("create_index %s %s",coll,path); err!=nil { return err }
+	_,err := c.reply(201)
+	return err
+}
+
+func (c *Conn) DropIndex(coll, path string) error {
+	if err := c.cmd("drop_index %s %s",coll,path); err!=nil { return err }
+	_,err := c.reply(201)
+	return err
+}
+
+// Calls fn for every document, whose indexed field equals value.
+func (c *Conn) Find(coll, path string, value interface{}, fn func(key, doc json.RawMessage) error) error {
+	v,err := encodeKey(value)
+	if err!=nil { return err }
+	if err = c.cmd("find %s %s %s",coll,path,v); err!=nil { return err }
+	if _,err = c.reply(202); err!=nil { return err }
+	return c.readList(fn)
+}
+
+// Adds the string field at the JSON pointer path to the full-text index.
+func (c *Conn) CreateTextIndex(coll, path string) error {
+	if err := c.cmd("create_text_index %s %s",coll,path); err!=nil { return err }
+	_,err := c.reply(201)
+	return err
+}
+
+func (c *Conn) DropTextIndex(coll, path string) error {
+	if err := c.cmd("drop_text_index %s %s",coll,path); err!=nil { return err }
+	_,err := c.reply(201)
+	return err
+}
+
+// The options of Search. The limit defaults to 20.
+type SearchOptions struct{
+	Limit int `json:"limit,omitempty"`
+
+	// The cursor of the previous page.
+	Cursor string `json:"cursor,omitempty"`
+}
+
+/*
+Calls fn for the documents, that contain any of the words of terms, best
+match first. If there are more matches than the limit, the returned cursor
+continues the listing.
+*/
+func (c *Conn) Search(coll, terms string, opts SearchOptions, fn func(key, doc json.RawMessage) error) (cursor string,err error) {
+	b,err := json.Marshal(opts)
+	if err!=nil { return "",err }
+	terms = strings.Join(strings.Fields(terms)," ")
+	if err = c.cmd("search %s %s %s",coll,b,terms); err!=nil { return "",err }
+	if _,err = c.reply(202); err!=nil { return "",err }
+	return c.readListCursor(fn)
+}
+
+/*
+Calls fn for every document, whose indexed field is in [from,to). A nil bound
+is unbounded, use json.RawMessage("null") to pass null.
+*/
+func (c *Conn) Range(coll, path string, from, to interface{}, fn func(key, doc json.RawMessage) error) error {
+	bounds := [2]string{"*","*"}
+	for i,b := range [2]interface{}{from,to} {
+		if b==nil { continue }
+		v,err := encodeKey(b)
+		if err!=nil { return err }
+		bounds[i] = v
+	}
+	if err := c.cmd("range %s %s %s %s",coll,path,bounds[0],bounds[1]); err!=nil { return err }
+	if _,err := c.reply(202); err!=nil { return err }
+	return c.readList(fn)
+}
+
+/*
+Calls fn for every document, that matches the query. The query is a JSON
+document with the fields filter, fields, sort, skip and limit.
+*/
+func (c *Conn) Query(coll string, query interface{}, fn func(key, doc json.RawMessage) error) error {
+	b,err := encodeDoc(query)
+	if err!=nil { return err }
+	if err = c.cmd("query %s",coll); err!=nil { return err }
+	if err = c.body(b); err!=nil { return err }
+	if _,err = c.reply(202); err!=nil { return err }
+	return c.readList(fn)
+}
+
+// A change of a watched collection. Doc is empty for deletes.
+type Change struct{
+	Seq uint64
+	Op string
+	Key json.RawMessage
+	Doc json.RawMessage
+}
+
+/*
+Streams the changes of the collection, starting at sequence number from, or
+at new changes, if from is 0. The stream ends, when fn returns an error, which
+is returned together with the sequence number to resume at.
+*/
+func (c *Conn) Watch(coll string, from uint64, fn func(ch *Change) error) (next uint64, err error) {
+	if from>0 {
+		err = c.cmd("watch %s %d",coll,from)
+	} else {
+		err = c.cmd("watch %s",coll)
+	}
+	if err!=nil { return 0,err }
+	if _,err = c.reply(203); err!=nil { return 0,err }
+	var ferr error
+	for {
+		line,err := c.c.ReadLine()
+		if err!=nil { return 0,c.fail(err) }
+		if strings.HasPrefix(line,"! ") {
+			next,err = strconv.ParseUint(line[2:],10,64)
+			if err!=nil { return 0,c.fail(ErrProtocol) }
+			return next,ferr
+		}
+		f := strings.SplitN(line," ",4)
+		if len(f)==3 && c.br!=nil { f = append(f,"") }
+		if len(f)!=4 || f[0]!=">" { return 0,c.fail(ErrProtocol) }
+		seq,err := strconv.ParseUint(f[1],10,64)
+		if err!=nil { return 0,c.fail(ErrProtocol) }
+		key,doc,err := c.readItem(f[3])
+		if err!=nil { return 0,err }
+		if ferr!=nil { continue }
+		if ferr = fn(&Change{seq,f[2],key,doc}); ferr!=nil {
+			// Keep reading the events, until the server ends the stream.
+			if err = c.cmd("stop"); err!=nil { return 0,err }
+		}
+	}
+}
+
+/*
+Imports newline-delimited JSON objects, whose keys are at the JSON pointer key.
+The mode is "skip", "overwrite" or "fail" and tells, what to do with existing
+documents.
+*/
+func (c *Conn) Import(coll, key, mode string, ndjson []byte) (imported, skipped int, err error) {
+	if err = c.cmd("import %s %s %s",coll,key,mode); err!=nil { return }
+	if err = c.body(ndjson); err!=nil { return }
+	msg,err := c.reply(201)
+	if err!=nil { return }
+	if _,err = fmt.Sscanf(msg,"imported %d skipped %d",&imported,&skipped); err!=nil { err = ErrProtocol }
+	return
+}
+
+// Sets the JSON Schema of the collection, nil removes it. Requires admin rights.
+func (c *Conn) SetSchema(coll string, schema interface{}) error {
+	var b []byte
+	if schema!=nil {
+		var err error
+		if b,err = encodeDoc(schema); err!=nil { return err }
+	}
+	if err := c.cmd("set_schema %s",coll); err!=nil { return err }
+	if err := c.body(b); err!=nil { return err }
+	_,err := c.reply(201)
+	return err
+}
+
+// Returns the JSON Schema of the collection or nil.
+func (c *Conn) GetSchema(coll string) (json.RawMessage,error) {
+	if err := c.cmd("get_schema %s",coll); err!=nil { return nil,err }
+	if _,err := c.reply(290); err!=nil { return nil,err }
+	b,err := c.readBody()
+	if err!=nil { return nil,err }
+	if len(b)==0 { return nil,nil }
+	return json.RawMessage(b),nil
+}
+
+// Writes the collection as newline-delimited JSON. If key is not empty, the keys are stored into the documents at this JSON pointer.
+func (c *Conn) Export(coll, key string, w io.Writer) error {
+	if err := c.cmd("export %s %s",coll,key); err!=nil { return err }
+	if _,err := c.reply(290); err!=nil { return err }
+	if c.br!=nil {
+		b,err := c.readBody()
+		if err!=nil { return err }
+		_,err = w.Write(b)
+		return err
+	}
+	_,err := io.Copy(w,c.c.DotReader())
+	return c.fail(err)
+}
+
+// An operation of a batch: get, put, merge, patch or delete.
+type BatchOp struct{
+	Op string `json:"op"`
+	Coll string `json:"coll"`
+	Key interface{} `json:"key"`
+	Doc interface{} `json:"doc,omitempty"`
+	IfMatch string `json:"if_match,omitempty"`
+}
+
+// The result of a batch operation. Only gets have a document and an ETag.
+type BatchResult struct{
+	Doc json.RawMessage `json:"doc,omitempty"`
+	ETag string `json:"etag,omitempty"`
+}
+
+/*
+Performs the operations atomically in one round trip. The server retries the
+batch on conflicts. w is WRITE_CHECKED or WRITE_COMMIT.
+*/
+func (c *Conn) Batch(r lstore.ReadIso, w lstore.WriteIso, ops []BatchOp) ([]BatchResult,error) {
+	rn,ok := readNames[r]
+	if !ok { return nil,fmt.Errorf("jsondb: invalid ReadIso %d",r) }
+	var mode string
+	switch w {
+	case lstore.WRITE_CHECKED: mode = "full"
+	case lstore.WRITE_COMMIT: mode = "batch"
+	default: return nil,fmt.Errorf("jsondb: invalid WriteIso %d for batches",w)
+	}
+	var body []byte
+	for _,op := range ops {
+		b,err := json.Marshal(op)
+		if err!=nil { return nil,err }
+		body = append(append(body,b...),'\n')
+	}
+	if err := c.cmd("batch %s %s",rn,mode); err!=nil { return nil,err }
+	if err := c.body(body); err!=nil { return nil,err }
+	if _,err := c.reply(204); err!=nil { return nil,err }
+	lines,err := c.readBodyLines()
+	if err!=nil { return nil,err }
+	res := make([]BatchResult,len(lines))
+	for i,l := range lines {
+		if err = json.Unmarshal([]byte(l),&res[i]); err!=nil { return nil,ErrProtocol }
+	}
+	return res,nil
+}
+
+// Returns the names of the collections, that the user may read.
+func (c *Conn) Collections() ([]string,error) {
+	if err := c.cmd("collections"); err!=nil { return nil,err }
+	var names []string
+	err := c.readJSON(&names)
+	return names,err
+}
+
+// The options of a new collection. TTL is in seconds.
+type CreateOptions struct{
+	Schema interface{} `json:"schema,omitempty"`
+	TTL int64 `json:"ttl,omitempty"`
+	Indexes []string `json:"indexes,omitempty"`
+	Text []string `json:"text,omitempty"`
+	History *HistoryOptions `json:"history,omitempty"`
+}
+
+// Creates the collection. Requires admin rights.
+func (c *Conn) Create(coll string, opts CreateOptions) error {
+	b,err := json.Marshal(opts)
+	if err!=nil { return err }
+	if err = c.cmd("create %s %s",coll,b); err!=nil { return err }
+	_,err = c.reply(201)
+	return err
+}
+
+// Deletes the collection with its documents and metadata. Requires admin rights.
+func (c *Conn) Drop(coll string) error {
+	if err := c.cmd("drop %s",coll); err!=nil { return err }
+	_,err := c.reply(201)
+	return err
+}
+
+// The statistics of a collection.
+type Stats struct{
+	Name string `json:"name"`
+	Documents int `json:"documents"`
+	Bytes int `json:"bytes"`
+	IndexEntries int `json:"index_entries"`
+	Indexes []string `json:"indexes"`
+	Text []string `json:"text"`
+	TTL int64 `json:"ttl"`
+	History *HistoryOptions `json:"history"`
+	Schema bool `json:"schema"`
+	Created bool `json:"created"`
+}
+
+func (c *Conn) Stats(coll string) (*Stats,error) {
+	if err := c.cmd("stats %s",coll); err!=nil { return nil,err }
+	st := new(Stats)
+	if err := c.readJSON(st); err!=nil { return nil,err }
+	return st,nil
+}
+
+// Reads a 290 reply with a JSON body into v.
+func (c *Conn) readJSON(v interface{}) error {
+	if _,err := c.reply(290); err!=nil { return err }
+	b,err := c.readBody()
+	if err!=nil { return err }
+	if err = json.Unmarshal(b,v); err!=nil { return ErrProtocol }
+	return nil
+}
+
+/*
+The revision history of a collection. Revisions is the number of revisions
+kept per document, MaxAge the seconds, a revision is kept. 0 means unlimited.
+*/
+type HistoryOptions struct{
+	Revisions int `json:"revisions,omitempty"`
+	MaxAge int64 `json:"max_age,omitempty"`
+}
+
+// A revision of a document. Time is nil for the revision, that predates the history.
+type Revision struct{
+	Rev uint64 `json:"rev"`
+	Time *time.Time `json:"time"`
+	ETag string `json:"etag"`
+	Deleted bool `json:"deleted"`
+}
+
+// Enables, changes or, with nil, disables the history of the collection. Requires admin rights.
+func (c *Conn) SetHistory(coll string, opts *HistoryOptions) error {
+	b,err := json.Marshal(opts)
+	if err!=nil { return err }
+	if err = c.cmd("set_history %s %s",coll,b); err!=nil { return err }
+	_,err = c.reply(201)
+	return err
+}
+
+// Returns the retained revisions of the document, oldest first.
+func (c *Conn) History(coll string, key interface{}) ([]Revision,error) {
+	k,err := encodeKey(key)
+	if err!=nil { return nil,err }
+	if err = c.keyCmd("history",coll,k,""); err!=nil { return nil,err }
+	var revs []Revision
+	if err = c.readJSON(&revs); err!=nil { return nil,err }
+	return revs,nil
+}
+
+// Returns the document at the revision, or nil, if it was deleted.
+func (c *Conn) GetRev(coll string, key interface{}, rev uint64) (json.RawMessage,string,error) {
+	doc,etag,_,err := c.get(coll,key," at "+strconv.FormatUint(rev,10))
+	return doc,etag,err
+}
+
+/*
+Returns the document, as it was at the time, or nil, if it did not exist, and
+its revision.
+*/
+func (c *Conn) GetAt(coll string, key interface{}, t time.Time) (doc json.RawMessage, rev uint64, err error) {
+	doc,_,rev,err = c.get(coll,key," at "+t.UTC().Format(time.RFC3339Nano))
+	return
+}
+
+// The newest version of the protocol, that the client speaks.
+const ProtocolVersion = 1
+
+// The capabilities of the server. Fields of newer servers are ignored.
+type Capabilities struct{
+	Version int `json:"version"`
+	MinVersion int `json:"min_version"`
+	MaxVersion int `json:"max_version"`
+	Commands []string `json:"commands"`
+	ReadIsolation []string `json:"read_isolation"`
+	Transactions []string `json:"transactions"`
+	Auth []string `json:"auth"`
+	AuthRequired bool `json:"auth_required"`
+	User string `json:"user"`
+	Binary bool `json:"binary"`
+	StartTLS bool `json:"starttls"`
+	TLS bool `json:"tls"`
+	Limits Limits `json:"limits"`
+}
+
+/*
+The resource limits of the server, 0 means unlimited. Exceeding them fails
+with an Error of code 94x.
+*/
+type Limits struct{
+	MaxDocSize int `json:"max_doc_size"`
+	MaxBodySize int `json:"max_body_size"`
+	MaxTxDuration time.Duration `json:"max_tx_duration"`
+	MaxTxWrites int `json:"max_tx_writes"`
+	MaxListKeys int `json:"max_list_keys"`
+	Quota int64 `json:"quota"`
+}
+
+// Reports whether the server knows the command.
+func (c *Capabilities) Supports(cmd string) bool {
+	for _,s := range c.Commands {
+		if s==cmd { return true }
+	}
+	return false
+}
+
+/*
+Negotiates the protocol version and returns the capabilities of the server.
+Servers, that predate the handshake, reply with a 996 Error.
+*/
+func (c *Conn) Hello() (*Capabilities,error) {
+	if err := c.cmd("hello %d",ProtocolVersion); err!=nil { return nil,err }
+	cp := new(Capabilities)
+	if err := c.readJSON(cp); err!=nil { return nil,err }
+	return cp,nil
+}
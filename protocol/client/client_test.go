@@ -0,0 +1,132 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+package client
+
+import (
+	"github.com/mad-day/hobbydb/lstore"
+	"github.com/mad-day/hobbydb/protocol"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// Serves s on a unix socket, with a fresh storage, if s has none, and returns its address.
+func testServer(t *testing.T, s *protocol.Server) string {
+	d,err := ioutil.TempDir("","client")
+	if err!=nil { t.Fatal(err) }
+	if s.DS==nil { s.DS = lstore.Complex(&lstore.Storage{Basepath:d},0) }
+	s.TTLInterval = -1
+	l,err := net.Listen("unix",d+"/sock")
+	if err!=nil { t.Fatal(err) }
+	go s.Serve(l)
+	t.Cleanup(func(){
+		ctx,cf := context.WithTimeout(context.Background(),time.Second)
+		defer cf()
+		s.Shutdown(ctx)
+		os.RemoveAll(d)
+	})
+	return d+"/sock"
+}
+
+func testDial(t *testing.T, addr string) *Conn {
+	c,err := Dial("unix",addr)
+	if err!=nil { t.Fatal(err) }
+	t.Cleanup(func(){ c.Close() })
+	return c
+}
+
+func must(t *testing.T, err error) {
+	t.Helper()
+	if err!=nil { t.Fatal(err) }
+}
+
+func TestConn(t *testing.T) {
+	c := testDial(t,testServer(t,&protocol.Server{}))
+	if _,err := c.Get("docs","a"); err==nil { t.Error("get without transaction succeeded") }
+	must(t,c.Begin(lstore.READ_SNAPSHOT,lstore.WRITE_CHECKED))
+	if !c.InTx() { t.Error("InTx is false after Begin") }
+	must(t,c.Put("docs","a",map[string]int{"x":1}))
+	must(t,c.Merge("docs","a",json.RawMessage(`{"y":2}`)))
+	must(t,c.Patch("docs","a",json.RawMessage(`[{"op":"replace","path":"/x","value":3}]`)))
+	must(t,c.Put("docs","b",json.RawMessage(`true`)))
+	doc,err := c.Get("docs","a")
+	must(t,err)
+	if string(doc)!=`{"x":3,"y":2}` { t.Errorf("got %s",doc) }
+	must(t,c.Delete("docs","b"))
+	if doc,err = c.Get("docs","b"); err!=nil || doc!=nil { t.Errorf("deleted document: got %s, %v",doc,err) }
+	var keys []string
+	must(t,c.List("docs",func(k, v json.RawMessage) error {
+		keys = append(keys,string(k))
+		return nil
+	}))
+	if len(keys)!=1 || keys[0]!=`"a"` { t.Errorf("got keys %v",keys) }
+	must(t,c.Commit())
+	if c.InTx() { t.Error("InTx is true after Commit") }
+
+	err = c.Put("docs","a",1)
+	var e *Error
+	if !errors.As(err,&e) || e.Code!=980 { t.Errorf("put without transaction: got %v, want 980",err) }
+}
+
+func TestConnConflict(t *testing.T) {
+	addr := testServer(t,&protocol.Server{})
+	c1,c2 := testDial(t,addr),testDial(t,addr)
+	must(t,c1.Begin(lstore.READ_SNAPSHOT,lstore.WRITE_CHECKED))
+	c1.Get("docs","a")
+	must(t,c2.Begin(lstore.READ_SNAPSHOT,lstore.WRITE_CHECKED))
+	must(t,c2.Put("docs","a",1))
+	must(t,c2.Commit())
+	must(t,c1.Put("docs","a",2))
+	if err := c1.Commit(); !errors.Is(err,lstore.ErrConcurrentUpdate) { t.Errorf("got %v, want ErrConcurrentUpdate",err) }
+
+	// Only the code tells conflicts apart.
+	if err := error(&Error{Code:904,Msg:"Invalid value: ErrConcurrentUpdate"}); errors.Is(err,lstore.ErrConcurrentUpdate) { t.Errorf("%v unwraps to ErrConcurrentUpdate",err) }
+}
+
+func TestPool(t *testing.T) {
+	p := NewPool("unix",testServer(t,&protocol.Server{}))
+	c1,err := p.Get()
+	must(t,err)
+	must(t,c1.Begin(lstore.READ_SNAPSHOT,lstore.WRITE_CHECKED))
+	must(t,c1.Put("docs","a",1))
+	must(t,c1.Close())
+
+	// The connection is reused, its transaction was rolled back.
+	c2,err := p.Get()
+	must(t,err)
+	if c2!=c1 { t.Error("the idle connection was not reused") }
+	if c2.InTx() { t.Error("the returned connection is still in a transaction") }
+	must(t,c2.Begin(lstore.READ_SNAPSHOT,lstore.WRITE_DISABLED))
+	if doc,_ := c2.Get("docs","a"); doc!=nil { t.Errorf("the write of the returned connection was committed: %s",doc) }
+	must(t,c2.Close())
+
+	must(t,p.Close())
+	if _,err = p.Get(); err!=ErrPoolClosed { t.Errorf("got %v, want ErrPoolClosed",err) }
+}
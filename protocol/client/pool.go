@@ -0,0 +1,99 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package client
+
+import (
+	"net"
+	"sync"
+	"errors"
+)
+
+var ErrPoolClosed = errors.New("jsondb: pool closed")
+
+/*
+A pool of connections. Conn.Close() returns a connection to its pool. Open
+transactions are rolled back, broken connections are dropped.
+*/
+type Pool struct{
+	Dial func() (net.Conn,error)
+
+	// The maximum number of idle connections, 0 means 2.
+	MaxIdle int
+
+	mu sync.Mutex
+	idle []*Conn
+	closed bool
+}
+
+func NewPool(network, addr string) *Pool {
+	return &Pool{Dial:func() (net.Conn,error) { return net.Dial(network,addr) }}
+}
+
+func (p *Pool) Get() (*Conn,error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil,ErrPoolClosed
+	}
+	if n := len(p.idle); n>0 {
+		c := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.mu.Unlock()
+		return c,nil
+	}
+	p.mu.Unlock()
+
+	conn,err := p.Dial()
+	if err!=nil { return nil,err }
+	c := NewConn(conn)
+	c.pool = p
+	return c,nil
+}
+
+func (p *Pool) put(c *Conn) error {
+	if c.inTx && !c.broken { c.Rollback() }
+	if c.broken { return c.close() }
+
+	max := p.MaxIdle
+	if max==0 { max = 2 }
+	p.mu.Lock()
+	if p.closed || len(p.idle)>=max {
+		p.mu.Unlock()
+		return c.close()
+	}
+	p.idle = append(p.idle,c)
+	p.mu.Unlock()
+	return nil
+}
+
+// Closes the idle connections. Connections in use are closed, when they are returned.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.closed = true
+	p.mu.Unlock()
+	for _,c := range idle { c.close() }
+	return nil
+}
@@ -0,0 +1,145 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package client
+
+import (
+	"github.com/mad-day/hobbydb/lstore"
+	"github.com/mad-day/hobbydb/protocol"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// Issues a certificate for the name, signed by the parent, or self-signed, if parent is nil.
+func testCert(t *testing.T, name string, parent *tls.Certificate) tls.Certificate {
+	key,err := ecdsa.GenerateKey(elliptic.P256(),rand.Reader)
+	if err!=nil { t.Fatal(err) }
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject: pkix.Name{CommonName:name},
+		DNSNames: []string{name},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter: time.Now().Add(time.Hour),
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth,x509.ExtKeyUsageClientAuth},
+	}
+	signer,signKey := tmpl,interface{}(key)
+	if parent==nil {
+		tmpl.IsCA,tmpl.BasicConstraintsValid = true,true
+		tmpl.KeyUsage = x509.KeyUsageCertSign|x509.KeyUsageDigitalSignature
+	} else {
+		signer,signKey = parent.Leaf,parent.PrivateKey
+	}
+	der,err := x509.CreateCertificate(rand.Reader,tmpl,signer,&key.PublicKey,signKey)
+	if err!=nil { t.Fatal(err) }
+	leaf,err := x509.ParseCertificate(der)
+	if err!=nil { t.Fatal(err) }
+	return tls.Certificate{Certificate:[][]byte{der},PrivateKey:key,Leaf:leaf}
+}
+
+type testPKI struct{
+	pool *x509.CertPool
+	server,bob tls.Certificate
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	ca := testCert(t,"ca",nil)
+	p := &testPKI{pool:x509.NewCertPool(),server:testCert(t,"jsondb.test",&ca),bob:testCert(t,"bob",&ca)}
+	p.pool.AddCert(ca.Leaf)
+	return p
+}
+
+func (p *testPKI) serverConfig() *tls.Config {
+	return &tls.Config{Certificates:[]tls.Certificate{p.server},ClientCAs:p.pool,ClientAuth:tls.VerifyClientCertIfGiven}
+}
+
+func (p *testPKI) clientConfig(certs ...tls.Certificate) *tls.Config {
+	return &tls.Config{RootCAs:p.pool,ServerName:"jsondb.test",Certificates:certs}
+}
+
+// The client certificate authenticates the connection after STARTTLS.
+func TestStartTLS(t *testing.T) {
+	pki := newTestPKI(t)
+	s := &protocol.Server{TLSConfig:pki.serverConfig(),RequireAuth:true}
+	addr := testServer(t,s)
+	must(t,protocol.SetUser(s.DS,"bob","pw",false,protocol.Grant{Pattern:"*",Write:true}))
+
+	c := testDial(t,addr)
+	must(t,c.StartTLS(pki.clientConfig(pki.bob)))
+	must(t,c.StartTLS(pki.clientConfig(pki.bob)))
+	must(t,c.Begin(lstore.READ_SNAPSHOT,lstore.WRITE_CHECKED))
+	must(t,c.Put("docs","a",1))
+	must(t,c.Commit())
+
+	// Without a certificate, the connection is encrypted, but not authenticated.
+	c = testDial(t,addr)
+	must(t,c.StartTLS(pki.clientConfig()))
+	var e *Error
+	if err := c.Begin(lstore.READ_SNAPSHOT,lstore.WRITE_CHECKED); !errors.As(err,&e) || e.Code!=930 { t.Errorf("got %v, want 930",err) }
+
+	c = testDial(t,addr)
+	must(t,c.Binary())
+	if err := c.StartTLS(pki.clientConfig()); err==nil { t.Error("STARTTLS in binary mode succeeded") }
+}
+
+func TestStartTLSUnavailable(t *testing.T) {
+	c := testDial(t,testServer(t,&protocol.Server{}))
+	var e *Error
+	if err := c.StartTLS(&tls.Config{ServerName:"x"}); !errors.As(err,&e) || e.Code!=932 { t.Errorf("got %v, want 932",err) }
+}
+
+func TestDialTLS(t *testing.T) {
+	pki := newTestPKI(t)
+	d,err := ioutil.TempDir("","client")
+	if err!=nil { t.Fatal(err) }
+	t.Cleanup(func(){ os.RemoveAll(d) })
+	s := &protocol.Server{DS:lstore.Complex(&lstore.Storage{Basepath:d},0),TLSConfig:pki.serverConfig(),TTLInterval:-1}
+	l,err := net.Listen("unix",d+"/sock")
+	if err!=nil { t.Fatal(err) }
+	go s.Serve(tls.NewListener(l,s.TLSConfig))
+	t.Cleanup(func(){
+		ctx,cf := context.WithTimeout(context.Background(),time.Second)
+		defer cf()
+		s.Shutdown(ctx)
+	})
+
+	if _,err = DialTLS("unix",d+"/sock",&tls.Config{RootCAs:x509.NewCertPool(),ServerName:"jsondb.test"}); err==nil { t.Error("an untrusted server was accepted") }
+	c,err := DialTLS("unix",d+"/sock",pki.clientConfig())
+	must(t,err)
+	defer c.Close()
+	must(t,c.StartTLS(pki.clientConfig()))
+	must(t,c.Begin(lstore.READ_SNAPSHOT,lstore.WRITE_CHECKED))
+	must(t,c.Put("docs","a",1))
+	must(t,c.Commit())
+}
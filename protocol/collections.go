@@ -0,0 +1,218 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package protocol
+
+import (
+	"github.com/mad-day/hobbydb/lstore"
+	"encoding/json"
+	"bytes"
+	"sort"
+	"strings"
+)
+
+// Calls fn for every collection in the catalog.
+func scanCatalog(tx lstore.UDB, fn func(coll string, meta *collMeta) error) error {
+	t,err := tx.UTable(catalogTable)
+	if err!=nil { return err }
+	iter := t.Iter()
+	defer iter.Release()
+	for iter.Next() {
+		m := new(collMeta)
+		if json.Unmarshal(iter.Value(),m)!=nil { continue }
+		if err = fn(string(iter.Key()),m); err!=nil { return err }
+	}
+	return nil
+}
+
+// Reports whether the table has no entries.
+func tableEmpty(tx lstore.UDB, name string) (bool,error) {
+	t,err := tx.UTable(name)
+	if err!=nil { return false,err }
+	iter := t.Iter()
+	defer iter.Release()
+	return !iter.Next(),nil
+}
+
+// Reports whether the collection was created or holds documents.
+func collExists(tx lstore.UDB, coll string, meta *collMeta) (bool,error) {
+	if meta.Created { return true,nil }
+	empty,err := tableEmpty(tx,docTable(coll))
+	return !empty,err
+}
+
+/*
+Returns the names of the collections: those in the catalog and, if the UDBM is
+a lstore.TableLister, those, that hold documents.
+*/
+func collections(ds lstore.UDBM, tx lstore.UDB) ([]string,error) {
+	seen := make(map[string]bool)
+	err := scanCatalog(tx,func(coll string, meta *collMeta) error {
+		ok,err := collExists(tx,coll,meta)
+		if ok { seen[coll] = true }
+		return err
+	})
+	if err!=nil { return nil,err }
+	if tl,ok := ds.(lstore.TableLister); ok {
+		names,err := tl.TableNames()
+		if err!=nil { return nil,err }
+		for _,n := range names {
+			if !strings.HasPrefix(n,"json_") || seen[n[5:]] { continue }
+			empty,err := tableEmpty(tx,n)
+			if err!=nil { return nil,err }
+			if !empty { seen[n[5:]] = true }
+		}
+	}
+	colls := make([]string,0,len(seen))
+	for coll := range seen { colls = append(colls,coll) }
+	sort.Strings(colls)
+	return colls,nil
+}
+
+// The options of the create command.
+type createOptions struct{
+	Schema json.RawMessage `json:"schema"`
+	TTL int64 `json:"ttl"`
+	Indexes []string `json:"indexes"`
+	Text []string `json:"text"`
+	History *historyOpts `json:"history"`
+}
+
+// The reply of the stats command.
+type collStats struct{
+	Name string `json:"name"`
+	Documents int `json:"documents"`
+	Bytes int `json:"bytes"`
+	IndexEntries int `json:"index_entries"`
+	Indexes []string `json:"indexes"`
+	Text []string `json:"text,omitempty"`
+	TTL int64 `json:"ttl,omitempty"`
+	History *historyOpts `json:"history,omitempty"`
+	Schema bool `json:"schema"`
+	Created bool `json:"created"`
+}
+
+func (c *cctx) replyJSON(v interface{}) error {
+	b,err := json.Marshal(v)
+	if err!=nil { return c.C.PrintfLine("800 IO Error: %v",err) }
+	if err = c.C.PrintfLine("290 content follows"); err!=nil { return err }
+	return c.writeBody(b)
+}
+
+/*
+Handles the collection commands:
+
+	collections               the names of the readable collections, as JSON array
+	create <coll> [options]   {"schema":{...}, "ttl":<seconds>, "indexes":["/ptr",...], "text":["/ptr",...], "history":{...}}
+	drop <coll>               deletes the documents, indexes, revisions and metadata
+	stats <coll>              the counts and the metadata, as JSON object
+
+Collections still spring into existence by writing to them, create records
+them in the catalog. Documents of collections with a TTL are deleted by the
+sweeper of the Server (or SweepExpired), once they were not written for ttl
+seconds. The history option takes the options of set_history, the text option
+the fields of the full-text index.
+*/
+func (c *cctx) performCollection(cmd, coll string, arg []byte) error {
+	if cmd=="collections" {
+		colls,err := collections(c.DS,c.TX)
+		if err!=nil { return c.C.PrintfLine("800 IO Error: %v",err) }
+		names := []string{}
+		for _,coll := range colls {
+			if c.authorize("list",coll) { names = append(names,coll) }
+		}
+		return c.replyJSON(names)
+	}
+	if coll=="" { return c.C.PrintfLine("999 Invalid command") }
+	meta,err := loadMeta(c.TX,coll)
+	if err!=nil { return c.C.PrintfLine("800 IO Error: %v",err) }
+	exists,err := collExists(c.TX,coll,meta)
+	if err!=nil { return c.C.PrintfLine("800 IO Error: %v",err) }
+	switch cmd {
+	case "create":
+		var o createOptions
+		if len(bytes.TrimSpace(arg))!=0 {
+			if err = json.Unmarshal(arg,&o); err!=nil { return c.C.PrintfLine("904 Invalid value: %v",err) }
+		}
+		if exists { return c.C.PrintfLine("714 Collection exists: %s",coll) }
+		if o.TTL<0 { return c.C.PrintfLine("904 Invalid value: negative ttl") }
+		if h := o.History; h!=nil && (h.Revisions<0 || h.MaxAge<0) { return c.C.PrintfLine("904 Invalid value: negative history limit") }
+		for _,p := range append(o.Indexes,o.Text...) {
+			if !validPointer(p) { return c.C.PrintfLine("902 Invalid JSON pointer: %q",p) }
+		}
+		if len(o.Schema)!=0 && string(o.Schema)!="null" {
+			if meta.Schema,err = normalizeJson(o.Schema); err!=nil { return c.C.PrintfLine("904 Invalid value: %v",err) }
+			if _,err = compileSchema(meta.Schema); err!=nil { return c.C.PrintfLine("904 Invalid value: %v",err) }
+		}
+		for _,p := range o.Indexes {
+			if !meta.hasIndex(p) { meta.Indexes = append(meta.Indexes,p) }
+		}
+		for _,p := range o.Text {
+			if !meta.hasText(p) { meta.Text = append(meta.Text,p) }
+		}
+		meta.TTL,meta.History,meta.Created = o.TTL,o.History,true
+		if err = storeMeta(c.TX,coll,meta); err!=nil { return c.replyWrite(cmd,err) }
+		return c.C.PrintfLine("201 updated")
+	case "drop":
+		if !exists && len(meta.Indexes)==0 && len(meta.Text)==0 && len(meta.Schema)==0 && meta.History==nil { return c.C.PrintfLine("907 No such collection: %s",coll) }
+		if err = c.dropCollection(coll); err!=nil { return c.replyWrite(cmd,err) }
+		return c.C.PrintfLine("201 updated")
+	case "stats":
+		st := collStats{Name:coll,Indexes:meta.Indexes,Text:meta.Text,TTL:meta.TTL,History:meta.History,Schema:len(meta.Schema)!=0,Created:meta.Created}
+		if st.Indexes==nil { st.Indexes = []string{} }
+		u,err := c.TX.UTable(docTable(coll))
+		if err!=nil { return c.C.PrintfLine("800 IO Error: %v",err) }
+		iter := u.Iter()
+		for iter.Next() {
+			st.Documents++
+			st.Bytes += len(iter.Key())+len(iter.Value())
+		}
+		iter.Release()
+		it,err := c.TX.UTable(indexTable(coll))
+		if err!=nil { return c.C.PrintfLine("800 IO Error: %v",err) }
+		iter = it.Iter()
+		for iter.Next() { st.IndexEntries++ }
+		iter.Release()
+		return c.replyJSON(st)
+	}
+	return c.C.PrintfLine("996 unknown command %s",cmd)
+}
+
+// Deletes the documents, then the remaining entries of the other tables and the metadata.
+func (c *cctx) dropCollection(coll string) error {
+	u,err := c.TX.UTable(docTable(coll))
+	if err!=nil { return err }
+	var keys [][]byte
+	iter := u.Iter()
+	for iter.Next() { keys = append(keys,bclone(iter.Key())) }
+	iter.Release()
+	for _,key := range keys {
+		if err = c.writeDoc(coll,u,key,nil); err!=nil { return err }
+	}
+	for _,name := range []string{indexTable(coll),ttlTable(coll),histTable(coll),ftsTable(coll),ownerTable(coll)} {
+		if err = clearTable(c.TX,name); err!=nil { return err }
+	}
+	t,err := c.TX.UTable(catalogTable)
+	if err!=nil { return err }
+	return t.Write([]byte(coll),nil)
+}
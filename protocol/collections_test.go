@@ -0,0 +1,84 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package protocol
+
+import (
+	"github.com/mad-day/hobbydb/lstore"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestCollections(t *testing.T) {
+	s := &Server{}
+	c := testSession(t,s)
+	c.must("200","","tx_full snapshot")
+	c.must("201","",`create a {"ttl":10,"indexes":["/n"],"text":["/t"],"history":{"revisions":2}}`)
+	c.must("714","","create a")
+	c.must("902","",`create b {"indexes":["n"]}`)
+	c.must("904","",`create b {"ttl":-1}`)
+	c.must("201",`{"n":1,"t":"hello"}`,`put a "x"`)
+	c.must("201",`1`,`put b "y"`)
+	c.must("290","","collections")
+	if got := c.body(); got!=`["a","b"]` { t.Errorf("collections: got %s",got) }
+
+	c.must("290","","stats a")
+	var st collStats
+	if err := json.Unmarshal([]byte(c.body()),&st); err!=nil { t.Fatal(err) }
+	if st.Documents!=1 || st.IndexEntries!=1 || st.TTL!=10 || !st.Created || len(st.Text)!=1 || st.History==nil || st.History.Revisions!=2 { t.Errorf("got %+v",st) }
+
+	c.must("201","","drop a")
+	c.must("907","","drop a")
+	c.must("201","","drop b")
+	c.must("290","","collections")
+	if got := c.body(); got!=`[]` { t.Errorf("collections after drop: got %s",got) }
+	c.must("200","","commit")
+
+	// Commands without a collection do not create a table for one.
+	names,err := s.DS.(lstore.TableLister).TableNames()
+	if err!=nil { t.Fatal(err) }
+	for _,n := range names {
+		if n=="json_" { t.Error("collections created the table json_") }
+	}
+}
+
+func TestSweepExpired(t *testing.T) {
+	s := &Server{}
+	c := testSession(t,s)
+	c.must("200","","tx_full snapshot")
+	c.must("201","",`create docs {"ttl":10}`)
+	c.must("201",`1`,`put docs "a"`)
+	c.must("201",`1`,`put docs "b"`)
+	c.must("200","","commit")
+	now := time.Now()
+	if n,err := SweepExpired(s.DS,now); n!=0 || err!=nil { t.Errorf("swept %d, %v before the expiry",n,err) }
+	// Rewriting the document renews its expiry.
+	time.Sleep(20*time.Millisecond)
+	c.must("200","","tx_full snapshot")
+	c.must("201",`2`,`put docs "b"`)
+	c.must("200","","commit")
+	if n,err := SweepExpired(s.DS,now.Add(10*time.Second+10*time.Millisecond)); n!=1 || err!=nil { t.Errorf("swept %d, %v, want 1",n,err) }
+	c.must("200","","tx_read snapshot")
+	if keys := c.list("list docs"); len(keys)!=1 || keys[0]!=`"b"` { t.Errorf("got %v",keys) }
+}
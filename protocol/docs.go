@@ -0,0 +1,116 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package protocol
+
+import (
+	"github.com/mad-day/hobbydb/lstore"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+// The document did not match the if-match condition.
+var errPrecondition = errors.New("precondition failed")
+
+// The ETag of absent documents.
+const noETag = "none"
+
+// Returns the ETag of a stored document.
+func etagOf(doc []byte) string {
+	if len(doc)==0 { return noETag }
+	h := sha256.Sum256(doc)
+	return hex.EncodeToString(h[:8])
+}
+
+/*
+Writes a document, or deletes it, if doc is empty. Every write to a
+collection must go through here, so that the data, that depends on the
+documents, is maintained within the same transaction.
+*/
+func (c *Session) writeDoc(coll string, u lstore.UTable, key, doc []byte) error {
+	return c.writeDocIf(coll,u,key,u.Read(key),doc,false)
+}
+
+/*
+Writes the document, where old is the current one. If cas is set, the write
+fails with errPrecondition, unless the current document still is old. Only
+this check is atomic: a compare-and-swap for instant writes, checked at commit
+by WRITE_CHECKED.
+
+The usage and the owner are charged before the document, the index, text, TTL
+and history entries are written after it, in instant transactions each by a
+write of its own. If one of them fails, the document and the entries are
+restored, as far as the document was not changed since, and the error is
+returned. A crash in between leaves the entries stale, until the document is
+written again.
+*/
+func (c *Session) writeDocIf(coll string, u lstore.UTable, key, old, doc []byte, cas bool) error {
+	meta,err := loadMeta(c.TX,coll)
+	if err!=nil { return err }
+	if len(meta.Schema)!=0 && len(doc)!=0 {
+		if err = validateDoc(meta.Schema,doc); err!=nil { return err }
+	}
+	refund,err := c.checkDoc(coll,key,old,doc)
+	if err!=nil { return err }
+	ct,isCAS := u.(lstore.CASTable)
+	if isCAS && cas {
+		err = ct.WriteIf(key,old,doc)
+		if err==lstore.ErrConcurrentUpdate { err = errPrecondition }
+	} else {
+		err = u.Write(key,doc)
+	}
+	if err!=nil {
+		refund()
+		return err
+	}
+	if err = c.writeEntries(coll,meta,key,old,doc); err!=nil {
+		if isCAS {
+			if ct.WriteIf(key,doc,old)!=nil { return err }
+		} else if u.Write(key,old)!=nil {
+			return err
+		}
+		c.writeEntries(coll,meta,key,doc,old)
+		refund()
+		return err
+	}
+	return nil
+}
+
+// Updates the entries, that depend on the document, from old to doc.
+func (c *Session) writeEntries(coll string, meta *collMeta, key, old, doc []byte) (err error) {
+	if len(meta.Indexes)>0 {
+		if err = updateIndexes(c.TX,coll,meta,key,old,doc); err!=nil { return err }
+	}
+	if len(meta.Text)>0 {
+		if err = updateText(c.TX,coll,meta.Text,meta.Text,key,old,doc); err!=nil { return err }
+	}
+	if meta.TTL>0 {
+		if err = updateTTL(c.TX,coll,key,doc,time.Now().Add(time.Duration(meta.TTL)*time.Second)); err!=nil { return err }
+	}
+	if meta.History!=nil {
+		if err = recordRevision(c.TX,coll,meta.History,key,old,doc,time.Now()); err!=nil { return err }
+	}
+	return c.recordChange(coll,key,doc)
+}
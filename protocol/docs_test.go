@@ -0,0 +1,93 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package protocol
+
+import (
+	"github.com/mad-day/hobbydb/lstore"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+var errInjected = errors.New("injected")
+
+// A Database, whose table fails every write, while failing is set to its name.
+type failTable struct{
+	lstore.Database
+	failing *string
+}
+func (f failTable) Table(name string) (lstore.TableDB,error) {
+	t,err := f.Database.Table(name)
+	if err!=nil { return nil,err }
+	return failWrites{t,f.failing,name},nil
+}
+type failWrites struct{
+	lstore.TableDB
+	failing *string
+	name string
+}
+func (f failWrites) Put(key, value []byte, wo *opt.WriteOptions) error {
+	if *f.failing==f.name { return errInjected }
+	return f.TableDB.Put(key,value,wo)
+}
+func (f failWrites) Delete(key []byte, wo *opt.WriteOptions) error {
+	if *f.failing==f.name { return errInjected }
+	return f.TableDB.Delete(key,wo)
+}
+func (f failWrites) Write(batch *leveldb.Batch, wo *opt.WriteOptions) error {
+	if *f.failing==f.name { return errInjected }
+	return f.TableDB.Write(batch,wo)
+}
+
+// Returns a storage, whose table fails every write, while failing is set to its name.
+func failingDS(t *testing.T, failing *string) lstore.UDBM {
+	d,err := ioutil.TempDir("","protocol")
+	if err!=nil { t.Fatal(err) }
+	t.Cleanup(func(){ os.RemoveAll(d) })
+	return lstore.Complex(failTable{&lstore.Storage{Basepath:d},failing},0)
+}
+
+// An instant write, whose index fails, restores the document.
+func TestWriteDocRestore(t *testing.T) {
+	var failing string
+	c := testSession(t,&Server{DS:failingDS(t,&failing)})
+	c.must("200","","tx_full snapshot")
+	c.must("201","","create_index docs /x")
+	c.must("200","","commit")
+	c.must("200","","tx_auto snapshot")
+	c.must("201",`{"x":1}`,`put docs "a"`)
+
+	failing = indexTable("docs")
+	c.must("700",`{"x":2}`,`put docs "a"`)
+	failing = ""
+	c.must("290","",`get docs "a"`)
+	if doc := c.body(); doc!=`{"x":1}` { t.Errorf("got %s, want the old document",doc) }
+	if keys := c.list(`find docs /x 1`); len(keys)!=1 { t.Errorf("the index lost the document: %v",keys) }
+	c.must("201",`{"x":2}`,`put docs "a"`)
+	if keys := c.list(`find docs /x 2`); len(keys)!=1 { t.Errorf("got %v",keys) }
+	c.must("200","","commit")
+}
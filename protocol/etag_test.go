@@ -0,0 +1,69 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package protocol
+
+import (
+	"strings"
+	"testing"
+)
+
+// Returns the ETag of the document.
+func (c *testConn) etag(coll, key string) string {
+	c.t.Helper()
+	line := c.must("290","",`get %s %s`,coll,key)
+	c.body()
+	i := strings.Index(line,"ETag=")
+	if i<0 { c.t.Fatalf("no ETag in %q",line) }
+	return line[i+5:]
+}
+
+func TestETag(t *testing.T) {
+	if etagOf(nil)!=noETag || etagOf([]byte("1"))==etagOf([]byte("2")) { t.Error("etagOf") }
+	c := testSession(t,&Server{})
+	c.must("200","","tx_full snapshot")
+	if tag := c.etag("docs",`"a"`); tag!=noETag { t.Errorf("absent document: got %s",tag) }
+	c.must("201",`{"v":1}`,`put docs "a" if-match none`)
+	c.must("712",`{"v":1}`,`put docs "a" if-match none`)
+	tag := c.etag("docs",`"a"`)
+	c.must("201",`{"v":2}`,`merge docs "a" if-match %s`,tag)
+	c.must("712",`{"v":3}`,`put docs "a" if-match %s`,tag)
+	c.must("712","",`delete docs "a" if-match %s`,tag)
+	c.must("901",`{"v":3}`,`put docs "a" if-match`)
+	c.must("201","",`delete docs "a" if-match %s`,c.etag("docs",`"a"`))
+	c.must("200","","commit")
+}
+
+// Of two instant writes with the same ETag, only the first one succeeds.
+func TestETagInstant(t *testing.T) {
+	s := &Server{}
+	c1 := testSession(t,s)
+	c2 := &testConn{t,testDial(t,testServe(t,&Server{DS:s.DS,TTLInterval:-1}))}
+	c1.must("200","","tx_auto snapshot")
+	c2.must("200","","tx_auto snapshot")
+	c1.must("201",`1`,`put docs "a"`)
+	tag := c1.etag("docs",`"a"`)
+	if tag2 := c2.etag("docs",`"a"`); tag2!=tag { t.Fatalf("got %s and %s",tag,tag2) }
+	c1.must("201",`2`,`put docs "a" if-match %s`,tag)
+	c2.must("712",`3`,`put docs "a" if-match %s`,tag)
+}
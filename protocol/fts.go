@@ -0,0 +1,351 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package protocol
+
+import (
+	"github.com/mad-day/hobbydb/lstore"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"bytes"
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+/*
+The full-text index of a collection is stored in the table jfts_<coll>:
+
+	'p' <term> 0x00 <document key>  ->  term frequency (big endian uint32)
+	'd' <document key>              ->  number of terms of the document (big endian uint32)
+	'n'                             ->  number of documents with terms (big endian uint64)
+
+The terms are the lower-cased, stemmed words of the indexed string fields.
+Only the postings of the terms, that change, are written, so writes of
+different documents do not conflict, unless they add documents to the index
+or remove them, which changes the count.
+*/
+func postingPrefix(term string) []byte {
+	return append(append([]byte{'p'},term...),0)
+}
+func docLenKey(key []byte) []byte { return append([]byte{'d'},key...) }
+
+var docCountKey = []byte{'n'}
+
+// Words, that are too common to be indexed.
+var stopWords = map[string]bool{
+	"a": true, "an": true, "and": true, "are": true, "as": true, "at": true, "be": true, "by": true,
+	"for": true, "from": true, "in": true, "is": true, "it": true, "of": true, "on": true, "or": true,
+	"that": true, "the": true, "this": true, "to": true, "was": true, "with": true,
+}
+
+// Splits the text into lower-cased words and stems them. Stop words are dropped.
+func tokenize(text string, fn func(term string)) {
+	words := strings.FieldsFunc(text,func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) })
+	for _,w := range words {
+		w = strings.ToLower(w)
+		if stopWords[w] { continue }
+		fn(stem(w))
+	}
+}
+
+func isVowel(b byte) bool { return strings.IndexByte("aeiou",b)>=0 }
+
+/*
+A light stemmer for English: it strips the most common inflections (plurals,
+-ing, -ed, -ly), so that "indexes", "indexing" and "indexed" all become
+"index". Short words are kept as they are.
+*/
+func stem(w string) string {
+	if len(w)<=3 { return w }
+	switch {
+	case strings.HasSuffix(w,"ies") && len(w)>4:
+		return w[:len(w)-3]+"y"
+	case strings.HasSuffix(w,"sses"):
+		return w[:len(w)-2]
+	case strings.HasSuffix(w,"xes") || strings.HasSuffix(w,"ches") || strings.HasSuffix(w,"shes") || strings.HasSuffix(w,"zes"):
+		return w[:len(w)-2]
+	case strings.HasSuffix(w,"ing") && len(w)>5:
+		return undouble(w[:len(w)-3])
+	case strings.HasSuffix(w,"ed") && len(w)>4:
+		return undouble(w[:len(w)-2])
+	case strings.HasSuffix(w,"ly") && len(w)>4:
+		return w[:len(w)-2]
+	case strings.HasSuffix(w,"s") && !strings.HasSuffix(w,"ss") && !strings.HasSuffix(w,"us") && !strings.HasSuffix(w,"is"):
+		return w[:len(w)-1]
+	}
+	return w
+}
+
+// Strips a doubled final consonant, eg. "runn" to "run". Keeps ll, ss and zz.
+func undouble(w string) string {
+	n := len(w)
+	if n>=2 && w[n-1]==w[n-2] && !isVowel(w[n-1]) && strings.IndexByte("lsz",w[n-1])<0 { return w[:n-1] }
+	return w
+}
+
+// Collects the strings of the value, which may be an array of strings.
+func textOf(v interface{}, fn func(s string)) {
+	switch t := v.(type) {
+	case string:
+		fn(t)
+	case []interface{}:
+		for _,e := range t {
+			if s,ok := e.(string); ok { fn(s) }
+		}
+	}
+}
+
+// Returns the terms of the fields of the document and their frequencies.
+func docTerms(paths []string, doc []byte) (terms map[string]int, n int) {
+	terms = make(map[string]int)
+	if len(doc)==0 || len(paths)==0 { return }
+	var v interface{}
+	if json.Unmarshal(doc,&v)!=nil { return }
+	for _,path := range paths {
+		f,ok := resolvePointer(v,path)
+		if !ok { continue }
+		textOf(f,func(s string) {
+			tokenize(s,func(term string) {
+				terms[term]++
+				n++
+			})
+		})
+	}
+	return
+}
+
+func be32(n int) []byte {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:],uint32(n))
+	return b[:]
+}
+
+/*
+Replaces the postings of the old document, indexed by the fields oldPaths, by
+the ones of the new document, indexed by newPaths.
+*/
+func updateText(tx lstore.UDB, coll string, oldPaths, newPaths []string, key, old, doc []byte) error {
+	t,err := tx.UTable(ftsTable(coll))
+	if err!=nil { return err }
+	ot,on := docTerms(oldPaths,old)
+	nt,nn := docTerms(newPaths,doc)
+	for term,tf := range ot {
+		if nt[term]==tf { continue }
+		if nt[term]==0 {
+			err = t.Write(append(postingPrefix(term),key...),nil)
+		} else {
+			err = t.Write(append(postingPrefix(term),key...),be32(nt[term]))
+		}
+		if err!=nil { return err }
+	}
+	for term,tf := range nt {
+		if ot[term]!=0 { continue }
+		if err = t.Write(append(postingPrefix(term),key...),be32(tf)); err!=nil { return err }
+	}
+	if on==nn { return nil }
+	if on==0 || nn==0 {
+		_,err = updateCounter(t,docCountKey,func(n uint64) uint64 {
+			if nn!=0 { return n+1 }
+			if n>0 { n-- }
+			return n
+		})
+		if err!=nil { return err }
+	}
+	if nn==0 { return t.Write(docLenKey(key),nil) }
+	return t.Write(docLenKey(key),be32(nn))
+}
+
+func (m *collMeta) hasText(path string) bool {
+	for _,p := range m.Text {
+		if p==path { return true }
+	}
+	return false
+}
+
+// The options of the search command.
+type searchOptions struct{
+	Limit int `json:"limit"`
+	Cursor string `json:"cursor"`
+}
+
+type searchHit struct{
+	key []byte
+	score float64
+}
+
+// Reports whether the hit ranks before the other one.
+func (h searchHit) before(o searchHit) bool {
+	if h.score!=o.score { return h.score>o.score }
+	return bytes.Compare(h.key,o.key)<0
+}
+
+// The cursor of a search continues after the score and the key of the last hit.
+func searchCursor(h searchHit) string {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:],math.Float64bits(h.score))
+	return base64.RawURLEncoding.EncodeToString(append(b[:],h.key...))
+}
+
+func parseSearchCursor(cursor string) (searchHit,error) {
+	b,err := base64.RawURLEncoding.DecodeString(cursor)
+	if err!=nil || len(b)<=8 { return searchHit{},errBadCursor }
+	return searchHit{key:b[8:],score:math.Float64frombits(binary.BigEndian.Uint64(b))},nil
+}
+
+/*
+Ranks the documents, that contain any of the terms, by TF-IDF:
+
+	score(d) = sum over the terms t of d:  (1 + ln tf(t,d)) * ln(1 + N/df(t)) / sqrt(len(d))
+
+where N is the number of indexed documents, df(t) the number of documents
+with the term and len(d) the number of terms of d. Equal scores are ordered
+by key.
+*/
+func rankText(t lstore.UTable, terms []string) []searchHit {
+	var n float64
+	if v := t.Read(docCountKey); len(v)==8 { n = float64(binary.BigEndian.Uint64(v)) }
+	tfss := make([]map[string]int,len(terms))
+	iter := t.Iter()
+	for i,term := range terms {
+		prefix := postingPrefix(term)
+		tfs := make(map[string]int)
+		for ok := iter.Seek(prefix); ok && bytes.HasPrefix(iter.Key(),prefix); ok = iter.Next() {
+			if v := iter.Value(); len(v)==4 { tfs[string(iter.Key()[len(prefix):])] = int(binary.BigEndian.Uint32(v)) }
+		}
+		tfss[i] = tfs
+	}
+	// The iterator must not outlive other reads.
+	iter.Release()
+	lens := make(map[string]int)
+	scores := make(map[string]float64)
+	for _,tfs := range tfss {
+		if len(tfs)==0 { continue }
+		idf := math.Log(1+n/float64(len(tfs)))
+		for key,tf := range tfs {
+			l,ok := lens[key]
+			if !ok {
+				if v := t.Read(docLenKey([]byte(key))); len(v)==4 { l = int(binary.BigEndian.Uint32(v)) }
+				lens[key] = l
+			}
+			if l<1 { l = 1 }
+			scores[key] += (1+math.Log(float64(tf)))*idf/math.Sqrt(float64(l))
+		}
+	}
+	hits := make([]searchHit,0,len(scores))
+	for key,s := range scores { hits = append(hits,searchHit{[]byte(key),s}) }
+	sort.Slice(hits,func(i, j int) bool { return hits[i].before(hits[j]) })
+	return hits
+}
+
+/*
+Handles the full-text commands:
+
+	create_text_index <coll> <path>
+	drop_text_index <coll> <path>
+	search <coll> [options] <terms>
+
+The text index covers the string fields (and arrays of strings) at the paths.
+Search lists the documents, that contain any of the terms, best first. The
+options are {"limit":<n>, "cursor":"..."}, the limit defaults to 20. If there
+are more documents, the listing ends with "! <cursor>", which continues it
+after the score and the key of the last document. Writes between the pages
+change the scores, so a document may then be listed twice or not at all.
+*/
+func (c *cctx) performText(cmd, coll string, u lstore.UTable, arg []byte) error {
+	meta,err := loadMeta(c.TX,coll)
+	if err!=nil { return c.C.PrintfLine("800 IO Error: %v",err) }
+	t,err := c.TX.UTable(ftsTable(coll))
+	if err!=nil { return c.C.PrintfLine("800 IO Error: %v",err) }
+
+	if cmd!="search" {
+		p,_ := nextArg(arg)
+		path := string(p)
+		if !validPointer(path) { return c.C.PrintfLine("902 Invalid JSON pointer: %q",path) }
+		paths := meta.Text
+		switch cmd {
+		case "create_text_index":
+			if meta.hasText(path) { return c.C.PrintfLine("201 updated") }
+			meta.Text = append(append([]string(nil),paths...),path)
+		case "drop_text_index":
+			if !meta.hasText(path) { return c.C.PrintfLine("903 No such index: %s",path) }
+			meta.Text = nil
+			for _,tp := range paths {
+				if tp!=path { meta.Text = append(meta.Text,tp) }
+			}
+		}
+		// Reindex the existing documents.
+		var keys,docs [][]byte
+		iter := u.Iter()
+		for iter.Next() {
+			keys = append(keys,bclone(iter.Key()))
+			docs = append(docs,bclone(iter.Value()))
+		}
+		iter.Release()
+		for i,key := range keys {
+			if err = updateText(c.TX,coll,paths,meta.Text,key,docs[i],docs[i]); err!=nil { return c.replyWrite(cmd,err) }
+		}
+		if err = storeMeta(c.TX,coll,meta); err!=nil { return c.replyWrite(cmd,err) }
+		return c.C.PrintfLine("201 updated")
+	}
+
+	if len(meta.Text)==0 { return c.C.PrintfLine("903 No such index: no text index on %s",coll) }
+	o := searchOptions{Limit:20}
+	arg = bytes.TrimSpace(arg)
+	if len(arg)!=0 && arg[0]=='{' {
+		var raw []byte
+		if raw,arg,err = nextJSON(arg); err==nil { err = json.Unmarshal(raw,&o) }
+		if err!=nil || o.Limit<0 { return c.C.PrintfLine("906 Invalid list options: %v",err) }
+	}
+	capped := c.capList(&o.Limit)
+	var after searchHit
+	if o.Cursor!="" {
+		if after,err = parseSearchCursor(o.Cursor); err!=nil { return c.C.PrintfLine("906 Invalid list options: %v",err) }
+	}
+	seen := make(map[string]bool)
+	var terms []string
+	tokenize(string(arg),func(term string) {
+		if !seen[term] { terms = append(terms,term) }
+		seen[term] = true
+	})
+	if len(terms)==0 { return c.C.PrintfLine("905 Invalid query: no search terms") }
+
+	hits := rankText(t,terms)
+	if o.Cursor!="" { hits = hits[sort.Search(len(hits),func(i int) bool { return after.before(hits[i]) }):] }
+	cursor := ""
+	if o.Limit>0 && len(hits)>o.Limit {
+		hits = hits[:o.Limit]
+		cursor = searchCursor(hits[len(hits)-1])
+	}
+	if capped && cursor!="" { limitHit("list_keys") }
+	if err = c.listHead("search results"); err!=nil { return err }
+	for _,h := range hits {
+		doc := u.Read(h.key)
+		if len(doc)==0 { continue }
+		if err = c.listItem(h.key,doc); err!=nil { return err }
+	}
+	if cursor!="" { return c.listMore(cursor) }
+	return c.listEnd()
+}
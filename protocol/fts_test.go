@@ -0,0 +1,140 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package protocol
+
+import (
+	"github.com/mad-day/hobbydb/lstore"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+func TestStem(t *testing.T) {
+	for w,want := range map[string]string{
+		"indexes": "index", "indexing": "index", "indexed": "index",
+		"queries": "query", "classes": "class", "matches": "match",
+		"running": "run", "quickly": "quick", "documents": "document",
+		"status": "status", "analysis": "analysis", "falling": "fall",
+		"cat": "cat", "ties": "tie",
+	} {
+		if got := stem(w); got!=want { t.Errorf("stem(%q) = %q, want %q",w,got,want) }
+	}
+}
+
+func TestTokenize(t *testing.T) {
+	var terms []string
+	tokenize("The Indexes, of a DB-file: 42 queries!",func(term string) { terms = append(terms,term) })
+	if want := []string{"index","db","file","42","query"}; !reflect.DeepEqual(terms,want) { t.Errorf("got %q, want %q",terms,want) }
+}
+
+func TestSearch(t *testing.T) {
+	c := testSession(t,&Server{})
+	c.must("200","","tx_full snapshot")
+	c.must("201",`{"title":"indexing documents"}`,`put docs "a"`)
+	c.must("903","",`search docs index`)
+	c.must("201","","create_text_index docs /title")
+	c.must("201","","create_text_index docs /tags")
+	c.must("201",`{"title":"an index","tags":["index","fast"]}`,`put docs "b"`)
+	c.must("201",`{"title":"a long story about nothing in particular","tags":["index"]}`,`put docs "c"`)
+	c.must("201",`{"title":"unrelated"}`,`put docs "d"`)
+
+	// b has the term twice in few words, c once in many.
+	if keys := c.list(`search docs indexed`); !reflect.DeepEqual(keys,[]string{`"b"`,`"a"`,`"c"`}) { t.Errorf("got %v",keys) }
+	if keys := c.list(`search docs fast unrelated`); len(keys)!=2 { t.Errorf("got %v",keys) }
+	if keys := c.list(`search docs missing`); len(keys)!=0 { t.Errorf("got %v",keys) }
+
+	c.must("202","",`search docs {"limit":2} index`)
+	keys,_,cursor := c.items()
+	if !reflect.DeepEqual(keys,[]string{`"b"`,`"a"`}) || cursor=="" { t.Fatalf("got %v and cursor %q",keys,cursor) }
+	// A document of the first page, that is deleted in between, does not shift the cursor.
+	c.must("201","",`delete docs "b"`)
+	if keys = c.list(`search docs {"limit":2,"cursor":"%s"} index`,cursor); !reflect.DeepEqual(keys,[]string{`"c"`}) { t.Errorf("got %v",keys) }
+	c.must("906","",`search docs {"cursor":"x"} index`)
+	c.must("905","",`search docs the of`)
+
+	// Changed and deleted documents leave the index.
+	c.must("201",`{"title":"nothing"}`,`put docs "b"`)
+	c.must("201","",`delete docs "a"`)
+	if keys = c.list(`search docs index`); !reflect.DeepEqual(keys,[]string{`"c"`}) { t.Errorf("got %v",keys) }
+
+	c.must("201","","drop_text_index docs /tags")
+	if keys = c.list(`search docs index`); len(keys)!=0 { t.Errorf("got %v after the drop",keys) }
+	c.must("903","","drop_text_index docs /tags")
+	c.must("902","","create_text_index docs title")
+	c.must("201","","drop_text_index docs /title")
+	c.must("903","",`search docs nothing`)
+	c.must("200","","commit")
+}
+
+// The number of indexed documents follows the documents, that get or lose terms.
+func TestSearchCount(t *testing.T) {
+	s := &Server{Limits:Limits{MaxListKeys:1}}
+	c := testSession(t,s)
+	count := func() uint64 {
+		tx := s.DS.StartTx(lstore.READ_SNAPSHOT,lstore.WRITE_DISABLED)
+		defer tx.Discard()
+		tbl,err := tx.UTable(ftsTable("docs"))
+		if err!=nil { t.Fatal(err) }
+		if v := tbl.Read(docCountKey); len(v)==8 { return binary.BigEndian.Uint64(v) }
+		return 0
+	}
+	c.must("200","","tx_auto snapshot")
+	c.must("201",`{"t":"one"}`,`put docs "a"`)
+	c.must("201","","create_text_index docs /t")
+	c.must("201",`{"t":"two"}`,`put docs "b"`)
+	c.must("201",`{"t":"two words"}`,`put docs "b"`)
+	c.must("201",`{"x":1}`,`put docs "c"`)
+	if n := count(); n!=2 { t.Errorf("got %d documents, want 2",n) }
+	c.must("201",`{"x":1}`,`put docs "b"`)
+	c.must("201","",`delete docs "a"`)
+	if n := count(); n!=0 { t.Errorf("got %d documents, want 0",n) }
+
+	// A limit, that MaxListKeys cuts, counts as hit.
+	c.must("201",`{"t":"one"}`,`put docs "a"`)
+	c.must("201",`{"t":"one"}`,`put docs "b"`)
+	hits := limitStats.Get("list_keys")
+	c.must("202","",`search docs one`)
+	if _,_,cursor := c.items(); cursor=="" { t.Error("the capped search has no cursor") }
+	if after := limitStats.Get("list_keys"); after==nil || (hits!=nil && after.String()==hits.String()) { t.Error("the capped search was not counted") }
+	c.must("200","","commit")
+}
+
+// A write, whose text index fails, restores the document and its other index entries.
+func TestSearchRestore(t *testing.T) {
+	var failing string
+	c := testSession(t,&Server{DS:failingDS(t,&failing)})
+	c.must("200","","tx_full snapshot")
+	c.must("201","","create_index docs /x")
+	c.must("201","","create_text_index docs /t")
+	c.must("200","","commit")
+	c.must("200","","tx_auto snapshot")
+	c.must("201",`{"x":1,"t":"old"}`,`put docs "a"`)
+	failing = ftsTable("docs")
+	c.must("700",`{"x":2,"t":"new"}`,`put docs "a"`)
+	failing = ""
+	if keys := c.list(`find docs /x 2`); len(keys)!=0 { t.Errorf("the index has the failed write: %v",keys) }
+	if keys := c.list(`find docs /x 1`); len(keys)!=1 { t.Errorf("the index lost the document: %v",keys) }
+	if keys := c.list(`search docs old`); len(keys)!=1 { t.Errorf("the text index lost the document: %v",keys) }
+	c.must("200","","commit")
+}
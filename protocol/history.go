@@ -0,0 +1,268 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package protocol
+
+import (
+	"github.com/mad-day/hobbydb/lstore"
+	"encoding/binary"
+	"encoding/json"
+	"bytes"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+/*
+The revision history of a collection. Every write of a document is recorded
+as a new revision, deletes too. The current revision is always kept, the
+prior ones as long as the limits allow.
+*/
+type historyOpts struct{
+	// The revisions kept per document, 0 means unlimited.
+	Revisions int `json:"revisions,omitempty"`
+
+	// The seconds, a revision is kept after it was written, 0 means forever.
+	MaxAge int64 `json:"max_age,omitempty"`
+}
+
+/*
+A revision of a document. Time is nil for the revision, that was written
+before the history was enabled.
+*/
+type Revision struct{
+	Rev uint64 `json:"rev"`
+	Time *time.Time `json:"time,omitempty"`
+	ETag string `json:"etag"`
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+/*
+The history table of a collection holds one entry per revision:
+
+	<len(key) as uvarint> <key> <rev as big endian uint64>  ->  <time as big endian unix nanoseconds> <doc>
+
+The length prefix keeps the revisions of keys apart, that are prefixes of one
+another. The prefix alone holds the last revision number, so that concurrent
+writers allocate distinct revisions, without scanning the history.
+*/
+func histPrefix(key []byte) []byte {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:],uint64(len(key)))
+	return append(b[:n:n],key...)
+}
+func histKey(prefix []byte, rev uint64) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:],rev)
+	return append(append([]byte(nil),prefix...),b[:]...)
+}
+
+type histEntry struct{
+	key []byte
+	rev uint64
+	ts int64
+	doc []byte
+}
+
+// Reads the revisions of the document, oldest first.
+func readHistory(t lstore.UTable, key []byte) (ents []histEntry) {
+	prefix := histPrefix(key)
+	iter := t.Iter()
+	defer iter.Release()
+	for ok := iter.Seek(prefix); ok && bytes.HasPrefix(iter.Key(),prefix); ok = iter.Next() {
+		k,v := iter.Key(),iter.Value()
+		if len(k)!=len(prefix)+8 || len(v)<8 { continue }
+		ents = append(ents,histEntry{
+			key: bclone(k),
+			rev: binary.BigEndian.Uint64(k[len(prefix):]),
+			ts: int64(binary.BigEndian.Uint64(v)),
+			doc: bclone(v[8:]),
+		})
+	}
+	return
+}
+
+/*
+Records doc as the new revision of the document, old is the current one. The
+first write records old as the revision, that predates the history. Then the
+revisions beyond the limits are removed: only those are read, oldest first.
+*/
+func recordRevision(tx lstore.UDB, coll string, h *historyOpts, key, old, doc []byte, now time.Time) error {
+	t,err := tx.UTable(histTable(coll))
+	if err!=nil { return err }
+	prefix := histPrefix(key)
+	put := func(rev uint64, ts int64, doc []byte) error {
+		v := make([]byte,8,8+len(doc))
+		binary.BigEndian.PutUint64(v,uint64(ts))
+		return t.Write(histKey(prefix,rev),append(v,doc...))
+	}
+	// The first revision allocates one more for the document, that predates the history.
+	last,err := updateCounter(t,prefix,func(n uint64) uint64 {
+		if n==0 && len(old)!=0 { return 2 }
+		return n+1
+	})
+	if err!=nil { return err }
+	if last==0 && len(old)!=0 {
+		if err = put(1,0,old); err!=nil { return err }
+		last = 1
+	}
+	rev := last+1
+	if err = put(rev,now.UnixNano(),doc); err!=nil { return err }
+
+	// The revisions up to keep are beyond the count, the older ones may be beyond the age.
+	var keep uint64
+	if h.Revisions>0 && rev>uint64(h.Revisions) { keep = rev-uint64(h.Revisions) }
+	var cut int64
+	if h.MaxAge>0 { cut = now.Add(-time.Duration(h.MaxAge)*time.Second).UnixNano() }
+	if keep==0 && cut==0 { return nil }
+	var drop [][]byte
+	iter := t.Iter()
+	for ok := iter.Seek(histKey(prefix,0)); ok && bytes.HasPrefix(iter.Key(),prefix); ok = iter.Next() {
+		k,v := iter.Key(),iter.Value()
+		if len(k)!=len(prefix)+8 || len(v)<8 { continue }
+		r := binary.BigEndian.Uint64(k[len(prefix):])
+		if r>=rev || (r>keep && int64(binary.BigEndian.Uint64(v))>=cut) { break }
+		drop = append(drop,bclone(k))
+	}
+	iter.Release()
+	for _,k := range drop {
+		if err = t.Write(k,nil); err!=nil { return err }
+	}
+	return nil
+}
+
+// Opens the history table of the collection, checking the grants and whether the history is enabled.
+func (s *Session) histTable(cmd, coll string) (lstore.UTable,error) {
+	if _,err := s.docTable(cmd,coll); err!=nil { return nil,err }
+	meta,err := loadMeta(s.TX,coll)
+	if err!=nil { return nil,opError(800,"IO Error",err) }
+	if meta.History==nil { return nil,opError(909,"No history",fmt.Errorf("collection %s",coll)) }
+	t,err := s.TX.UTable(histTable(coll))
+	if err!=nil { return nil,opError(800,"IO Error",err) }
+	return t,nil
+}
+
+// Returns the retained revisions of the document, oldest first.
+func (s *Session) History(coll string, key []byte) ([]Revision,error) {
+	t,err := s.histTable("history",coll)
+	if err!=nil { return nil,err }
+	if key,err = normalizeJson(key); err!=nil { return nil,opError(901,"Invalid Key",err) }
+	revs := []Revision{}
+	for _,e := range readHistory(t,key) {
+		r := Revision{Rev:e.rev,ETag:etagOf(e.doc),Deleted:len(e.doc)==0}
+		if e.ts!=0 {
+			ts := time.Unix(0,e.ts).UTC()
+			r.Time = &ts
+		}
+		revs = append(revs,r)
+	}
+	return revs,nil
+}
+
+/*
+Returns the document, as it was at the revision or the time (RFC 3339), and
+the number of that revision. Documents, that were not written since the
+history was enabled, are returned as they are, with revision 0.
+*/
+func (s *Session) GetAt(coll string, key []byte, at string) (doc []byte, etag string, rev uint64, err error) {
+	t,err := s.histTable("get",coll)
+	if err!=nil { return }
+	if key,err = normalizeJson(key); err!=nil { return nil,"",0,opError(901,"Invalid Key",err) }
+	var ts int64
+	byRev := true
+	if rev,err = strconv.ParseUint(at,10,64); err!=nil {
+		tm,terr := time.Parse(time.RFC3339Nano,at)
+		if terr!=nil { return nil,"",0,opError(904,"Invalid value",fmt.Errorf("invalid revision or time %q",at)) }
+		ts,byRev,err = tm.UnixNano(),false,nil
+	}
+	ents := readHistory(t,key)
+	if len(ents)==0 && !byRev {
+		u,err := s.TX.UTable(docTable(coll))
+		if err!=nil { return nil,"",0,opError(800,"IO Error",err) }
+		doc = u.Read(key)
+		return doc,etagOf(doc),0,nil
+	}
+	found := -1
+	for i,e := range ents {
+		if (byRev && e.rev==rev) || (!byRev && e.ts<=ts) { found = i }
+	}
+	if found<0 {
+		// Before the first revision, the document did not exist.
+		if !byRev && ents[0].rev==1 { return nil,noETag,0,nil }
+		return nil,"",0,opError(909,"No such revision",fmt.Errorf("%s",at))
+	}
+	e := ents[found]
+	return e.doc,etagOf(e.doc),e.rev,nil
+}
+
+/*
+Enables, changes or, with null, disables the history of the collection.
+Disabling it removes the revisions.
+*/
+func (s *Session) SetHistory(coll string, opts json.RawMessage) error {
+	if _,err := s.docTable("set_history",coll); err!=nil { return err }
+	var h *historyOpts
+	if err := json.Unmarshal(opts,&h); err!=nil { return opError(904,"Invalid value",err) }
+	if h!=nil && (h.Revisions<0 || h.MaxAge<0) { return opError(904,"Invalid value",fmt.Errorf("negative limit")) }
+	meta,err := loadMeta(s.TX,coll)
+	if err!=nil { return opError(800,"IO Error",err) }
+	if h==nil && meta.History!=nil {
+		if err = clearTable(s.TX,histTable(coll)); err!=nil { return writeError(700,"write op set_history",err) }
+	}
+	meta.History = h
+	if err = storeMeta(s.TX,coll,meta); err!=nil { return writeError(700,"write op set_history",err) }
+	return nil
+}
+
+// Deletes all entries of the table.
+func clearTable(tx lstore.UDB, name string) error {
+	t,err := tx.UTable(name)
+	if err!=nil { return err }
+	var keys [][]byte
+	iter := t.Iter()
+	for iter.Next() { keys = append(keys,bclone(iter.Key())) }
+	iter.Release()
+	for _,k := range keys {
+		if err = t.Write(k,nil); err!=nil { return err }
+	}
+	return nil
+}
+
+/*
+Handles the history commands:
+
+	history <coll> <key>                   the retained revisions, as JSON array of Revision
+	set_history <coll> <options|null>      {"revisions":<count>, "max_age":<seconds>}
+	get <coll> <key> at <rev|time>         the document at the revision or RFC 3339 time
+
+The reply of get at names the revision: "290 content follows Rev=<n> ETag=<etag>".
+*/
+func (c *cctx) performHistory(cmd, coll string, arg []byte) error {
+	if cmd=="set_history" { return c.reply(c.SetHistory(coll,arg),"201 updated") }
+	key,rest,err := c.readKeyArgs(arg)
+	if err==nil && len(rest)!=0 { err = fmt.Errorf("unexpected %q",rest) }
+	if err!=nil { return c.C.PrintfLine("901 Invalid Key: %v",err) }
+	revs,err := c.History(coll,key)
+	if err!=nil { return c.reply(err,"") }
+	return c.replyJSON(revs)
+}
@@ -0,0 +1,126 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package protocol
+
+import (
+	"github.com/mad-day/hobbydb/lstore"
+	"testing"
+	"time"
+)
+
+func testTx(t *testing.T, ds lstore.UDBM) *Session {
+	s := NewSession(ds,false)
+	if err := s.Begin(lstore.READ_SNAPSHOT,lstore.WRITE_CHECKED); err!=nil { t.Fatal(err) }
+	return s
+}
+
+func (s *Session) mustWrite(t *testing.T, op, key, doc string) {
+	t.Helper()
+	if err := s.Write(op,"docs",[]byte(key),"",[]byte(doc)); err!=nil { t.Fatal(err) }
+}
+
+func TestHistory(t *testing.T) {
+	s := testTx(t,testDS(t))
+	defer s.Rollback()
+	if _,err := s.History("docs",[]byte(`"a"`)); err==nil || err.(*Error).Code!=909 { t.Errorf("got %v, want 909",err) }
+	s.mustWrite(t,"put",`"a"`,`1`)
+	s.mustWrite(t,"put",`"b"`,`1`)
+	if err := s.SetHistory("docs",[]byte(`{"revisions":3}`)); err!=nil { t.Fatal(err) }
+	if err := s.SetHistory("docs",[]byte(`{"revisions":-1}`)); err==nil { t.Error("a negative limit was accepted") }
+
+	// Unchanged documents are current at any time.
+	if doc,_,rev,err := s.GetAt("docs",[]byte(`"b"`),time.Now().Format(time.RFC3339Nano)); string(doc)!="1" || rev!=0 || err!=nil { t.Errorf("got %s %d %v",doc,rev,err) }
+
+	s.mustWrite(t,"put",`"a"`,`2`)
+	between := time.Now()
+	time.Sleep(time.Millisecond)
+	s.mustWrite(t,"put",`"a"`,`3`)
+	revs,err := s.History("docs",[]byte(`"a"`))
+	if err!=nil { t.Fatal(err) }
+	if len(revs)!=3 || revs[0].Rev!=1 || revs[0].Time!=nil || revs[2].Rev!=3 || revs[2].Time==nil { t.Fatalf("got %+v",revs) }
+	if doc,_,_,_ := s.GetAt("docs",[]byte(`"a"`),"1"); string(doc)!="1" { t.Errorf("revision 1: got %s",doc) }
+	if doc,_,rev,_ := s.GetAt("docs",[]byte(`"a"`),between.Format(time.RFC3339Nano)); string(doc)!="2" || rev!=2 { t.Errorf("at time: got %s %d",doc,rev) }
+
+	s.mustWrite(t,"delete",`"a"`,``)
+	s.mustWrite(t,"put",`"a"`,`5`)
+	revs,_ = s.History("docs",[]byte(`"a"`))
+	if len(revs)!=3 || revs[0].Rev!=3 || !revs[1].Deleted { t.Errorf("got %+v",revs) }
+	if _,_,_,err = s.GetAt("docs",[]byte(`"a"`),"1"); err==nil || err.(*Error).Code!=909 { t.Errorf("dropped revision: got %v, want 909",err) }
+	if doc,etag,_,err := s.GetAt("docs",[]byte(`"a"`),"4"); len(doc)!=0 || etag!=noETag || err!=nil { t.Errorf("deleted revision: got %s %s %v",doc,etag,err) }
+	if _,_,_,err = s.GetAt("docs",[]byte(`"a"`),"yesterday"); err==nil || err.(*Error).Code!=904 { t.Errorf("got %v, want 904",err) }
+
+	// A new document did not exist before its first revision.
+	s.mustWrite(t,"put",`"c"`,`1`)
+	if doc,_,_,err := s.GetAt("docs",[]byte(`"c"`),between.Format(time.RFC3339Nano)); doc!=nil || err!=nil { t.Errorf("got %s %v",doc,err) }
+
+	if err = s.SetHistory("docs",[]byte(`null`)); err!=nil { t.Fatal(err) }
+	if err = s.SetHistory("docs",[]byte(`{}`)); err!=nil { t.Fatal(err) }
+	if revs,_ = s.History("docs",[]byte(`"a"`)); len(revs)!=0 { t.Errorf("disabling kept %+v",revs) }
+}
+
+func TestHistoryMaxAge(t *testing.T) {
+	s := testTx(t,testDS(t))
+	defer s.Rollback()
+	h := &historyOpts{MaxAge:60}
+	now := time.Now()
+	for i,doc := range []string{"1","2","3"} {
+		if err := recordRevision(s.TX,"docs",h,[]byte("k"),nil,[]byte(doc),now.Add(time.Duration(i)*time.Minute)); err!=nil { t.Fatal(err) }
+	}
+	tbl,_ := s.TX.UTable(histTable("docs"))
+	ents := readHistory(tbl,[]byte("k"))
+	if len(ents)!=2 || ents[0].rev!=2 { t.Errorf("got %d revisions, the first is %d",len(ents),ents[0].rev) }
+
+	// The current revision is kept, however old.
+	if err := recordRevision(s.TX,"docs",h,[]byte("k"),nil,[]byte("4"),now.Add(time.Hour)); err!=nil { t.Fatal(err) }
+	if ents = readHistory(tbl,[]byte("k")); len(ents)!=1 || ents[0].rev!=4 { t.Errorf("got %+v",ents) }
+
+	// Keys, that are prefixes of one another, keep apart.
+	recordRevision(s.TX,"docs",h,[]byte("kk"),nil,[]byte("1"),now)
+	if ents = readHistory(tbl,[]byte("k")); len(ents)!=1 { t.Errorf("got %d revisions",len(ents)) }
+}
+
+// Concurrent writers of a document never record the same revision.
+func TestHistoryConcurrent(t *testing.T) {
+	ds := testDS(t)
+	s := testTx(t,ds)
+	if err := s.SetHistory("docs",[]byte(`{}`)); err!=nil { t.Fatal(err) }
+	s.mustWrite(t,"put",`"a"`,`1`)
+	if err := s.Commit(); err!=nil { t.Fatal(err) }
+
+	// Transactions, that do not check their reads, conflict on the revision.
+	s1,s2 := NewSession(ds,false),NewSession(ds,false)
+	for _,s := range []*Session{s1,s2} {
+		if err := s.Begin(lstore.READ_SNAPSHOT,lstore.WRITE_COMMIT); err!=nil { t.Fatal(err) }
+	}
+	s1.mustWrite(t,"put",`"a"`,`2`)
+	s2.mustWrite(t,"put",`"a"`,`3`)
+	if err := s1.Commit(); err!=nil { t.Fatal(err) }
+	if err := s2.Commit(); err==nil || err.(*Error).Code!=711 { t.Errorf("got %v, want 711",err) }
+
+	s = testTx(t,ds)
+	defer s.Rollback()
+	revs,err := s.History("docs",[]byte(`"a"`))
+	if err!=nil { t.Fatal(err) }
+	if len(revs)!=2 || revs[1].Rev!=2 || revs[1].ETag!=etagOf([]byte("2")) { t.Errorf("got %+v",revs) }
+}
@@ -0,0 +1,465 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+/*
+An HTTP/JSON gateway to the jsondb collections of a lstore.UDBM. The requests
+are performed by a protocol.Session, so they share the semantics of the jsondb
+text protocol:
+
+	GET    /collections/{name}/{key}          the document, with its ETag
+	GET    /collections/{name}/{key}?at=      the document at a revision or RFC 3339 time, see history
+	PUT    /collections/{name}/{key}          honours If-Match and If-None-Match: *
+	PATCH  /collections/{name}/{key}          application/merge-patch+json or application/json-patch+json
+	DELETE /collections/{name}/{key}
+	GET    /collections/{name}?start=&end=&prefix=&limit=&reverse=&cursor=
+
+	POST   /tx?read=snapshot&write=checked    starts a transaction, replies {"tx":"<id>"}
+	POST   /tx/{id}/commit
+	DELETE /tx/{id}                           rolls the transaction back
+
+A key is a JSON value. Path segments, that are not valid JSON, are taken as
+strings, so /collections/users/alice equals /collections/users/%22alice%22.
+
+The document requests use the transaction of the "tx" query parameter or the
+X-Jsondb-Tx header. Without one, every request runs in its own transaction.
+
+Errors are replied as {"code":<jsondb reply code>,"error":"...","details":[...]}.
+*/
+package httpgw
+
+import (
+	"github.com/mad-day/hobbydb/lstore"
+	"github.com/mad-day/hobbydb/protocol"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The maximum size of a request body.
+const maxBody = 16<<20
+
+var (
+	errNoTx = &protocol.Error{Code:980,Msg:"No such transaction"}
+	errTxBusy = &protocol.Error{Code:981,Msg:"Transaction in use"}
+	errAuth = &protocol.Error{Code:931,Msg:"Authentication failed"}
+	// Not a jsondb reply code, get replies empty documents.
+	errNotFound = &protocol.Error{Code:404,Msg:"Not found"}
+)
+
+// An open transaction, a resource of the gateway.
+type gwTx struct{
+	s *protocol.Session
+	busy bool
+	used time.Time
+}
+
+/*
+The HTTP handler of the gateway.
+*/
+type Handler struct{
+	DS lstore.UDBM
+
+	// Require HTTP basic authentication of the jsondb users, or a verified TLS
+	// client certificate of one.
+	RequireAuth bool
+
+	// The limits of the sessions. MaxBodySize defaults to 16 MiB.
+	Limits protocol.Limits
+
+	// Maps verified client certificates to users, nil means their common name.
+	CertUser func(cert *x509.Certificate) string
+
+	// Open transactions, that were not used for this long, are rolled back.
+	// 0 means one minute.
+	TxTimeout time.Duration
+
+	mu sync.Mutex
+	txs map[string]*gwTx
+}
+
+func (h *Handler) timeout() time.Duration {
+	if h.TxTimeout<=0 { return time.Minute }
+	return h.TxTimeout
+}
+
+// Rolls back the expired transactions. Must hold mu.
+func (h *Handler) expire(now time.Time) {
+	for id,t := range h.txs {
+		if t.busy || now.Sub(t.used)<h.timeout() { continue }
+		t.s.Rollback()
+		delete(h.txs,id)
+	}
+}
+
+// Acquires the transaction for the user. Must be released by release.
+func (h *Handler) acquire(id, user string) (*gwTx,error) {
+	h.mu.Lock(); defer h.mu.Unlock()
+	h.expire(time.Now())
+	t := h.txs[id]
+	if t==nil || t.s.User()!=user { return nil,errNoTx }
+	if t.busy { return nil,errTxBusy }
+	t.busy = true
+	return t,nil
+}
+func (h *Handler) release(t *gwTx) {
+	h.mu.Lock(); defer h.mu.Unlock()
+	t.busy = false
+	t.used = time.Now()
+}
+func (h *Handler) remove(id string) {
+	h.mu.Lock(); defer h.mu.Unlock()
+	delete(h.txs,id)
+}
+
+/*
+Creates a session for the request, authenticated by HTTP basic authentication
+or, without, by the TLS client certificate.
+*/
+func (h *Handler) session(r *http.Request) (*protocol.Session,error) {
+	s := protocol.NewSession(h.DS,h.RequireAuth)
+	s.Limits = &h.Limits
+	name,pw,ok := r.BasicAuth()
+	if !ok {
+		if name = protocol.CertPrincipal(r.TLS,h.CertUser); name!="" { s.Login(name) }
+		return s,nil
+	}
+	if err := s.Auth(name,pw); err!=nil { return nil,err }
+	return s,nil
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s,err := h.session(r)
+	if err==nil && h.RequireAuth && s.User()=="" { err = errAuth }
+	if err!=nil {
+		w.Header().Set("WWW-Authenticate",`Basic realm="jsondb"`)
+		replyError(w,errAuth)
+		return
+	}
+	path := strings.Trim(r.URL.EscapedPath(),"/")
+	seg := strings.Split(path,"/")
+	for i := range seg {
+		if seg[i],err = url.PathUnescape(seg[i]); err!=nil {
+			http.Error(w,"invalid path",http.StatusBadRequest)
+			return
+		}
+	}
+	switch {
+	case len(seg)>=2 && seg[0]=="collections" && !protocol.ValidCollection(seg[1]):
+		http.Error(w,"invalid collection name",http.StatusBadRequest)
+	case len(seg)==1 && seg[0]=="tx" && r.Method=="POST":
+		h.begin(w,r,s)
+	case len(seg)==3 && seg[0]=="tx" && seg[2]=="commit" && r.Method=="POST":
+		h.end(w,s,seg[1],true)
+	case len(seg)==2 && seg[0]=="tx" && r.Method=="DELETE":
+		h.end(w,s,seg[1],false)
+	case len(seg)==2 && seg[0]=="collections" && r.Method=="GET":
+		h.doc(w,r,s,seg[1],nil,false)
+	case len(seg)==3 && seg[0]=="collections":
+		switch r.Method {
+		case "GET","HEAD","PUT","PATCH","DELETE":
+			h.doc(w,r,s,seg[1],parseKey(seg[2]),true)
+		default:
+			w.Header().Set("Allow","GET, HEAD, PUT, PATCH, DELETE")
+			http.Error(w,"method not allowed",http.StatusMethodNotAllowed)
+		}
+	default:
+		http.NotFound(w,r)
+	}
+}
+
+// Handles POST /tx.
+func (h *Handler) begin(w http.ResponseWriter, r *http.Request, s *protocol.Session) {
+	q := r.URL.Query()
+	ri,ok1 := readIso[q.Get("read")]
+	wi,ok2 := writeIso[q.Get("write")]
+	if !ok1 || !ok2 {
+		replyError(w,&protocol.Error{Code:990,Msg:"unknown isolation level"})
+		return
+	}
+	if err := s.Begin(ri,wi); err!=nil {
+		replyError(w,err)
+		return
+	}
+	var b [16]byte
+	if _,err := rand.Read(b[:]); err!=nil {
+		s.Rollback()
+		replyError(w,err)
+		return
+	}
+	id := hex.EncodeToString(b[:])
+	h.mu.Lock()
+	if h.txs==nil { h.txs = make(map[string]*gwTx) }
+	h.expire(time.Now())
+	h.txs[id] = &gwTx{s:s,used:time.Now()}
+	h.mu.Unlock()
+	w.Header().Set("Location","/tx/"+id)
+	replyJSON(w,http.StatusCreated,map[string]string{"tx":id})
+}
+
+// Handles POST /tx/{id}/commit and DELETE /tx/{id}.
+func (h *Handler) end(w http.ResponseWriter, s *protocol.Session, id string, commit bool) {
+	t,err := h.acquire(id,s.User())
+	if err!=nil {
+		replyError(w,err)
+		return
+	}
+	h.remove(id)
+	if commit {
+		err = t.s.Commit()
+	} else {
+		err = t.s.Rollback()
+	}
+	if err!=nil {
+		replyError(w,err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Handles the document requests, and the listing, if !hasKey.
+func (h *Handler) doc(w http.ResponseWriter, r *http.Request, s *protocol.Session, coll string, key []byte, hasKey bool) {
+	id := r.URL.Query().Get("tx")
+	if id=="" { id = r.Header.Get("X-Jsondb-Tx") }
+	if id!="" {
+		t,err := h.acquire(id,s.User())
+		if err!=nil {
+			replyError(w,err)
+			return
+		}
+		defer h.release(t)
+		s = t.s
+	} else {
+		wi := lstore.WRITE_DISABLED
+		switch r.Method {
+		case "PUT","PATCH","DELETE": wi = lstore.WRITE_CHECKED
+		}
+		if err := s.Begin(lstore.READ_SNAPSHOT,wi); err!=nil {
+			replyError(w,err)
+			return
+		}
+		defer s.Rollback()
+	}
+	// Commits the own transaction, before the reply is written.
+	done := func() bool {
+		if id!="" { return true }
+		if err := s.Commit(); err!=nil {
+			replyError(w,err)
+			return false
+		}
+		return true
+	}
+
+	if !hasKey {
+		list(w,r,s,coll,done)
+		return
+	}
+
+	switch r.Method {
+	case "GET","HEAD":
+		var doc []byte
+		var etag string
+		var err error
+		if at := r.URL.Query().Get("at"); at!="" {
+			var rev uint64
+			doc,etag,rev,err = s.GetAt(coll,key,at)
+			w.Header().Set("X-Jsondb-Revision",strconv.FormatUint(rev,10))
+		} else {
+			doc,etag,err = s.Get(coll,key)
+		}
+		if err==nil && len(doc)==0 { err = errNotFound }
+		if err!=nil {
+			replyError(w,err)
+			return
+		}
+		if !done() { return }
+		w.Header().Set("Content-Type","application/json")
+		w.Header().Set("ETag",strconv.Quote(etag))
+		w.Header().Set("Content-Length",strconv.Itoa(len(doc)))
+		w.WriteHeader(http.StatusOK)
+		if r.Method=="GET" { w.Write(doc) }
+		return
+	}
+
+	op := "put"
+	var body []byte
+	var err error
+	switch r.Method {
+	case "DELETE":
+		op = "delete"
+	case "PATCH":
+		ct,_,_ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		switch ct {
+		case "application/merge-patch+json": op = "merge"
+		case "application/json-patch+json": op = "patch"
+		default:
+			http.Error(w,"unsupported patch type",http.StatusUnsupportedMediaType)
+			return
+		}
+	}
+	if op!="delete" {
+		max := int64(maxBody)
+		if h.Limits.MaxBodySize>0 { max = int64(h.Limits.MaxBodySize) }
+		if body,err = ioutil.ReadAll(http.MaxBytesReader(w,r.Body,max)); err!=nil {
+			replyError(w,&protocol.Error{Code:945,Msg:"Body too large"})
+			return
+		}
+		if op=="put" && !json.Valid(body) {
+			replyError(w,&protocol.Error{Code:904,Msg:"Invalid value"})
+			return
+		}
+	}
+	ifMatch := ""
+	if im := r.Header.Get("If-Match"); im!="" && im!="*" {
+		ifMatch = strings.Trim(strings.TrimPrefix(im,"W/"),`"`)
+	} else if im=="*" {
+		// Any existing document matches.
+		doc,_,err := s.Get(coll,key)
+		if err==nil && len(doc)==0 { err = &protocol.Error{Code:712,Msg:"Precondition failed"} }
+		if err!=nil {
+			replyError(w,err)
+			return
+		}
+	}
+	if r.Header.Get("If-None-Match")=="*" { ifMatch = "none" }
+	if err = s.Write(op,coll,key,ifMatch,body); err!=nil {
+		replyError(w,err)
+		return
+	}
+	if !done() { return }
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type listItem struct{
+	Key json.RawMessage `json:"key"`
+	Doc json.RawMessage `json:"doc"`
+}
+type listReply struct{
+	Items []listItem `json:"items"`
+	Cursor string `json:"cursor,omitempty"`
+}
+
+// Handles GET /collections/{name}.
+func list(w http.ResponseWriter, r *http.Request, s *protocol.Session, coll string, done func() bool) {
+	q := r.URL.Query()
+	var o protocol.ListOptions
+	var err error
+	if v := q.Get("start"); v!="" { o.Start = parseKey(v) }
+	if v := q.Get("end"); v!="" { o.End = parseKey(v) }
+	if v,ok := q["prefix"]; ok { o.Prefix = &v[0] }
+	if v := q.Get("limit"); v!="" {
+		if o.Limit,err = strconv.Atoi(v); err!=nil {
+			replyError(w,&protocol.Error{Code:906,Msg:"Invalid list options",Err:err})
+			return
+		}
+	}
+	if v := q.Get("reverse"); v!="" {
+		if o.Reverse,err = strconv.ParseBool(v); err!=nil {
+			replyError(w,&protocol.Error{Code:906,Msg:"Invalid list options",Err:err})
+			return
+		}
+	}
+	o.Cursor = q.Get("cursor")
+	rep := listReply{Items:[]listItem{}}
+	rep.Cursor,err = s.List(coll,&o,func(key, doc []byte) error {
+		rep.Items = append(rep.Items,listItem{bclone(key),bclone(doc)})
+		return nil
+	})
+	if err!=nil {
+		replyError(w,err)
+		return
+	}
+	if !done() { return }
+	replyJSON(w,http.StatusOK,rep)
+}
+
+var readIso = map[string]lstore.ReadIso{
+	"": lstore.READ_SNAPSHOT,
+	"snapshot": lstore.READ_SNAPSHOT,
+	"repeatable": lstore.READ_REPEATABLE,
+	"any": lstore.READ_ANY,
+}
+var writeIso = map[string]lstore.WriteIso{
+	"": lstore.WRITE_CHECKED,
+	"checked": lstore.WRITE_CHECKED,
+	"commit": lstore.WRITE_COMMIT,
+	"instant_atomic": lstore.WRITE_INSTANT_ATOMIC,
+	"instant": lstore.WRITE_INSTANT,
+	"disabled": lstore.WRITE_DISABLED,
+}
+
+// Takes a path segment as JSON value, or as string, if it is not valid JSON.
+func parseKey(seg string) []byte {
+	if json.Valid([]byte(seg)) { return []byte(seg) }
+	b,_ := json.Marshal(seg)
+	return b
+}
+
+func bclone(b []byte) []byte { return append([]byte(nil),b...) }
+
+// Maps the jsondb reply codes to HTTP status codes.
+func status(e *protocol.Error) int {
+	switch {
+	case e.Code==404: return http.StatusNotFound
+	case e.Code==930: return http.StatusForbidden
+	case e.Code==931: return http.StatusUnauthorized
+	case e.Code==980: return http.StatusNotFound
+	case e.Code==981 || e.Code==710 || e.Code==711: return http.StatusConflict
+	case e.Code==712: return http.StatusPreconditionFailed
+	case e.Code==960: return http.StatusUnprocessableEntity
+	case e.Code==940 || e.Code==942 || e.Code==943 || e.Code==945: return http.StatusRequestEntityTooLarge
+	case e.Code==941: return http.StatusRequestTimeout
+	case e.Code==944: return http.StatusInsufficientStorage
+	case e.Code/100==9: return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+func replyError(w http.ResponseWriter, err error) {
+	e,ok := err.(*protocol.Error)
+	if !ok { e = &protocol.Error{Code:800,Msg:"IO Error",Err:err} }
+	replyJSON(w,status(e),struct{
+		Code int `json:"code"`
+		Error string `json:"error"`
+		Details []string `json:"details,omitempty"`
+	}{e.Code,e.Error(),e.Details})
+}
+
+func replyJSON(w http.ResponseWriter, code int, v interface{}) {
+	b,err := json.Marshal(v)
+	if err!=nil {
+		http.Error(w,err.Error(),http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type","application/json")
+	w.WriteHeader(code)
+	w.Write(append(b,'\n'))
+}
@@ -0,0 +1,148 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package httpgw
+
+import (
+	"github.com/mad-day/hobbydb/lstore"
+	"github.com/mad-day/hobbydb/protocol"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func testHandler(t *testing.T) *Handler {
+	d,err := ioutil.TempDir("","httpgw")
+	if err!=nil { t.Fatal(err) }
+	t.Cleanup(func(){ os.RemoveAll(d) })
+	return &Handler{DS:lstore.Complex(&lstore.Storage{Basepath:d},0)}
+}
+
+// Performs the request and fails, unless the status is the expected one.
+func do(t *testing.T, h http.Handler, code int, method, url, body string, hdr ...string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(method,url,strings.NewReader(body))
+	for i := 0; i+1<len(hdr); i += 2 { r.Header.Set(hdr[i],hdr[i+1]) }
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w,r)
+	if w.Code!=code { t.Fatalf("%s %s: got %d %s, want %d",method,url,w.Code,w.Body,code) }
+	return w
+}
+
+func TestDocuments(t *testing.T) {
+	h := testHandler(t)
+	do(t,h,404,"GET","/collections/docs/a","")
+	do(t,h,204,"PUT","/collections/docs/a",`{"x":1}`,"If-None-Match","*")
+	do(t,h,412,"PUT","/collections/docs/a",`{"x":1}`,"If-None-Match","*")
+	do(t,h,400,"PUT","/collections/docs/a",`{"x":`)
+	w := do(t,h,200,"GET","/collections/docs/%22a%22","")
+	etag := w.Header().Get("ETag")
+	if w.Body.String()!=`{"x":1}` || etag=="" { t.Errorf("got %s, ETag %s",w.Body,etag) }
+	do(t,h,204,"PATCH","/collections/docs/a",`{"y":2}`,"Content-Type","application/merge-patch+json","If-Match",etag)
+	do(t,h,412,"PATCH","/collections/docs/a",`{"y":3}`,"Content-Type","application/merge-patch+json","If-Match",etag)
+	do(t,h,204,"PATCH","/collections/docs/a",`[{"op":"remove","path":"/x"}]`,"Content-Type","application/json-patch+json")
+	do(t,h,415,"PATCH","/collections/docs/a",`{}`,"Content-Type","text/plain")
+	if w = do(t,h,200,"GET","/collections/docs/a",""); w.Body.String()!=`{"y":2}` { t.Errorf("got %s",w.Body) }
+	if w = do(t,h,200,"HEAD","/collections/docs/a",""); w.Body.Len()!=0 { t.Error("HEAD replied a body") }
+	do(t,h,204,"PUT","/collections/docs/1",`true`)
+	do(t,h,204,"DELETE","/collections/docs/a","","If-Match","*")
+	do(t,h,412,"DELETE","/collections/docs/a","","If-Match","*")
+	do(t,h,405,"POST","/collections/docs/a","")
+	do(t,h,404,"GET","/other","")
+
+	var rep listReply
+	w = do(t,h,200,"GET","/collections/docs?limit=5","")
+	if err := json.Unmarshal(w.Body.Bytes(),&rep); err!=nil { t.Fatal(err) }
+	if len(rep.Items)!=1 || string(rep.Items[0].Key)!="1" || rep.Cursor!="" { t.Errorf("got %s",w.Body) }
+	w = do(t,h,400,"GET","/collections/docs?limit=x","")
+	if !strings.Contains(w.Body.String(),`"code":906`) { t.Errorf("got %s",w.Body) }
+}
+
+// Collection names, that could reach other tables, are rejected.
+func TestCollectionName(t *testing.T) {
+	h := testHandler(t)
+	do(t,h,400,"PUT","/collections/..%2F..%2Fescape/a",`{"x":1}`)
+	do(t,h,400,"GET","/collections/a%2Fb","")
+	do(t,h,400,"DELETE","/collections/Docs/a","")
+	do(t,h,400,"GET","/collections//a","")
+	do(t,h,204,"PUT","/collections/my_docs2/a",`{"x":1}`)
+}
+
+func TestTransactions(t *testing.T) {
+	h := testHandler(t)
+	var rep struct{ Tx string `json:"tx"` }
+	w := do(t,h,201,"POST","/tx?read=snapshot&write=checked","")
+	if err := json.Unmarshal(w.Body.Bytes(),&rep); err!=nil || rep.Tx=="" { t.Fatalf("got %s",w.Body) }
+	do(t,h,204,"PUT","/collections/docs/a?tx="+rep.Tx,`1`)
+	do(t,h,200,"GET","/collections/docs/a","","X-Jsondb-Tx",rep.Tx)
+	do(t,h,404,"GET","/collections/docs/a","")
+	do(t,h,204,"POST","/tx/"+rep.Tx+"/commit","")
+	do(t,h,200,"GET","/collections/docs/a","")
+	do(t,h,404,"POST","/tx/"+rep.Tx+"/commit","")
+
+	json.Unmarshal(do(t,h,201,"POST","/tx","").Body.Bytes(),&rep)
+	do(t,h,204,"DELETE","/collections/docs/a?tx="+rep.Tx,"")
+	do(t,h,204,"DELETE","/tx/"+rep.Tx,"")
+	do(t,h,200,"GET","/collections/docs/a","")
+	do(t,h,400,"POST","/tx?read=dirty","")
+
+	// The conflicting transaction fails to commit.
+	var t1,t2 struct{ Tx string `json:"tx"` }
+	json.Unmarshal(do(t,h,201,"POST","/tx","").Body.Bytes(),&t1)
+	json.Unmarshal(do(t,h,201,"POST","/tx","").Body.Bytes(),&t2)
+	do(t,h,200,"GET","/collections/docs/a?tx="+t1.Tx,"")
+	do(t,h,204,"PUT","/collections/docs/a?tx="+t2.Tx,`2`)
+	do(t,h,204,"POST","/tx/"+t2.Tx+"/commit","")
+	do(t,h,204,"PUT","/collections/docs/a?tx="+t1.Tx,`3`)
+	do(t,h,409,"POST","/tx/"+t1.Tx+"/commit","")
+}
+
+func TestAuth(t *testing.T) {
+	h := testHandler(t)
+	h.RequireAuth = true
+	if err := protocol.SetUser(h.DS,"bob","pw",false,protocol.Grant{Pattern:"pub"}); err!=nil { t.Fatal(err) }
+	w := do(t,h,401,"GET","/collections/pub/a","")
+	if w.Header().Get("WWW-Authenticate")=="" { t.Error("no WWW-Authenticate header") }
+	basic := func(method, url, password string) int {
+		r := httptest.NewRequest(method,url,strings.NewReader("1"))
+		r.SetBasicAuth("bob",password)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w,r)
+		return w.Code
+	}
+	if code := basic("GET","/collections/pub/a","wrong"); code!=401 { t.Errorf("wrong password: got %d",code) }
+	for _,tc := range []struct{
+		method, url string
+		code int
+	}{
+		{"GET","/collections/pub/a",404},
+		{"PUT","/collections/pub/a",403},
+		{"GET","/collections/other/a",403},
+	} {
+		if code := basic(tc.method,tc.url,"pw"); code!=tc.code { t.Errorf("%s %s: got %d, want %d",tc.method,tc.url,code,tc.code) }
+	}
+}
@@ -0,0 +1,288 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package protocol
+
+import (
+	"github.com/mad-day/hobbydb/lstore"
+	"encoding/binary"
+	"encoding/json"
+	"strings"
+	"strconv"
+	"bytes"
+	"math"
+)
+
+/*
+Index entries are stored in the table jidx_<coll>:
+
+	escape(path) 0x00 0x01 | type | encoded value | document key  ->  document key
+
+The encoded values sort in the order null < false < true < numbers < strings.
+Arrays are indexed by their elements, objects are not indexed.
+*/
+
+const (
+	ix_null byte = 1+iota
+	ix_false
+	ix_true
+	ix_number
+	ix_string
+)
+
+// Escapes 0x00, so that 0x00 0x01 terminates.
+func ixEscape(b []byte, s string) []byte {
+	for i := 0; i<len(s); i++ {
+		if s[i]==0 {
+			b = append(b,0,0xff)
+		} else {
+			b = append(b,s[i])
+		}
+	}
+	return append(b,0,1)
+}
+
+func ixPrefix(path string) []byte { return ixEscape(nil,path) }
+
+// Encodes a scalar value, ok is false for objects and arrays.
+func ixValue(b []byte, v interface{}) ([]byte,bool) {
+	switch t := v.(type) {
+	case nil: return append(b,ix_null),true
+	case bool:
+		if t { return append(b,ix_true),true }
+		return append(b,ix_false),true
+	case float64:
+		u := math.Float64bits(t)
+		if u&(1<<63)!=0 { u = ^u } else { u |= 1<<63 }
+		var buf [8]byte
+		binary.BigEndian.PutUint64(buf[:],u)
+		return append(append(b,ix_number),buf[:]...),true
+	case string:
+		return ixEscape(append(b,ix_string),t),true
+	}
+	return b,false
+}
+
+// Resolves a JSON pointer (RFC 6901).
+func resolvePointer(doc interface{}, ptr string) (interface{},bool) {
+	if ptr=="" { return doc,true }
+	if ptr[0]!='/' { return nil,false }
+	for _,tok := range pointerTokens(ptr) {
+		switch v := doc.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if doc,ok = v[tok]; !ok { return nil,false }
+		case []interface{}:
+			i,err := strconv.Atoi(tok)
+			if err!=nil || i<0 || i>=len(v) { return nil,false }
+			doc = v[i]
+		default:
+			return nil,false
+		}
+	}
+	return doc,true
+}
+
+// Splits a non-empty JSON pointer into its unescaped reference tokens.
+func pointerTokens(ptr string) []string {
+	toks := strings.Split(ptr[1:],"/")
+	for i,tok := range toks {
+		toks[i] = strings.Replace(strings.Replace(tok,"~1","/",-1),"~0","~",-1)
+	}
+	return toks
+}
+
+func validPointer(ptr string) bool { return ptr=="" || ptr[0]=='/' }
+
+// Returns the index keys of the document.
+func indexKeys(paths []string, key, doc []byte) map[string]bool {
+	keys := make(map[string]bool)
+	if len(doc)==0 { return keys }
+	var v interface{}
+	if json.Unmarshal(doc,&v)!=nil { return keys }
+	for _,path := range paths {
+		f,ok := resolvePointer(v,path)
+		if !ok { continue }
+		vals := []interface{}{f}
+		if arr,ok := f.([]interface{}); ok { vals = arr }
+		for _,e := range vals {
+			ik,ok := ixValue(ixPrefix(path),e)
+			if !ok { continue }
+			keys[string(append(ik,key...))] = true
+		}
+	}
+	return keys
+}
+
+// Replaces the index entries of the old document by the ones of the new one.
+func updateIndexes(tx lstore.UDB, coll string, meta *collMeta, key, old, doc []byte) error {
+	t,err := tx.UTable(indexTable(coll))
+	if err!=nil { return err }
+	ok := indexKeys(meta.Indexes,key,old)
+	nk := indexKeys(meta.Indexes,key,doc)
+	for k := range ok {
+		if nk[k] { continue }
+		if err = t.Write([]byte(k),nil); err!=nil { return err }
+	}
+	for k := range nk {
+		if ok[k] { continue }
+		if err = t.Write([]byte(k),key); err!=nil { return err }
+	}
+	return nil
+}
+
+// Returns the successor of all keys with the given prefix.
+func prefixEnd(prefix []byte) []byte {
+	end := bclone(prefix)
+	for i := len(end)-1; i>=0; i-- {
+		if end[i]<0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+func bclone(b []byte) []byte {
+	c := make([]byte,len(b))
+	copy(c,b)
+	return c
+}
+
+// Calls fn with the document keys of the index entries in [lower,upper).
+func scanIndex(it lstore.UIterator, lower, upper []byte, fn func(key []byte) error) error {
+	for ok := it.Seek(lower); ok; ok = it.Next() {
+		if upper!=nil && bytes.Compare(it.Key(),upper)>=0 { break }
+		if err := fn(bclone(it.Value())); err!=nil { return err }
+	}
+	return nil
+}
+
+/*
+Handles the index commands:
+
+	create_index <coll> <path>
+	drop_index <coll> <path>
+	find <coll> <path> <value>
+	range <coll> <path> <from|*> <to|*>
+
+The range includes from and excludes to.
+*/
+func (c *cctx) performIndex(cmd, coll string, u lstore.UTable, arg []byte) error {
+	p,rest := nextArg(arg)
+	path := string(p)
+	if !validPointer(path) { return c.C.PrintfLine("902 Invalid JSON pointer: %q",path) }
+	meta,err := loadMeta(c.TX,coll)
+	if err!=nil { return c.C.PrintfLine("800 IO Error: %v",err) }
+	it,err := c.TX.UTable(indexTable(coll))
+	if err!=nil { return c.C.PrintfLine("800 IO Error: %v",err) }
+
+	switch cmd {
+	case "create_index":
+		if meta.hasIndex(path) { return c.C.PrintfLine("201 updated") }
+		// Index the existing documents.
+		iter := u.Iter()
+		for iter.Next() {
+			key := bclone(iter.Key())
+			for k := range indexKeys([]string{path},key,iter.Value()) {
+				if err = it.Write([]byte(k),key); err!=nil { break }
+			}
+			if err!=nil { break }
+		}
+		iter.Release()
+		if err!=nil { return c.replyWrite(cmd,err) }
+		meta.Indexes = append(meta.Indexes,path)
+		if err = storeMeta(c.TX,coll,meta); err!=nil { return c.replyWrite(cmd,err) }
+		return c.C.PrintfLine("201 updated")
+	case "drop_index":
+		if !meta.hasIndex(path) { return c.C.PrintfLine("903 No such index: %s",path) }
+		var keys [][]byte
+		iter := it.Iter()
+		prefix := ixPrefix(path)
+		for ok := iter.Seek(prefix); ok && bytes.HasPrefix(iter.Key(),prefix); ok = iter.Next() {
+			keys = append(keys,bclone(iter.Key()))
+		}
+		iter.Release()
+		for _,k := range keys {
+			if err = it.Write(k,nil); err!=nil { return c.replyWrite(cmd,err) }
+		}
+		var idx []string
+		for _,ip := range meta.Indexes {
+			if ip!=path { idx = append(idx,ip) }
+		}
+		meta.Indexes = idx
+		if err = storeMeta(c.TX,coll,meta); err!=nil { return c.replyWrite(cmd,err) }
+		return c.C.PrintfLine("201 updated")
+	}
+
+	if !meta.hasIndex(path) { return c.C.PrintfLine("903 No such index: %s",path) }
+
+	var bounds [2][]byte
+	for i := range bounds {
+		var val []byte
+		if cmd=="range" && len(rest)>0 && rest[0]=='*' {
+			rest = bytes.TrimLeft(rest[1:]," \t")
+			continue
+		}
+		val,rest,err = nextJSON(rest)
+		if err!=nil { return c.C.PrintfLine("904 Invalid value: %v",err) }
+		var v interface{}
+		json.Unmarshal(val,&v)
+		var ok bool
+		bounds[i],ok = ixValue(ixPrefix(path),v)
+		if !ok { return c.C.PrintfLine("904 Invalid value: not a scalar") }
+		if cmd=="find" { break }
+	}
+	lower,upper := bounds[0],bounds[1]
+	switch cmd {
+	case "find":
+		upper = prefixEnd(lower)
+	case "range":
+		if lower==nil { lower = ixPrefix(path) }
+		if upper==nil { upper = prefixEnd(ixPrefix(path)) }
+	}
+
+	/*
+	Collect the keys first, the index iterator must not outlive other reads.
+	An array field indexes a document once per element, so a range may hit it
+	several times: list it only once.
+	*/
+	var keys [][]byte
+	seen := make(map[string]bool)
+	iter := it.Iter()
+	scanIndex(iter,lower,upper,func(key []byte) error {
+		if !seen[string(key)] { keys = append(keys,key) }
+		seen[string(key)] = true
+		return nil
+	})
+	iter.Release()
+	if err = c.checkResults(len(keys)); err!=nil { return c.reply(err,"") }
+
+	if err = c.listHead("index results"); err!=nil { return err }
+	for _,key := range keys {
+		doc := u.Read(key)
+		if len(doc)==0 { continue }
+		if err = c.listItem(key,doc); err!=nil { return err }
+	}
+	return c.listEnd()
+}
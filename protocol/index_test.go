@@ -0,0 +1,135 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package protocol
+
+import (
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+// A text-mode connection to a test server.
+type testConn struct{
+	t *testing.T
+	*textproto.Conn
+}
+
+// Serves s, with a fresh storage, if s has none, and connects to it.
+func testSession(t *testing.T, s *Server) *testConn {
+	if s.DS==nil { s.DS = testDS(t) }
+	s.TTLInterval = -1
+	return &testConn{t,testDial(t,testServe(t,s))}
+}
+
+// Sends the command, followed by the body, if any, and returns the reply line.
+func (c *testConn) do(body string, format string, args ...interface{}) string {
+	c.t.Helper()
+	if err := c.PrintfLine(format,args...); err!=nil { c.t.Fatal(err) }
+	if body!="" {
+		dw := c.DotWriter()
+		dw.Write([]byte(body))
+		if err := dw.Close(); err!=nil { c.t.Fatal(err) }
+	}
+	line,err := c.ReadLine()
+	if err!=nil { c.t.Fatal(err) }
+	return line
+}
+
+// Like do, but fails, unless the reply has the code.
+func (c *testConn) must(code, body string, format string, args ...interface{}) string {
+	c.t.Helper()
+	line := c.do(body,format,args...)
+	if !strings.HasPrefix(line,code+" ") && line!=code { c.t.Fatalf("%s: got %q, want %s",format,line,code) }
+	return line
+}
+
+// Reads a dot body and strips its final newline.
+func (c *testConn) body() string {
+	c.t.Helper()
+	b,err := c.ReadDotBytes()
+	if err!=nil { c.t.Fatal(err) }
+	return strings.TrimSuffix(string(b),"\n")
+}
+
+// Reads the documents of a listing, which ends with "!" or "! <cursor>".
+func (c *testConn) items() (keys, docs []string, cursor string) {
+	c.t.Helper()
+	for {
+		line,err := c.ReadLine()
+		if err!=nil { c.t.Fatal(err) }
+		switch {
+		case strings.HasPrefix(line,"> "):
+			keys = append(keys,line[2:])
+			docs = append(docs,c.body())
+		case strings.HasPrefix(line,"!"):
+			return keys,docs,strings.TrimPrefix(line[1:]," ")
+		default:
+			c.t.Fatalf("unexpected line in listing: %q",line)
+		}
+	}
+}
+
+// Runs a listing command and returns its keys.
+func (c *testConn) list(format string, args ...interface{}) []string {
+	c.t.Helper()
+	c.must("202","",format,args...)
+	keys,_,_ := c.items()
+	return keys
+}
+
+func TestIndex(t *testing.T) {
+	c := testSession(t,&Server{})
+	c.must("200","","tx_full snapshot")
+	c.must("201",`{"n":1,"tags":["a","b","c"]}`,`put docs "x"`)
+	c.must("201",`{"n":2,"tags":["b"]}`,`put docs "y"`)
+	c.must("201","","create_index docs /tags")
+	c.must("201","","create_index docs /n")
+	c.must("201",`{"n":3,"tags":["c","d"]}`,`put docs "z"`)
+
+	if keys := c.list(`find docs /tags "b"`); strings.Join(keys,",")!=`"x","y"` { t.Errorf("find: got %v",keys) }
+	if keys := c.list(`range docs /tags "a" "d"`); strings.Join(keys,",")!=`"x","y","z"` { t.Errorf("range over an array: got %v",keys) }
+	if keys := c.list(`range docs /n 2 *`); strings.Join(keys,",")!=`"y","z"` { t.Errorf("open range: got %v",keys) }
+	c.must("201",`{"n":4}`,`put docs "x"`)
+	if keys := c.list(`find docs /tags "a"`); len(keys)!=0 { t.Errorf("the old index entries remain: %v",keys) }
+	c.must("201","",`delete docs "y"`)
+	if keys := c.list(`range docs /n * *`); strings.Join(keys,",")!=`"z","x"` { t.Errorf("got %v",keys) }
+	c.must("200","","commit")
+
+	c.must("200","","tx_full snapshot")
+	c.must("201","","drop_index docs /tags")
+	c.must("903","",`find docs /tags "c"`)
+	c.must("902","",`find docs tags "c"`)
+}
+
+// The documents, that an array field indexes several times, count once against MaxListKeys.
+func TestIndexLimit(t *testing.T) {
+	c := testSession(t,&Server{Limits:Limits{MaxListKeys:2}})
+	c.must("200","","tx_full snapshot")
+	c.must("201","","create_index docs /tags")
+	c.must("201",`{"tags":["a","b","c"]}`,`put docs "x"`)
+	c.must("201",`{"tags":["a","b"]}`,`put docs "y"`)
+	if keys := c.list(`range docs /tags * *`); len(keys)!=2 { t.Errorf("got %v",keys) }
+	c.must("201",`{"tags":["c"]}`,`put docs "z"`)
+	c.must("943","",`range docs /tags * *`)
+}
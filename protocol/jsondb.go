@@ -24,12 +24,15 @@ SOFTWARE.
 package protocol
 
 import (
+	"bytes"
 	"regexp"
+	"net"
 	"net/textproto"
+	"time"
+	"sync/atomic"
 	"github.com/mad-day/hobbydb/lstore"
 	"fmt"
 	"encoding/json"
-	jsonpatch "github.com/evanphx/json-patch"
 )
 /*
  TODO use:
@@ -43,9 +46,92 @@ var cmd2 = regexp.MustCompile(`^([a-z0-9_]+)`)
 
 
 type cctx struct{
+	*Session
 	C *textproto.Conn
-	DS lstore.UDBM
-	TX lstore.UDB
+	
+	// Optional, set by the Server.
+	conn net.Conn
+	srv *Server
+	id uint64
+	idle int32
+
+	// The body of the command in text mode, read ahead.
+	body []byte
+
+	// Set in binary mode.
+	bin *binConn
+}
+
+func newCctx(s *Session, c *textproto.Conn) *cctx {
+	cc := &cctx{Session:s,C:c}
+	s.log = cc.logf
+	return cc
+}
+
+// Sets the read deadline of the connection, if any. 0 clears it.
+func (c *cctx) deadline(d time.Duration) {
+	if c.conn==nil { return }
+	if d<=0 {
+		c.conn.SetReadDeadline(time.Time{})
+		return
+	}
+	c.conn.SetReadDeadline(time.Now().Add(d))
+}
+
+/*
+Waits for the next command without consuming it, so that the transaction can
+be rolled back, once it expires meanwhile.
+*/
+func (c *cctx) waitCommand(idle time.Duration) error {
+	for {
+		d,txWait := idle,false
+		if r := c.txRemaining(); r>0 && (idle<=0 || r<idle) { d,txWait = r,true }
+		c.deadline(d)
+		// Shutdown() sets its deadline after the shutdown flag.
+		if c.srv!=nil && c.srv.closing() { return errShutdown }
+		_,err := c.C.R.Peek(1)
+		if ne,ok := err.(net.Error); ok && ne.Timeout() && txWait && c.txExpired(time.Now()) {
+			c.expireTx()
+			continue
+		}
+		if err==nil { c.deadline(idle) }
+		return err
+	}
+}
+
+func (c *cctx) logf(format string, args ...interface{}) {
+	if c.srv==nil { return }
+	c.srv.logf("conn=%d "+format,append([]interface{}{c.id},args...)...)
+}
+
+// Rolls back the active transaction, if any.
+func (c *cctx) rollback() {
+	if c.TX!=nil && c.Rollback()==nil { c.logf("event=rollback reason=disconnect") }
+}
+
+// Replies with the error of a Session operation.
+func (c *cctx) replyError(e *Error) error {
+	if e.Code!=960 { return c.C.PrintfLine("%d %v",e.Code,e) }
+	// The validation errors follow as body.
+	if err := c.C.PrintfLine("%d %s",e.Code,e.Msg); err!=nil { return err }
+	dw := c.bodyWriter()
+	for _,d := range e.Details {
+		if _,err := dw.Write([]byte(d+"\n")); err!=nil {
+			dw.Close()
+			return err
+		}
+	}
+	return dw.Close()
+}
+
+// Replies with the error of a failed write.
+func (c *cctx) replyWrite(cmd string, err error) error { return c.replyError(writeError(700,"write op "+cmd,err)) }
+
+// Replies OK, or with the error of a Session operation.
+func (c *cctx) reply(err error, ok string) error {
+	if e,isErr := err.(*Error); isErr { return c.replyError(e) }
+	if err!=nil { return c.C.PrintfLine("800 IO Error: %v",err) }
+	return c.C.PrintfLine("%s",ok)
 }
 
 func normalizeJson(i []byte) (r []byte,err error) {
@@ -56,9 +142,94 @@ func normalizeJson(i []byte) (r []byte,err error) {
 	return
 }
 
+// Decodes JSON like json.Unmarshal, but keeps numbers as json.Number, so that they keep their precision.
+func unmarshalNumber(b []byte, v interface{}) error {
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	if err := d.Decode(v); err!=nil { return err }
+	if d.More() { return fmt.Errorf("invalid character after top-level value") }
+	return nil
+}
+
+// Splits off the first whitespace-separated argument.
+func nextArg(s []byte) (arg, rest []byte) {
+	s = bytes.TrimLeft(s," \t")
+	i := bytes.IndexAny(s," \t")
+	if i<0 { return s,nil }
+	return s[:i],bytes.TrimLeft(s[i:]," \t")
+}
+
+// Splits off the first JSON value. The value may contain whitespace.
+func nextJSON(s []byte) (val, rest []byte, err error) {
+	s = bytes.TrimLeft(s," \t")
+	dec := json.NewDecoder(bytes.NewReader(s))
+	var raw json.RawMessage
+	if err = dec.Decode(&raw); err!=nil { return }
+	off := dec.InputOffset()
+	return s[:off],bytes.TrimLeft(s[off:]," \t"),nil
+}
+
+/*
+Parses a key, optionally followed by a condition:
+
+	<key> [if-match <etag|none>]
+*/
+func splitKey(s []byte) (key []byte, ifmatch string, err error) {
+	raw,rest,err := nextJSON(s)
+	if err!=nil { return }
+	if key,err = normalizeJson(raw); err!=nil { return }
+	if ifmatch,err = splitCond(rest); err!=nil { return nil,"",err }
+	return
+}
+
+// Parses the optional "if-match <etag|none>" after a key.
+func splitCond(s []byte) (ifmatch string, err error) {
+	if len(s)==0 { return }
+	kw,rest := nextArg(s)
+	tag,rest := nextArg(rest)
+	if string(kw)!="if-match" || len(tag)==0 || len(rest)!=0 {
+		return "",fmt.Errorf("unexpected %q",s)
+	}
+	return string(tag),nil
+}
+
+// Writes the head of a listing.
+func (c *cctx) listHead(msg string) error {
+	return c.C.PrintfLine("202 %s",msg)
+}
+
+// Writes one document of a listing.
+func (c *cctx) listItem(key, doc []byte) error {
+	return c.writeItem("",key,doc)
+}
+
+// Writes the end of a listing.
+func (c *cctx) listEnd() error {
+	return c.C.PrintfLine("!")
+}
+
+// Writes the end of a listing, that can be continued with the cursor.
+func (c *cctx) listMore(cursor string) error {
+	return c.C.PrintfLine("! %s",cursor)
+}
+
 func (c *cctx) perform() error {
 	var args [3][]byte
-	rl,err := c.C.ReadLineBytes()
+	var idle time.Duration
+	if c.srv!=nil { idle = c.srv.IdleTimeout }
+	
+	// Either Shutdown() sees us idle, or we see the shutdown.
+	atomic.StoreInt32(&c.idle,1)
+	if c.srv!=nil && c.srv.closing() { return errShutdown }
+	var rl []byte
+	err := c.waitCommand(idle)
+	if err==nil { rl,err = c.C.ReadLineBytes() }
+	atomic.StoreInt32(&c.idle,0)
+	if err!=nil {
+		if c.srv!=nil && c.srv.closing() { return errShutdown }
+		return err
+	}
+	if c.srv!=nil { c.deadline(c.srv.ReadTimeout) }
 	if sm := cmd.FindSubmatchIndex(rl);len(sm)!=0 {
 		args[0] = rl[sm[2]:sm[3]]
 		args[1] = rl[sm[4]:sm[5]]
@@ -69,10 +240,49 @@ func (c *cctx) perform() error {
 		return c.C.PrintfLine("999 Invalid command")
 	}
 	//c.C.PrintfLine("%q %q %q",string(args[0]),string(args[1]),string(args[2]))
+	if c.srv!=nil && c.srv.LogCommands { c.logf("event=cmd cmd=%s arg=%q",args[0],args[1]) }
+	if err = c.prefetch(string(args[0])); err==errBodyTooLarge {
+		limitHit("body_size")
+		c.logf("event=limit limit=body_size cmd=%s",args[0])
+		return c.replyError(errBodyTooLarge)
+	} else if err!=nil {
+		return err
+	}
+	switch string(args[0]){
+	case "quit","rollback","hello","capabilities":
+	default:
+		if err = c.checkTx(); err!=nil { return c.reply(err,"") }
+	}
 	switch string(args[0]){
+	case "quit","auth","binary","starttls","hello","capabilities":
+	default:
+		if !knownCommand(string(args[0])) { return c.C.PrintfLine("996 unknown command %s",args[0]) }
+		if !c.authenticated() { return c.deny("authentication required") }
+	}
+	switch string(args[0]){
+	case "auth":
+		return c.reply(c.Auth(string(args[1]),string(args[2])),"200 OK")
+	case "watch":
+		return c.performWatch(string(args[1]),args[2])
+	case "import":
+		return c.performImport(string(args[1]),args[2])
+	case "batch":
+		return c.performBatch(string(args[1]),args[2])
+	case "export":
+		return c.performExport(string(args[1]),args[2])
+	case "starttls":
+		return c.performStartTLS()
+	case "hello","capabilities":
+		return c.performHello(string(args[0]),string(args[1]))
 	case "quit":
 		c.C.PrintfLine("250 bye")
 		return eBYE
+	case "binary":
+		if c.bin!=nil { return c.C.PrintfLine("200 binary mode") }
+		if c.TX!=nil { return c.C.PrintfLine("981 Active transaction") }
+		if err = c.C.PrintfLine("200 binary mode"); err!=nil { return err }
+		c.startBinary()
+		return nil
 	case "tx_full","tx_batch","tx_auto","tx_blind","tx_read":
 		if c.TX!=nil { return c.C.PrintfLine("981 Active transaction") }
 		var ri lstore.ReadIso
@@ -90,91 +300,91 @@ func (c *cctx) perform() error {
 		case "any": ri = lstore.READ_ANY
 		default: if c.TX==nil { return c.C.PrintfLine("990 unknown isolation level: %v",string(args[1])) }
 		}
-		c.TX = c.DS.StartTx(ri,wi)
-		return c.C.PrintfLine("200 OK")
+		return c.reply(c.Begin(ri,wi),"200 OK")
 	case "commit":
-		if c.TX==nil { return c.C.PrintfLine("980 No active transaction") }
-		err = c.TX.Commit()
-		c.TX = nil
-		if err!=nil { return c.C.PrintfLine("710 Abort: %v",err) }
-		return c.C.PrintfLine("200 OK")
+		return c.reply(c.Commit(),"200 OK")
 	case "rollback":
-		if c.TX==nil { return c.C.PrintfLine("980 No active transaction") }
-		c.TX.Discard()
-		c.TX = nil
-		return c.C.PrintfLine("200 OK")
+		return c.reply(c.Rollback(),"200 OK")
 	default:
-		if c.TX==nil { return c.C.PrintfLine("980 No active transaction") }
+		if c.TX==nil { return c.reply(c.noTx(),"") }
+		if !c.authorize(string(args[0]),string(args[1])) {
+			if cmdAccess[string(args[0])]=='a' { return c.deny("admin required") }
+			return c.deny("no access to "+string(args[1]))
+		}
 	}
 	var u lstore.UTable
 	var errt1 error
-	u,errt1 = c.TX.UTable("json_"+string(args[1]))
-	var mykey,myup,myvalue []byte
+	switch string(args[0]){
+	// Only these take the table of a collection, the others would create a stray one.
+	case "create_index","drop_index","find","range","create_text_index","drop_text_index","search","query":
+		u,errt1 = c.TX.UTable(docTable(string(args[1])))
+	}
+	var myup []byte
 	
 	switch string(args[0]){
+	case "create_index","drop_index","find","range":
+		if errt1!=nil { return c.C.PrintfLine("800 IO Error: %v",errt1) }
+		return c.performIndex(string(args[0]),string(args[1]),u,args[2])
+	case "create_text_index","drop_text_index","search":
+		if errt1!=nil { return c.C.PrintfLine("800 IO Error: %v",errt1) }
+		return c.performText(string(args[0]),string(args[1]),u,args[2])
+	case "collections","create","drop","stats":
+		return c.performCollection(string(args[0]),string(args[1]),args[2])
+	case "history","set_history":
+		return c.performHistory(string(args[0]),string(args[1]),args[2])
+	case "set_schema","get_schema":
+		return c.performSchema(string(args[0]),string(args[1]))
+	case "user_set","user_delete":
+		return c.performUser(string(args[0]),string(args[1]))
+	case "query":
+		myup,err = c.readBody()
+		if err!=nil { return err }
+		if errt1!=nil { return c.C.PrintfLine("800 IO Error: %v",errt1) }
+		return c.performQuery(string(args[1]),u,myup)
 	case "get":
-		if errt1!=nil { return c.C.PrintfLine("800 IO Error: %v",err) }
-		mykey,err = normalizeJson(args[2])
+		mykey,rest,err := c.readKeyArgs(args[2])
 		if err!=nil { return c.C.PrintfLine("901 Invalid Key: %v",err) }
-		err = c.C.PrintfLine("290 content follows")
+		var doc []byte
+		var etag string
+		if kw,at := nextArg(rest); string(kw)=="at" && len(at)!=0 {
+			var rev uint64
+			doc,etag,rev,err = c.GetAt(string(args[1]),mykey,string(at))
+			if err!=nil { return c.reply(err,"") }
+			err = c.C.PrintfLine("290 content follows Rev=%d ETag=%s",rev,etag)
+		} else {
+			doc,etag,err = c.Get(string(args[1]),mykey)
+			if err!=nil { return c.reply(err,"") }
+			err = c.C.PrintfLine("290 content follows ETag=%s",etag)
+		}
 		if err!=nil { return err }
-		dw := c.C.DotWriter()
-		defer dw.Close()
-		_,err = dw.Write(u.Read(mykey))
-		return err
-	case "put","delete","merge","patch":
+		return c.writeBody(doc)
+	case "put","delete","merge","patch","update":
 		if string(args[0])=="delete" {
 			myup = nil
 		} else {
-			myup,err = c.C.ReadDotBytes()
+			myup,err = c.readBody()
 			if err!=nil { return err }
 		}
-		mykey,err = normalizeJson(args[2])
+		mykey,ifmatch,err := c.readKey(args[2])
 		if err!=nil { return c.C.PrintfLine("901 Invalid Key: %v",err) }
-		if errt1!=nil { return c.C.PrintfLine("800 IO Error: %v",err) }
-		switch string(args[0]) {
-		case "merge","patch":
-			myvalue = u.Read(mykey)
-			if len(myvalue)==0 { myvalue=[]byte("{}") }
-		}
-		switch string(args[0]) {
-		case "merge":
-			myup,err = jsonpatch.MergePatch(myvalue,myup)
-			if err!=nil { return c.C.PrintfLine("998 Invalid merge patch: %v",err) }
-		case "patch":
-			patch, err := jsonpatch.DecodePatch(myup)
-			if err!=nil { return c.C.PrintfLine("997 Invalid JSON patch: %v",err) }
-			myup, err = patch.Apply(myvalue)
-			if err!=nil { return c.C.PrintfLine("850 Corrupted JSON in db: %v",err) }
-		}
-		err = u.Write(mykey,myup)
-		if err!=nil { return c.C.PrintfLine("700 write op %s: %v",args[0],err) }
-		/*-----------------------------------------------------------------------------*/
-		return c.C.PrintfLine("201 updated")
+		return c.reply(c.Write(string(args[0]),string(args[1]),mykey,ifmatch,myup),"201 updated")
 	case "list":
-		iter := u.Iter()
-		defer iter.Release()
-		err = c.C.PrintfLine("202 list collection")
-		if err!=nil { return err }
-		for iter.Next() {
-			c.C.PrintfLine("> %s",iter.Key())
-			dw := c.C.DotWriter()
-			_,err = dw.Write(iter.Value())
-			if err!=nil { return err }
-			err = dw.Close()
-			if err!=nil { return err }
-		}
-		return c.C.PrintfLine("!")
+		return c.performList(string(args[1]),args[2])
 	}
 	return c.C.PrintfLine("996 unknown command %s",args[0])
-	return nil
 }
 
-func Perform(l lstore.UDBM,c *textproto.Conn) {
-	cc := &cctx{C:c,DS:l}
+func (c *cctx) loop() error {
+	defer c.rollback()
 	for {
-		err := cc.perform()
-		if err!=nil { return }
+		err := c.perform()
+		if err==nil && c.srv!=nil && c.srv.closing() { err = errShutdown }
+		if err==errShutdown { c.C.PrintfLine("421 Server shutting down") }
+		if err!=nil { return err }
 	}
 }
 
+func Perform(l lstore.UDBM,c *textproto.Conn) {
+	newCctx(NewSession(l,false),c).loop()
+}
+
@@ -0,0 +1,286 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package protocol
+
+import (
+	"github.com/mad-day/hobbydb/lstore"
+	"encoding/binary"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+/*
+The resource limits of the sessions, 0 means unlimited. Every limit has its
+reply code:
+
+	940 Document too large        MaxDocSize
+	941 Transaction timeout       MaxTxDuration, the transaction is rolled back
+	942 Too many writes           MaxTxWrites
+	943 Too many results          MaxListKeys, find, range and query
+	944 Quota exceeded            Quota
+	945 Body too large            MaxBodySize
+
+Lists are cut short at MaxListKeys and end with a cursor instead. Every time
+a limit is hit, the counter of the limit in the expvar map "jsondb_limits" is
+incremented.
+*/
+type Limits struct{
+	// The maximum size of a stored document in bytes.
+	MaxDocSize int `json:"max_doc_size,omitempty"`
+
+	// The maximum size of a dot body or frame in bytes. Larger bodies are
+	// skipped without being buffered.
+	MaxBodySize int `json:"max_body_size,omitempty"`
+
+	// The maximum lifetime of a transaction. Expired transactions are rolled
+	// back, even while their connection idles, to release their snapshots.
+	MaxTxDuration time.Duration `json:"max_tx_duration,omitempty"`
+
+	// The maximum number of writes per transaction.
+	MaxTxWrites int `json:"max_tx_writes,omitempty"`
+
+	// The maximum number of documents per listing.
+	MaxListKeys int `json:"max_list_keys,omitempty"`
+
+	// The storage quota of the users in bytes, unless their user record has
+	// one (see SetQuota).
+	Quota int64 `json:"quota,omitempty"`
+}
+
+var noLimits Limits
+
+// The counters of the limits, that were hit.
+var limitStats = expvar.NewMap("jsondb_limits")
+
+func limitHit(name string) { limitStats.Add(name,1) }
+
+var (
+	errDocTooLarge = &Error{Code:940,Msg:"Document too large"}
+	errTxTimeout = &Error{Code:941,Msg:"Transaction timeout"}
+	errTooManyWrites = &Error{Code:942,Msg:"Too many writes"}
+	errTooManyResults = &Error{Code:943,Msg:"Too many results"}
+	errBodyTooLarge = &Error{Code:945,Msg:"Body too large"}
+)
+
+func (s *Session) limits() *Limits {
+	if s.Limits==nil { return &noLimits }
+	return s.Limits
+}
+
+// Rolls back the transaction, if it outlived MaxTxDuration.
+func (s *Session) checkTx() error {
+	if s.TX==nil || !s.txExpired(time.Now()) { return nil }
+	s.expireTx()
+	return s.noTx()
+}
+
+/*
+Rolls back the expired transaction. The next command, that needs it, fails
+with errTxTimeout instead of errNoTx.
+*/
+func (s *Session) expireTx() {
+	s.Rollback()
+	s.expired = true
+	limitHit("tx_duration")
+	s.logf("event=limit limit=tx_duration")
+}
+
+func (s *Session) noTx() error {
+	if s.expired {
+		s.expired = false
+		return errTxTimeout
+	}
+	return errNoTx
+}
+
+func (s *Session) txExpired(now time.Time) bool {
+	d := s.limits().MaxTxDuration
+	return d>0 && now.Sub(s.started)>d
+}
+
+// Returns the time until the transaction expires, or 0, if it does not.
+func (s *Session) txRemaining() time.Duration {
+	d := s.limits().MaxTxDuration
+	if s.TX==nil || d<=0 { return 0 }
+	r := time.Until(s.started.Add(d))
+	if r<time.Millisecond { r = time.Millisecond }
+	return r
+}
+
+// Fails, if the transaction has written MaxTxWrites documents. The writes are counted by the callers.
+func (s *Session) checkWrites() error {
+	if m := s.limits().MaxTxWrites; m>0 && s.writes>=m {
+		limitHit("tx_writes")
+		return errTooManyWrites
+	}
+	return nil
+}
+
+// Caps the limit of a listing, also the unlimited 0, at MaxListKeys. Reports whether it did.
+func (s *Session) capList(limit *int) bool {
+	m := s.limits().MaxListKeys
+	if m<=0 || (*limit>0 && *limit<=m) { return false }
+	*limit = m
+	return true
+}
+
+// Fails, if a listing of n documents exceeds MaxListKeys.
+func (s *Session) checkResults(n int) error {
+	if m := s.limits().MaxListKeys; m>0 && n>m {
+		limitHit("list_keys")
+		return errTooManyResults
+	}
+	return nil
+}
+
+// The table, that holds the storage used by the users.
+const usageTable = "jsondb_usage"
+
+/*
+Checks the document against MaxDocSize and charges the change of its size to
+the owner of the document, which is the user, that created it. Documents count
+with their key, documents of anonymous sessions have no owner. The usage of
+every owner is tracked, but only limited by its quota. The returned refund
+takes the charge and the change of the owner back, if the document could not
+be written.
+*/
+func (s *Session) checkDoc(coll string, key, old, doc []byte) (refund func(),err error) {
+	refund = func(){}
+	if m := s.limits().MaxDocSize; m>0 && len(doc)>m {
+		limitHit("doc_size")
+		return refund,errDocTooLarge
+	}
+	ot,err := s.TX.UTable(ownerTable(coll))
+	if err!=nil { return refund,err }
+	owner := s.userName
+	if len(old)!=0 { owner = string(ot.Read(key)) }
+	if owner=="" { return refund,nil }
+	size := func(d []byte) int64 {
+		if len(d)==0 { return 0 }
+		return int64(len(key)+len(d))
+	}
+	delta := size(doc)-size(old)
+	if delta!=0 {
+		quota,err := s.quotaOf(owner)
+		if err!=nil { return refund,err }
+		if err = s.addUsage(owner,delta,quota); err!=nil { return refund,err }
+	}
+	var prev,next []byte
+	switch {
+	case len(old)==0 && len(doc)!=0: next = []byte(owner)
+	case len(old)!=0 && len(doc)==0: prev = []byte(owner)
+	}
+	refund = func(){
+		if delta!=0 { s.addUsage(owner,-delta,0) }
+		if prev!=nil || next!=nil { ot.Write(key,prev) }
+	}
+	if prev!=nil || next!=nil {
+		if err = ot.Write(key,next); err!=nil { refund() }
+	}
+	return
+}
+
+// Returns the quota of the user, 0 means unlimited.
+func (s *Session) quotaOf(name string) (int64,error) {
+	var quota int64
+	if name==s.userName && s.user!=nil {
+		quota = s.user.Quota
+	} else if u,err := loadUser(s.TX,name); err==nil {
+		quota = u.Quota
+	} else if err!=ErrNoUser {
+		return 0,err
+	}
+	if quota==0 { quota = s.limits().Quota }
+	if quota<0 { quota = 0 }
+	return quota,nil
+}
+
+/*
+Adds delta to the usage of the user and fails, if it grows beyond the quota.
+Instant transactions update the usage atomically, the others read it for
+update, so that concurrent updates conflict at commit.
+*/
+func (s *Session) addUsage(name string, delta, quota int64) error {
+	t,err := s.TX.UTable(usageTable)
+	if err!=nil { return err }
+	key := []byte(name)
+	for attempt := 1; ; attempt++ {
+		var cur []byte
+		ct,cas := t.(lstore.CASTable)
+		if cas {
+			cur = ct.ReadCurrent(key)
+		} else if ur,ok := t.(lstore.UpdateReader); ok {
+			cur = ur.ReadForUpdate(key)
+		} else {
+			cur = t.Read(key)
+		}
+		var used int64
+		if len(cur)==8 { used = int64(binary.BigEndian.Uint64(cur)) }
+		used += delta
+		if delta>0 && quota>0 && used>quota {
+			limitHit("quota")
+			return opError(944,"Quota exceeded",fmt.Errorf("%d of %d bytes",used,quota))
+		}
+		if used<0 { used = 0 }
+		b := make([]byte,8)
+		binary.BigEndian.PutUint64(b,uint64(used))
+		if !cas { return t.Write(key,b) }
+		err = ct.WriteIf(key,cur,b)
+		if err!=lstore.ErrConcurrentUpdate || attempt>=updateAttempts { return err }
+	}
+}
+
+/*
+Sets the storage quota of the user in bytes. 0 means the quota of the Limits,
+a negative quota means unlimited.
+*/
+func SetQuota(ds lstore.UDBM, name string, quota int64) error {
+	tx := ds.StartTx(lstore.READ_SNAPSHOT,lstore.WRITE_CHECKED)
+	u,err := loadUser(tx,name)
+	if err==nil {
+		u.Quota = quota
+		err = storeUser(tx,name,u)
+	}
+	if err!=nil {
+		tx.Discard()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Reads a dot body of up to max bytes. Larger bodies are skipped and fail with errBodyTooLarge.
+func (c *cctx) readDot(max int) ([]byte,error) {
+	if max<=0 { return c.C.ReadDotBytes() }
+	dr := c.C.DotReader()
+	b,err := ioutil.ReadAll(io.LimitReader(dr,int64(max)+1))
+	if err!=nil { return nil,err }
+	if len(b)>max {
+		if _,err = io.Copy(ioutil.Discard,dr); err!=nil { return nil,err }
+		return nil,errBodyTooLarge
+	}
+	return b,nil
+}
@@ -0,0 +1,155 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package protocol
+
+import (
+	"github.com/mad-day/hobbydb/lstore"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLimits(t *testing.T) {
+	c := testSession(t,&Server{Limits:Limits{MaxDocSize:10,MaxBodySize:20,MaxTxWrites:2,MaxTxDuration:100*time.Millisecond}})
+	c.must("200","","tx_full snapshot")
+	c.must("940",`"0123456789"`,`put docs "a"`)
+	c.must("945",strings.Repeat("1",30),`put docs "a"`)
+	c.must("201","1",`put docs "a"`)
+	c.must("201","2",`put docs "b"`)
+	c.must("942","3",`put docs "c"`)
+	c.must("200","","commit")
+	c.must("200","","tx_read snapshot")
+	time.Sleep(150*time.Millisecond)
+	c.must("941","",`get docs "a"`)
+	c.must("980","",`get docs "a"`)
+}
+
+// Returns the storage used by the user.
+func usage(t *testing.T, ds lstore.UDBM, name string) int64 {
+	t.Helper()
+	tx := ds.StartTx(lstore.READ_SNAPSHOT,lstore.WRITE_DISABLED)
+	defer tx.Discard()
+	u,err := tx.UTable(usageTable)
+	if err!=nil { t.Fatal(err) }
+	b := u.Read([]byte(name))
+	if len(b)!=8 { return 0 }
+	return int64(binary.BigEndian.Uint64(b))
+}
+
+func userTx(t *testing.T, ds lstore.UDBM, name string, w lstore.WriteIso) *Session {
+	t.Helper()
+	s := NewSession(ds,false)
+	if err := s.Login(name); err!=nil { t.Fatal(err) }
+	if err := s.Begin(lstore.READ_SNAPSHOT,w); err!=nil { t.Fatal(err) }
+	return s
+}
+
+// The documents are charged to the user, that created them, whoever changes them.
+func TestQuotaOwner(t *testing.T) {
+	ds := testDS(t)
+	for _,name := range []string{"bob","eve"} {
+		if err := SetUser(ds,name,"pw",true); err!=nil { t.Fatal(err) }
+	}
+	if err := SetQuota(ds,"bob",20); err!=nil { t.Fatal(err) }
+
+	bob := userTx(t,ds,"bob",lstore.WRITE_CHECKED)
+	bob.mustWrite(t,"put",`"a"`,`{"x":1}`)
+	if err := bob.Commit(); err!=nil { t.Fatal(err) }
+	if n := usage(t,ds,"bob"); n!=10 { t.Errorf("bob uses %d, want 10",n) }
+
+	eve := userTx(t,ds,"eve",lstore.WRITE_CHECKED)
+	eve.mustWrite(t,"merge",`"a"`,`{"y":2}`)
+	eve.mustWrite(t,"put",`"b"`,`{"y":2}`)
+	err := eve.Write("merge","docs",[]byte(`"a"`),"",[]byte(`{"z":"0123456789"}`))
+	if e,ok := err.(*Error); !ok || e.Code!=944 { t.Errorf("got %v, want 944",err) }
+	if err = eve.Commit(); err!=nil { t.Fatal(err) }
+	if n := usage(t,ds,"bob"); n!=16 { t.Errorf("bob uses %d, want 16",n) }
+	if n := usage(t,ds,"eve"); n!=10 { t.Errorf("eve uses %d without a quota, want 10",n) }
+
+	eve = userTx(t,ds,"eve",lstore.WRITE_CHECKED)
+	eve.mustWrite(t,"delete",`"a"`,``)
+	eve.mustWrite(t,"put",`"a"`,`1`)
+	if err = eve.Commit(); err!=nil { t.Fatal(err) }
+	if n := usage(t,ds,"bob"); n!=0 { t.Errorf("bob uses %d after the delete, want 0",n) }
+	if n := usage(t,ds,"eve"); n!=14 { t.Errorf("eve uses %d, want 14",n) }
+}
+
+// Concurrent writes of the documents of a user lose no usage.
+func TestQuotaConcurrent(t *testing.T) {
+	ds := testDS(t)
+	if err := SetUser(ds,"bob","pw",true); err!=nil { t.Fatal(err) }
+	var wg sync.WaitGroup
+	for i := 0; i<4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			s := userTx(t,ds,"bob",lstore.WRITE_INSTANT_ATOMIC)
+			defer s.Commit()
+			for j := 0; j<25; j++ {
+				if err := s.Write("put","docs",[]byte(fmt.Sprintf(`"%d-%02d"`,i,j)),"",[]byte(`1`)); err!=nil { t.Error(err); return }
+			}
+		}(i)
+	}
+	wg.Wait()
+	if n := usage(t,ds,"bob"); n!=100*7 { t.Errorf("bob uses %d, want %d",n,100*7) }
+
+	s1 := userTx(t,ds,"bob",lstore.WRITE_CHECKED)
+	s2 := userTx(t,ds,"bob",lstore.WRITE_CHECKED)
+	s1.mustWrite(t,"put",`"x"`,`1`)
+	s2.mustWrite(t,"put",`"y"`,`1`)
+	if err := s1.Commit(); err!=nil { t.Fatal(err) }
+	if err := s2.Commit(); err==nil {
+		t.Error("the concurrent usage update was committed")
+	} else if e,ok := err.(*Error); !ok || e.Code!=711 {
+		t.Errorf("got %v, want 711",err)
+	}
+	if n := usage(t,ds,"bob"); n!=100*7+4 { t.Errorf("bob uses %d, want %d",n,100*7+4) }
+}
+
+// A write, that fails after the document, takes the charge back.
+func TestQuotaRefund(t *testing.T) {
+	var failing string
+	ds := failingDS(t,&failing)
+	if err := SetUser(ds,"bob","pw",true); err!=nil { t.Fatal(err) }
+	c := testSession(t,&Server{DS:ds})
+	c.must("200","","auth bob pw")
+	c.must("200","","tx_full snapshot")
+	c.must("201","","create_index docs /x")
+	c.must("200","","commit")
+	c.must("200","","tx_auto snapshot")
+	c.must("201",`{"x":1}`,`put docs "a"`)
+	used := usage(t,ds,"bob")
+	failing = indexTable("docs")
+	c.must("700",`{"x":"longer"}`,`put docs "a"`)
+	c.must("700",`{"x":2}`,`put docs "b"`)
+	failing = ""
+	if n := usage(t,ds,"bob"); n!=used { t.Errorf("bob uses %d, want %d",n,used) }
+	c.must("201",`{"x":2}`,`put docs "b"`)
+	c.must("201","",`delete docs "a"`)
+	if n := usage(t,ds,"bob"); n!=used { t.Errorf("bob uses %d, want %d",n,used) }
+	c.must("200","","commit")
+}
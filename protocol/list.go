@@ -0,0 +1,153 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package protocol
+
+import (
+	"github.com/mad-day/hobbydb/lstore"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"bytes"
+)
+
+var errBadCursor = errors.New("invalid cursor")
+
+/*
+The options of the list command:
+
+	list <coll> {"start":"a", "end":"m", "prefix":"ab", "limit":100, "reverse":true, "cursor":"..."}
+
+Keys are ordered by their JSON encoding. The start key is included, the end
+key is excluded. The prefix applies to string keys. If the limit cuts the
+listing short, it ends with "! <cursor>" instead of "!". Passing the cursor
+with otherwise equal options continues the listing.
+
+The storage iterates forward only: a reverse listing scans its whole range
+and buffers the last limit+1 documents, so it costs O(N) in the size of the
+range. Without a limit (and MaxListKeys), it buffers the whole range.
+*/
+type ListOptions struct{
+	Start json.RawMessage `json:"start,omitempty"`
+	End json.RawMessage `json:"end,omitempty"`
+	Prefix *string `json:"prefix,omitempty"`
+	Limit int `json:"limit,omitempty"`
+	Reverse bool `json:"reverse,omitempty"`
+	Cursor string `json:"cursor,omitempty"`
+}
+
+// Computes the key range [lower,upper) of the options. Nil bounds are unbounded.
+func (o *ListOptions) bounds() (lower, upper []byte, err error) {
+	if o.Start!=nil {
+		if lower,err = normalizeJson(o.Start); err!=nil { return }
+	}
+	if o.End!=nil {
+		if upper,err = normalizeJson(o.End); err!=nil { return }
+	}
+	if o.Prefix!=nil {
+		var p []byte
+		if p,err = json.Marshal(*o.Prefix); err!=nil { return }
+		p = p[:len(p)-1] // Strip the closing quote.
+		if bytes.Compare(p,lower)>0 { lower = p }
+		if e := prefixEnd(p); upper==nil || bytes.Compare(e,upper)<0 { upper = e }
+	}
+	if o.Cursor!="" {
+		var b []byte
+		b,err = base64.RawURLEncoding.DecodeString(o.Cursor)
+		if err!=nil || len(b)==0 || (b[0]=='r')!=o.Reverse { return nil,nil,errBadCursor }
+		key := b[1:]
+		if o.Reverse {
+			if upper==nil || bytes.Compare(key,upper)<0 { upper = key }
+		} else {
+			// The smallest key after the cursor.
+			next := append(bclone(key),0)
+			if bytes.Compare(next,lower)>0 { lower = next }
+		}
+	}
+	return
+}
+
+func makeCursor(reverse bool, key []byte) string {
+	dir := byte('f')
+	if reverse { dir = 'r' }
+	return base64.RawURLEncoding.EncodeToString(append([]byte{dir},key...))
+}
+
+// Calls fn for the documents in [lower,upper), returns the cursor, if limit cut the listing short.
+func listRange(u lstore.UTable, limit int, reverse bool, lower, upper []byte, fn func(key, doc []byte) error) (string,error) {
+	iter := u.Iter()
+	defer iter.Release()
+	ok := false
+	if lower!=nil { ok = iter.Seek(lower) } else { ok = iter.Next() }
+	inRange := func() bool { return ok && (upper==nil || bytes.Compare(iter.Key(),upper)<0) }
+
+	if !reverse {
+		var last []byte
+		for n := 0; inRange(); ok,n = iter.Next(),n+1 {
+			if limit>0 && n==limit { return makeCursor(false,last),nil }
+			if err := fn(iter.Key(),iter.Value()); err!=nil { return "",err }
+			last = bclone(iter.Key())
+		}
+		return "",nil
+	}
+
+	// There is no backwards iteration, so keep the last limit+1 documents. The callers cap the limit.
+	var keys,docs [][]byte
+	for ; inRange(); ok = iter.Next() {
+		keys = append(keys,bclone(iter.Key()))
+		docs = append(docs,bclone(iter.Value()))
+		if limit>0 && len(keys)>limit+1 {
+			keys,docs = keys[1:],docs[1:]
+		}
+	}
+	more := limit>0 && len(keys)>limit
+	if more { keys,docs = keys[1:],docs[1:] }
+	for i := len(keys)-1; i>=0; i-- {
+		if err := fn(keys[i],docs[i]); err!=nil { return "",err }
+	}
+	if more { return makeCursor(true,keys[0]),nil }
+	return "",nil
+}
+
+// Handles list <coll> [options].
+func (c *cctx) performList(coll string, arg []byte) error {
+	var o ListOptions
+	if len(bytes.TrimSpace(arg))!=0 {
+		if err := json.Unmarshal(arg,&o); err!=nil { return c.C.PrintfLine("906 Invalid list options: %v",err) }
+	}
+	head := false
+	cursor,err := c.List(coll,&o,func(key, doc []byte) error {
+		if !head {
+			head = true
+			if err := c.listHead("list collection"); err!=nil { return err }
+		}
+		return c.listItem(key,doc)
+	})
+	if e,ok := err.(*Error); ok { return c.replyError(e) }
+	if err!=nil { return err }
+	if !head {
+		if err = c.listHead("list collection"); err!=nil { return err }
+	}
+	if cursor!="" { return c.listMore(cursor) }
+	return c.listEnd()
+}
@@ -0,0 +1,79 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package protocol
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestList(t *testing.T) {
+	c := testSession(t,&Server{})
+	c.must("200","","tx_full snapshot")
+	for _,k := range []string{"a","ab","b","c","d"} { c.must("201",`1`,`put docs "%s"`,k) }
+	list := func(opts string) (string,string) {
+		t.Helper()
+		c.must("202","","list docs %s",opts)
+		keys,_,cursor := c.items()
+		return strings.Join(keys,","),cursor
+	}
+	for _,tc := range []struct{ opts, keys string }{
+		{``,`"a","ab","b","c","d"`},
+		{`{"start":"ab","end":"d"}`,`"ab","b","c"`},
+		{`{"prefix":"a"}`,`"a","ab"`},
+		{`{"prefix":"a","reverse":true}`,`"ab","a"`},
+		{`{"start":"b","reverse":true}`,`"d","c","b"`},
+	} {
+		if keys,cursor := list(tc.opts); keys!=tc.keys || cursor!="" { t.Errorf("%s: got %s %q, want %s",tc.opts,keys,cursor,tc.keys) }
+	}
+
+	// Page through the collection in both directions.
+	for _,reverse := range []bool{false,true} {
+		var all []string
+		cursor := ""
+		for i := 0; i<5; i++ {
+			keys,next := list(`{"limit":2,"reverse":`+map[bool]string{false:"false",true:"true"}[reverse]+`,"cursor":"`+cursor+`"}`)
+			all = append(all,keys)
+			if cursor = next; cursor=="" { break }
+		}
+		want := `"a","ab";"b","c";"d"`
+		if reverse { want = `"d","c";"b","ab";"a"` }
+		if got := strings.Join(all,";"); got!=want { t.Errorf("reverse %v: got %s, want %s",reverse,got,want) }
+	}
+	_,cursor := list(`{"limit":1}`)
+	c.must("906","",`list docs {"reverse":true,"cursor":"%s"}`,cursor)
+	c.must("906","",`list docs {"limit":-1}`)
+}
+
+// A reverse listing without a limit buffers at most MaxListKeys+1 documents and ends with a cursor.
+func TestListReverseCapped(t *testing.T) {
+	c := testSession(t,&Server{Limits:Limits{MaxListKeys:2}})
+	c.must("200","","tx_full snapshot")
+	for _,k := range []string{"a","b","c"} { c.must("201",`1`,`put docs "%s"`,k) }
+	c.must("202","",`list docs {"reverse":true}`)
+	keys,_,cursor := c.items()
+	if strings.Join(keys,",")!=`"c","b"` || cursor=="" { t.Fatalf("got %v %q",keys,cursor) }
+	c.must("202","",`list docs {"reverse":true,"cursor":"%s"}`,cursor)
+	if keys,_,cursor = c.items(); strings.Join(keys,",")!=`"a"` || cursor!="" { t.Errorf("got %v %q",keys,cursor) }
+}
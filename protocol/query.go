@@ -0,0 +1,453 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package protocol
+
+import (
+	"github.com/mad-day/hobbydb/lstore"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"errors"
+	"bytes"
+	"sort"
+	"fmt"
+)
+
+/*
+The body of the query command:
+
+	{
+		"filter": {"/age":{"$gte":18}, "$or":[{"/tags":"x"},{"/tags":"y"}]},
+		"fields": ["/name","/age"],
+		"sort": ["-/age","$key"],
+		"skip": 0,
+		"limit": 10
+	}
+
+The fields of the filter are JSON pointers or $key, which stands for the
+document key. A field matches a literal value by equality, or an object of
+the operators $eq, $ne, $gt, $gte, $lt, $lte, $in and $exists. If the field
+holds an array, the array itself or any of its elements must match. All fields
+must match, $and and $or take arrays of filters.
+
+Values compare in the order null < false < true < numbers < strings, but
+$gt, $gte, $lt and $lte only match values of the same kind.
+
+The sort fields may be prefixed with - for descending order, documents are in
+key order otherwise.
+*/
+type queryDoc struct{
+	Filter map[string]interface{} `json:"filter"`
+	Fields []string `json:"fields"`
+	Sort []string `json:"sort"`
+	Skip int `json:"skip"`
+	Limit int `json:"limit"`
+}
+
+type filter func(key, doc interface{}) bool
+type cond func(v interface{}, exists bool) bool
+
+func allOf(fs []filter) filter {
+	return func(key, doc interface{}) bool {
+		for _,f := range fs {
+			if !f(key,doc) { return false }
+		}
+		return true
+	}
+}
+func anyOf(fs []filter) filter {
+	return func(key, doc interface{}) bool {
+		for _,f := range fs {
+			if f(key,doc) { return true }
+		}
+		return false
+	}
+}
+
+func compileFilter(v interface{}) (filter,error) {
+	m,ok := v.(map[string]interface{})
+	if !ok { return nil,errors.New("filter is not an object") }
+	var fs []filter
+	for field,val := range m {
+		switch {
+		case field=="$and" || field=="$or":
+			arr,ok := val.([]interface{})
+			if !ok || len(arr)==0 { return nil,fmt.Errorf("%s needs a non-empty array",field) }
+			sub := make([]filter,len(arr))
+			for i,e := range arr {
+				f,err := compileFilter(e)
+				if err!=nil { return nil,err }
+				sub[i] = f
+			}
+			if field=="$and" { fs = append(fs,allOf(sub)) } else { fs = append(fs,anyOf(sub)) }
+		case field=="$key":
+			c,err := compileCond(val)
+			if err!=nil { return nil,err }
+			fs = append(fs,func(key, doc interface{}) bool { return c(key,true) })
+		case validPointer(field):
+			c,err := compileCond(val)
+			if err!=nil { return nil,err }
+			path := field
+			fs = append(fs,func(key, doc interface{}) bool {
+				f,ok := resolvePointer(doc,path)
+				return c(f,ok)
+			})
+		default:
+			return nil,fmt.Errorf("invalid field %q",field)
+		}
+	}
+	return allOf(fs),nil
+}
+
+// Returns the operators of a condition, or nil, if it is a literal.
+func operators(v interface{}) map[string]interface{} {
+	m,ok := v.(map[string]interface{})
+	if !ok || len(m)==0 { return nil }
+	for k := range m {
+		if !strings.HasPrefix(k,"$") { return nil }
+	}
+	return m
+}
+
+// Matches v or any element of v, if v is an array.
+func anyElem(v interface{}, exists bool, p func(interface{}) bool) bool {
+	if !exists { return false }
+	if p(v) { return true }
+	if arr,ok := v.([]interface{}); ok {
+		for _,e := range arr {
+			if p(e) { return true }
+		}
+	}
+	return false
+}
+
+func compileCond(v interface{}) (cond,error) {
+	ops := operators(v)
+	if ops==nil {
+		return func(f interface{}, exists bool) bool {
+			return anyElem(f,exists,func(e interface{}) bool { return reflect.DeepEqual(e,v) })
+		},nil
+	}
+	var cs []cond
+	for op,arg := range ops {
+		arg := arg
+		switch op {
+		case "$eq":
+			cs = append(cs,func(f interface{}, exists bool) bool {
+				return anyElem(f,exists,func(e interface{}) bool { return reflect.DeepEqual(e,arg) })
+			})
+		case "$ne":
+			cs = append(cs,func(f interface{}, exists bool) bool {
+				return !anyElem(f,exists,func(e interface{}) bool { return reflect.DeepEqual(e,arg) })
+			})
+		case "$gt","$gte","$lt","$lte":
+			var ok func(int) bool
+			switch op {
+			case "$gt": ok = func(i int) bool { return i>0 }
+			case "$gte": ok = func(i int) bool { return i>=0 }
+			case "$lt": ok = func(i int) bool { return i<0 }
+			case "$lte": ok = func(i int) bool { return i<=0 }
+			}
+			cs = append(cs,func(f interface{}, exists bool) bool {
+				return anyElem(f,exists,func(e interface{}) bool {
+					i,comparable := compareValues(e,arg)
+					return comparable && ok(i)
+				})
+			})
+		case "$in":
+			arr,ok := arg.([]interface{})
+			if !ok { return nil,errors.New("$in needs an array") }
+			cs = append(cs,func(f interface{}, exists bool) bool {
+				return anyElem(f,exists,func(e interface{}) bool {
+					for _,a := range arr {
+						if reflect.DeepEqual(e,a) { return true }
+					}
+					return false
+				})
+			})
+		case "$exists":
+			want,ok := arg.(bool)
+			if !ok { return nil,errors.New("$exists needs a boolean") }
+			cs = append(cs,func(f interface{}, exists bool) bool { return exists==want })
+		default:
+			return nil,fmt.Errorf("unknown operator %s",op)
+		}
+	}
+	return func(f interface{}, exists bool) bool {
+		for _,c := range cs {
+			if !c(f,exists) { return false }
+		}
+		return true
+	},nil
+}
+
+// The rank of a value in the sort order. Missing values come first.
+func valueRank(v interface{}, exists bool) byte {
+	if !exists { return 0 }
+	switch t := v.(type) {
+	case nil: return ix_null
+	case bool:
+		if t { return ix_true }
+		return ix_false
+	case float64: return ix_number
+	case string: return ix_string
+	}
+	return ix_string+1
+}
+
+// Compares two scalars of the same kind.
+func compareValues(a, b interface{}) (int,bool) {
+	r := valueRank(a,true)
+	if r!=valueRank(b,true) || r>ix_string { return 0,false }
+	switch r {
+	case ix_number:
+		x,y := a.(float64),b.(float64)
+		switch {
+		case x<y: return -1,true
+		case x>y: return 1,true
+		}
+	case ix_string:
+		return strings.Compare(a.(string),b.(string)),true
+	}
+	return 0,true
+}
+
+// A total order for sorting. Objects and arrays are equal to each other.
+func sortCompare(a interface{}, aok bool, b interface{}, bok bool) int {
+	ra,rb := valueRank(a,aok),valueRank(b,bok)
+	switch {
+	case ra<rb: return -1
+	case ra>rb: return 1
+	}
+	i,_ := compareValues(a,b)
+	return i
+}
+
+// Copies the fields into a new object, keeping their nesting.
+func project(doc interface{}, fields []string) interface{} {
+	out := make(map[string]interface{})
+	for _,field := range fields {
+		v,ok := resolvePointer(doc,field)
+		if !ok { continue }
+		if field=="" { return doc }
+		toks := pointerTokens(field)
+		m := out
+		for _,tok := range toks[:len(toks)-1] {
+			n,ok := m[tok].(map[string]interface{})
+			if !ok {
+				n = make(map[string]interface{})
+				m[tok] = n
+			}
+			m = n
+		}
+		m[toks[len(toks)-1]] = v
+	}
+	return out
+}
+
+/*
+Selects the candidate keys using the top-level conditions of the filter. The
+$key equality is answered by point reads, an indexed field by index scans.
+Returns nil, if the whole collection must be scanned.
+*/
+func (c *cctx) planQuery(coll string, f map[string]interface{}, meta *collMeta) ([][]byte,error) {
+	if kc,ok := f["$key"]; ok {
+		var keys []interface{}
+		if ops := operators(kc); ops==nil {
+			keys = []interface{}{kc}
+		} else if v,ok := ops["$eq"]; ok {
+			keys = []interface{}{v}
+		} else if v,ok := ops["$in"].([]interface{}); ok {
+			keys = v
+		}
+		if keys!=nil {
+			res := make([][]byte,0,len(keys))
+			for _,k := range keys {
+				b,err := json.Marshal(k)
+				if err!=nil { return nil,err }
+				res = append(res,b)
+			}
+			return uniqueKeys(res),nil
+		}
+	}
+	for _,path := range meta.Indexes {
+		fc,ok := f[path]
+		if !ok { continue }
+		ranges := indexRanges(path,fc)
+		if ranges==nil { continue }
+		it,err := c.TX.UTable(indexTable(coll))
+		if err!=nil { return nil,err }
+		var res [][]byte
+		iter := it.Iter()
+		for _,r := range ranges {
+			scanIndex(iter,r[0],r[1],func(key []byte) error {
+				res = append(res,key)
+				return nil
+			})
+		}
+		iter.Release()
+		return uniqueKeys(res),nil
+	}
+	return nil,nil
+}
+
+// The index key ranges, that contain all matches of the condition, or nil.
+func indexRanges(path string, fc interface{}) [][2][]byte {
+	point := func(v interface{}) ([2][]byte,bool) {
+		lo,ok := ixValue(ixPrefix(path),v)
+		return [2][]byte{lo,prefixEnd(lo)},ok
+	}
+	ops := operators(fc)
+	if ops==nil {
+		if r,ok := point(fc); ok { return [][2][]byte{r} }
+		return nil
+	}
+	if v,ok := ops["$eq"]; ok {
+		if r,ok := point(v); ok { return [][2][]byte{r} }
+	}
+	if arr,ok := ops["$in"].([]interface{}); ok {
+		var rs [][2][]byte
+		for _,v := range arr {
+			r,ok := point(v)
+			if !ok { return nil }
+			rs = append(rs,r)
+		}
+		return rs
+	}
+	r := [2][]byte{ixPrefix(path),prefixEnd(ixPrefix(path))}
+	bounded := false
+	for op,v := range ops {
+		b,ok := ixValue(ixPrefix(path),v)
+		if !ok { continue }
+		switch op {
+		case "$gt": b = prefixEnd(b)
+		case "$gte":
+		case "$lt": r[1] = b; bounded = true; continue
+		case "$lte": r[1] = prefixEnd(b); bounded = true; continue
+		default: continue
+		}
+		r[0] = b
+		bounded = true
+	}
+	if !bounded { return nil }
+	return [][2][]byte{r}
+}
+
+// Sorts the keys and removes duplicates.
+func uniqueKeys(keys [][]byte) [][]byte {
+	sort.Slice(keys,func(i, j int) bool { return bytes.Compare(keys[i],keys[j])<0 })
+	res := keys[:0]
+	for i,k := range keys {
+		if i>0 && bytes.Equal(k,keys[i-1]) { continue }
+		res = append(res,k)
+	}
+	return res
+}
+
+type queryHit struct{
+	key []byte
+	kv,doc interface{}
+	raw []byte
+}
+
+// Handles query <coll>, the query document follows as dot body.
+func (c *cctx) performQuery(coll string, u lstore.UTable, body []byte) error {
+	var q queryDoc
+	if err := json.Unmarshal(body,&q); err!=nil { return c.C.PrintfLine("905 Invalid query: %v",err) }
+	if q.Skip<0 || q.Limit<0 { return c.C.PrintfLine("905 Invalid query: negative skip or limit") }
+	for _,field := range q.Fields {
+		if !validPointer(field) { return c.C.PrintfLine("902 Invalid JSON pointer: %q",field) }
+	}
+	for _,field := range q.Sort {
+		field = strings.TrimPrefix(field,"-")
+		if field!="$key" && !validPointer(field) { return c.C.PrintfLine("902 Invalid JSON pointer: %q",field) }
+	}
+	match := filter(func(key, doc interface{}) bool { return true })
+	if q.Filter!=nil {
+		var err error
+		if match,err = compileFilter(q.Filter); err!=nil { return c.C.PrintfLine("905 Invalid query: %v",err) }
+	}
+	meta,err := loadMeta(c.TX,coll)
+	if err!=nil { return c.C.PrintfLine("800 IO Error: %v",err) }
+	keys,err := c.planQuery(coll,q.Filter,meta)
+	if err!=nil { return c.C.PrintfLine("800 IO Error: %v",err) }
+
+	// Without sorting, the documents are in key order and the scan stops early.
+	var hits []queryHit
+	skip := q.Skip
+	full := func() bool { return len(q.Sort)==0 && q.Limit>0 && len(hits)>=q.Limit }
+	visit := func(key, raw []byte) {
+		var kv,doc interface{}
+		if json.Unmarshal(key,&kv)!=nil || json.Unmarshal(raw,&doc)!=nil { return }
+		if !match(kv,doc) { return }
+		if len(q.Sort)==0 && skip>0 {
+			skip--
+			return
+		}
+		hits = append(hits,queryHit{bclone(key),kv,doc,bclone(raw)})
+	}
+	if keys!=nil {
+		for _,key := range keys {
+			if full() { break }
+			if raw := u.Read(key); len(raw)!=0 { visit(key,raw) }
+		}
+	} else {
+		iter := u.Iter()
+		for !full() && iter.Next() { visit(iter.Key(),iter.Value()) }
+		iter.Release()
+	}
+
+	if len(q.Sort)!=0 {
+		sort.SliceStable(hits,func(i, j int) bool {
+			for _,field := range q.Sort {
+				desc := strings.HasPrefix(field,"-")
+				field = strings.TrimPrefix(field,"-")
+				var r int
+				if field=="$key" {
+					r = sortCompare(hits[i].kv,true,hits[j].kv,true)
+				} else {
+					a,aok := resolvePointer(hits[i].doc,field)
+					b,bok := resolvePointer(hits[j].doc,field)
+					r = sortCompare(a,aok,b,bok)
+				}
+				if desc { r = -r }
+				if r!=0 { return r<0 }
+			}
+			return false
+		})
+		if q.Skip>=len(hits) { hits = nil } else { hits = hits[q.Skip:] }
+		if q.Limit>0 && len(hits)>q.Limit { hits = hits[:q.Limit] }
+	}
+
+	if err = c.checkResults(len(hits)); err!=nil { return c.reply(err,"") }
+	if err = c.listHead("query results"); err!=nil { return err }
+	for _,h := range hits {
+		raw := h.raw
+		if q.Fields!=nil {
+			if raw,err = json.Marshal(project(h.doc,q.Fields)); err!=nil { return err }
+		}
+		if err = c.listItem(h.key,raw); err!=nil { return err }
+	}
+	return c.listEnd()
+}
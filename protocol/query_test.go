@@ -0,0 +1,90 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package protocol
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestCompileFilter(t *testing.T) {
+	doc := map[string]interface{}{"age":30.0,"name":"bob","tags":[]interface{}{"x","y"},"nil":nil}
+	for _,tc := range []struct{
+		filter string
+		match bool
+	}{
+		{`{}`,true},
+		{`{"/age":30}`,true},
+		{`{"/age":{"$gte":18,"$lt":30}}`,false},
+		{`{"/age":{"$gt":"a"}}`,false},
+		{`{"/name":{"$in":["alice","bob"]}}`,true},
+		{`{"/name":{"$ne":"bob"}}`,false},
+		{`{"/tags":"y"}`,true},
+		{`{"/tags":["x","y"]}`,true},
+		{`{"/nil":null,"/missing":{"$exists":false}}`,true},
+		{`{"/nil":{"$exists":true}}`,true},
+		{`{"$key":"k"}`,true},
+		{`{"$or":[{"/age":1},{"/tags":"x"}]}`,true},
+		{`{"$and":[{"/age":30},{"/tags":"z"}]}`,false},
+	} {
+		var v interface{}
+		if err := json.Unmarshal([]byte(tc.filter),&v); err!=nil { t.Fatal(err) }
+		f,err := compileFilter(v)
+		if err!=nil { t.Errorf("%s: %v",tc.filter,err); continue }
+		if f("k",doc)!=tc.match { t.Errorf("%s: got %v, want %v",tc.filter,!tc.match,tc.match) }
+	}
+	for _,bad := range []string{`[]`,`{"age":1}`,`{"$or":[]}`,`{"/a":{"$foo":1}}`} {
+		var v interface{}
+		json.Unmarshal([]byte(bad),&v)
+		if _,err := compileFilter(v); err==nil { t.Errorf("%s: no error",bad) }
+	}
+}
+
+func TestQuery(t *testing.T) {
+	c := testSession(t,&Server{})
+	c.must("200","","tx_full snapshot")
+	for i,doc := range []string{`{"age":40,"name":"a"}`,`{"age":20,"name":"b"}`,`{"age":30,"name":"c","tags":["x"]}`,`{"name":"d"}`} {
+		c.must("201",doc,`put people %d`,i)
+	}
+	query := func(q string) (keys, docs []string) {
+		t.Helper()
+		c.must("202",q,"query people")
+		keys,docs,_ = c.items()
+		return
+	}
+	for pass := 0; pass<2; pass++ {
+		if keys,_ := query(`{"filter":{"/age":{"$gte":25}}}`); strings.Join(keys,",")!="0,2" { t.Errorf("pass %d: got %v",pass,keys) }
+		if keys,_ := query(`{"filter":{"/age":{"$exists":true}},"sort":["-/age"],"skip":1,"limit":1}`); strings.Join(keys,",")!="2" { t.Errorf("pass %d: sorted: got %v",pass,keys) }
+		if keys,_ := query(`{"filter":{"$key":{"$lt":2}},"limit":1}`); strings.Join(keys,",")!="0" { t.Errorf("pass %d: limit: got %v",pass,keys) }
+		if keys,_ := query(`{"filter":{"/tags":"x"}}`); strings.Join(keys,",")!="2" { t.Errorf("pass %d: array: got %v",pass,keys) }
+		// The second pass plans the query with the indexes.
+		c.must("201","","create_index people /age")
+		c.must("201","","create_index people /tags")
+	}
+	if _,docs := query(`{"filter":{"/name":"b"},"fields":["/age"]}`); strings.Join(docs,",")!=`{"age":20}` { t.Errorf("fields: got %v",docs) }
+	c.must("905",`{"filter":[]}`,"query people")
+	c.must("905",`{"limit":-1}`,"query people")
+	c.must("902",`{"sort":["age"]}`,"query people")
+}
@@ -0,0 +1,108 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package protocol
+
+import (
+	"github.com/xeipuuv/gojsonschema"
+	"strings"
+	"sync"
+)
+
+// A document, that does not satisfy the schema of its collection.
+type schemaError struct{
+	errs []string
+}
+func (e *schemaError) Error() string { return "schema validation failed: "+strings.Join(e.errs,"; ") }
+
+// The compiled schemas by their source.
+var schemaCache sync.Map
+
+func compileSchema(src []byte) (*gojsonschema.Schema,error) {
+	if s,ok := schemaCache.Load(string(src)); ok { return s.(*gojsonschema.Schema),nil }
+	s,err := gojsonschema.NewSchema(gojsonschema.NewBytesLoader(src))
+	if err!=nil { return nil,err }
+	schemaCache.Store(string(src),s)
+	return s,nil
+}
+
+// Validates the document against the schema, returning a *schemaError on failure.
+func validateDoc(src, doc []byte) error {
+	s,err := compileSchema(src)
+	if err!=nil { return err }
+	res,err := s.Validate(gojsonschema.NewBytesLoader(doc))
+	if err!=nil { return &schemaError{[]string{err.Error()}} }
+	if res.Valid() { return nil }
+	se := new(schemaError)
+	for _,e := range res.Errors() { se.errs = append(se.errs,e.String()) }
+	return se
+}
+
+// Replies with the validation errors, one per line.
+func (c *cctx) replySchemaError(se *schemaError) error {
+	if err := c.C.PrintfLine("960 Schema validation failed"); err!=nil { return err }
+	return c.schemaErrorBody(se)
+}
+
+// Writes the validation errors as the dot body of a 960 reply.
+func (c *cctx) schemaErrorBody(se *schemaError) error {
+	dw := c.bodyWriter()
+	for _,e := range se.errs {
+		if _,err := dw.Write([]byte(e+"\n")); err!=nil {
+			dw.Close()
+			return err
+		}
+	}
+	return dw.Close()
+}
+
+/*
+Handles the schema commands of admins:
+
+	set_schema <coll>     followed by the JSON Schema, an empty body removes it
+	get_schema <coll>
+
+The schema applies to the documents written after it was set.
+*/
+func (c *cctx) performSchema(cmd, coll string) error {
+	var body []byte
+	var err error
+	if cmd=="set_schema" {
+		if body,err = c.readBody(); err!=nil { return err }
+	}
+	meta,err := loadMeta(c.TX,coll)
+	if err!=nil { return c.C.PrintfLine("800 IO Error: %v",err) }
+	if cmd=="get_schema" {
+		if err = c.C.PrintfLine("290 content follows"); err!=nil { return err }
+		return c.writeBody(meta.Schema)
+	}
+	if len(strings.TrimSpace(string(body)))==0 {
+		meta.Schema = nil
+	} else {
+		if body,err = normalizeJson(body); err!=nil { return c.C.PrintfLine("904 Invalid value: %v",err) }
+		if _,err = compileSchema(body); err!=nil { return c.C.PrintfLine("904 Invalid value: %v",err) }
+		meta.Schema = body
+	}
+	if err = storeMeta(c.TX,coll,meta); err!=nil { return c.replyWrite(cmd,err) }
+	return c.C.PrintfLine("201 updated")
+}
@@ -0,0 +1,57 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package protocol
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSchema(t *testing.T) {
+	c := testSession(t,&Server{})
+	c.must("200","","tx_full snapshot")
+	c.must("201",`{"n":"x"}`,`put docs "old"`)
+	schema := `{"properties":{"n":{"type":"integer"}},"required":["n"],"type":"object"}`
+	c.must("201",schema,"set_schema docs")
+	c.must("904",`{"type":1}`,"set_schema docs")
+	c.must("904",`{"type":`,"set_schema docs")
+	c.must("290","","get_schema docs")
+	if got := c.body(); got!=schema { t.Errorf("got schema %s",got) }
+
+	c.must("201",`{"n":1}`,`put docs "a"`)
+	c.must("960",`{"n":"1"}`,`put docs "b"`)
+	if errs := c.body(); !strings.Contains(errs,"n") { t.Errorf("got errors %q",errs) }
+	c.must("960",`{"n":null}`,`merge docs "a"`)
+	c.body()
+	c.must("201","",`delete docs "a"`)
+	// The schema applies to new writes only.
+	c.must("290","",`get docs "old"`)
+	if doc := c.body(); doc!=`{"n":"x"}` { t.Errorf("got %s",doc) }
+
+	c.must("201"," ","set_schema docs")
+	c.must("201",`{"n":"1"}`,`put docs "b"`)
+	c.must("290","","get_schema docs")
+	if got := c.body(); got!="" { t.Errorf("got schema %s after removing it",got) }
+	c.must("200","","commit")
+}
@@ -0,0 +1,238 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package protocol
+
+import (
+	"github.com/mad-day/hobbydb/lstore"
+	"net"
+	"net/textproto"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrServerClosed = errors.New("protocol: Server closed")
+var errShutdown = errors.New("shutdown")
+
+/*
+A server for the jsondb text protocol. Every connection is served by its own
+goroutine. Open transactions are rolled back, when a connection ends.
+*/
+type Server struct{
+	DS lstore.UDBM
+
+	// The maximum number of concurrent connections, 0 means unlimited.
+	MaxConns int
+
+	// The time a connection may wait between two commands.
+	IdleTimeout time.Duration
+
+	// The time, the rest of a command (eg. a dot body) may take.
+	ReadTimeout time.Duration
+
+	// If nil, nothing is logged.
+	Logger *log.Logger
+
+	// Log every command, not only connection events.
+	LogCommands bool
+
+	// Reject all commands but auth and quit, until the client authenticated.
+	// The users are managed with SetUser or the user_set command.
+	RequireAuth bool
+
+	// How often the documents of collections with a TTL are swept, 0 means
+	// once a minute, a negative interval disables the sweeper.
+	TTLInterval time.Duration
+
+	// Enables the starttls command and is used by ListenAndServeTLS. To map
+	// client certificates to users, set ClientAuth, eg. to
+	// tls.VerifyClientCertIfGiven.
+	TLSConfig *tls.Config
+
+	// The limits of the connections.
+	Limits Limits
+
+	// Maps verified client certificates to users, nil means CommonName.
+	// Clients with a certificate of a user are authenticated as this user.
+	CertUser func(cert *x509.Certificate) string
+
+	mu sync.Mutex
+	sweeping bool
+	listeners map[net.Listener]bool
+	conns map[*cctx]bool
+	wg sync.WaitGroup
+	nconns int32
+	lastid uint64
+	shutdown int32
+}
+
+func (s *Server) logf(format string, args ...interface{}) {
+	if s.Logger==nil { return }
+	s.Logger.Printf(format,args...)
+}
+func (s *Server) closing() bool { return atomic.LoadInt32(&s.shutdown)!=0 }
+
+/*
+Listens on the given network address and serves the connections. The network
+is either "tcp" or "unix".
+*/
+func (s *Server) ListenAndServe(network, addr string) error {
+	l,err := net.Listen(network,addr)
+	if err!=nil { return err }
+	return s.Serve(l)
+}
+
+// Accepts connections on the listener, until the server is shut down.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closing() {
+		s.mu.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	if s.listeners==nil { s.listeners = make(map[net.Listener]bool) }
+	s.listeners[l] = true
+	if !s.sweeping && s.TTLInterval>=0 {
+		s.sweeping = true
+		iv := s.TTLInterval
+		if iv==0 { iv = time.Minute }
+		go s.sweeper(iv)
+	}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners,l)
+		s.mu.Unlock()
+		l.Close()
+	}()
+
+	s.logf("event=listen addr=%s",l.Addr())
+	var delay time.Duration
+	for {
+		conn,err := l.Accept()
+		if err!=nil {
+			if s.closing() { return ErrServerClosed }
+			if ne,ok := err.(net.Error); ok && ne.Temporary() {
+				if delay==0 { delay = 5*time.Millisecond } else { delay *= 2 }
+				if delay>time.Second { delay = time.Second }
+				s.logf("event=accept-error error=%q retry=%v",err,delay)
+				time.Sleep(delay)
+				continue
+			}
+			return err
+		}
+		delay = 0
+		s.serveConn(conn)
+	}
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	id := atomic.AddUint64(&s.lastid,1)
+	// Reserve the slot first, so that concurrent listeners can not exceed MaxConns.
+	if n := atomic.AddInt32(&s.nconns,1); s.MaxConns>0 && int(n)>s.MaxConns {
+		atomic.AddInt32(&s.nconns,-1)
+		s.logf("conn=%d remote=%s event=reject reason=max-conns",id,conn.RemoteAddr())
+		textproto.NewConn(conn).PrintfLine("421 Too many connections")
+		conn.Close()
+		return
+	}
+	sess := NewSession(s.DS,s.RequireAuth)
+	sess.Limits = &s.Limits
+	cc := newCctx(sess,textproto.NewConn(conn))
+	cc.conn,cc.srv,cc.id = conn,s,id
+
+	// Registers the connection together with the closing check, so that
+	// Shutdown waits for every connection, it did not refuse.
+	s.mu.Lock()
+	if s.closing() {
+		s.mu.Unlock()
+		atomic.AddInt32(&s.nconns,-1)
+		cc.C.PrintfLine("421 Server shutting down")
+		conn.Close()
+		return
+	}
+	if s.conns==nil { s.conns = make(map[*cctx]bool) }
+	s.conns[cc] = true
+	s.wg.Add(1)
+	s.mu.Unlock()
+
+	go func() {
+		defer s.wg.Done()
+		start := time.Now()
+		s.logf("conn=%d remote=%s event=open",id,conn.RemoteAddr())
+		var err error
+		if tc,ok := conn.(*tls.Conn); ok { err = cc.handshake(tc) }
+		if err==nil { err = cc.loop() }
+		cc.C.Close()
+		s.mu.Lock()
+		delete(s.conns,cc)
+		s.mu.Unlock()
+		atomic.AddInt32(&s.nconns,-1)
+		if err==eBYE { err = nil }
+		s.logf("conn=%d event=close duration=%v error=%q",id,time.Since(start),errString(err))
+	}()
+}
+
+func errString(err error) string {
+	if err==nil { return "" }
+	return err.Error()
+}
+
+/*
+Stops accepting new connections and ends the existing ones. Connections, that
+wait for a command, are ended at once, all others after their current command.
+Their open transactions are rolled back. If the context expires first, the
+remaining connections are closed forcibly.
+*/
+func (s *Server) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&s.shutdown,1)
+	s.mu.Lock()
+	for l := range s.listeners { l.Close() }
+	for cc := range s.conns {
+		// Wakes up connections, that are waiting for a command.
+		if atomic.LoadInt32(&cc.idle)!=0 { cc.conn.SetReadDeadline(time.Now()) }
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+	s.mu.Lock()
+	for cc := range s.conns { cc.conn.Close() }
+	s.mu.Unlock()
+	<-done
+	return ctx.Err()
+}
@@ -0,0 +1,153 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+
+package protocol
+
+import (
+	"github.com/mad-day/hobbydb/lstore"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testDS(t *testing.T) lstore.UDBM {
+	d,err := ioutil.TempDir("","protocol")
+	if err!=nil { t.Fatal(err) }
+	t.Cleanup(func(){ os.RemoveAll(d) })
+	return lstore.Complex(&lstore.Storage{Basepath:d},0)
+}
+
+// Serves s on a unix socket and returns its address.
+func testServe(t *testing.T, s *Server) string {
+	d,err := ioutil.TempDir("","sock")
+	if err!=nil { t.Fatal(err) }
+	addr := d+"/sock"
+	l,err := net.Listen("unix",addr)
+	if err!=nil { t.Fatal(err) }
+	go s.Serve(l)
+	t.Cleanup(func(){
+		ctx,cf := context.WithTimeout(context.Background(),time.Second)
+		defer cf()
+		s.Shutdown(ctx)
+		os.RemoveAll(d)
+	})
+	return addr
+}
+
+func testDial(t *testing.T, addr string) *textproto.Conn {
+	c,err := textproto.Dial("unix",addr)
+	if err!=nil { t.Fatal(err) }
+	t.Cleanup(func(){ c.Close() })
+	return c
+}
+
+func TestServerMaxConns(t *testing.T) {
+	s := &Server{DS:testDS(t),MaxConns:5,TTLInterval:-1}
+	var wg sync.WaitGroup
+	var accepted,rejected int32
+	for i := 0; i<20; i++ {
+		a,b := net.Pipe()
+		t.Cleanup(func(){ b.Close() })
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			s.serveConn(a)
+		}()
+		go func() {
+			defer wg.Done()
+			b.SetReadDeadline(time.Now().Add(300*time.Millisecond))
+			line,err := textproto.NewConn(b).ReadLine()
+			if err==nil && strings.HasPrefix(line,"421 ") {
+				atomic.AddInt32(&rejected,1)
+			} else {
+				atomic.AddInt32(&accepted,1)
+			}
+		}()
+	}
+	wg.Wait()
+	if accepted!=5 || rejected!=15 { t.Errorf("accepted %d and rejected %d, want 5 and 15",accepted,rejected) }
+	if n := atomic.LoadInt32(&s.nconns); n!=5 { t.Errorf("got %d connections, want 5",n) }
+}
+
+// A connection without IdleTimeout waits forever, even if ReadTimeout is set.
+func TestServerReadTimeout(t *testing.T) {
+	s := &Server{DS:testDS(t),ReadTimeout:50*time.Millisecond,TTLInterval:-1}
+	c := testDial(t,testServe(t,s))
+	for i := 0; i<2; i++ {
+		if err := c.PrintfLine("tx_read snapshot"); err!=nil { t.Fatal(err) }
+		if _,_,err := c.ReadCodeLine(200); err!=nil { t.Fatal(err) }
+		if err := c.PrintfLine("rollback"); err!=nil { t.Fatal(err) }
+		if _,_,err := c.ReadCodeLine(200); err!=nil { t.Fatal(err) }
+		time.Sleep(150*time.Millisecond)
+	}
+}
+
+func TestServerIdleTimeout(t *testing.T) {
+	s := &Server{DS:testDS(t),IdleTimeout:50*time.Millisecond,TTLInterval:-1}
+	c := testDial(t,testServe(t,s))
+	time.Sleep(150*time.Millisecond)
+	c.PrintfLine("tx_read snapshot")
+	if _,_,err := c.ReadCodeLine(200); err==nil { t.Error("the idle connection is still open") }
+}
+
+func TestServerShutdown(t *testing.T) {
+	ds := testDS(t)
+	s := &Server{DS:ds,TTLInterval:-1}
+	c := testDial(t,testServe(t,s))
+	c.PrintfLine("tx_full snapshot")
+	if _,_,err := c.ReadCodeLine(200); err!=nil { t.Fatal(err) }
+	c.PrintfLine(`put docs "a"`)
+	dw := c.DotWriter()
+	dw.Write([]byte("1"))
+	dw.Close()
+	if _,_,err := c.ReadCodeLine(201); err!=nil { t.Fatal(err) }
+	ctx,cf := context.WithTimeout(context.Background(),time.Second)
+	defer cf()
+	if err := s.Shutdown(ctx); err!=nil { t.Fatal(err) }
+	if _,_,err := c.ReadCodeLine(421); err!=nil { t.Errorf("got %v, want 421",err) }
+
+	// The open transaction was rolled back.
+	tx := ds.StartTx(lstore.READ_SNAPSHOT,lstore.WRITE_DISABLED)
+	u,err := tx.UTable("json_docs")
+	if err!=nil { t.Fatal(err) }
+	iter := u.Iter()
+	if iter.Next() { t.Errorf("%s is stored after the shutdown",iter.Key()) }
+	iter.Release()
+	tx.Discard()
+
+	// Connections, that arrive during the shutdown, are refused.
+	a,b := net.Pipe()
+	defer b.Close()
+	go s.serveConn(a)
+	b.SetReadDeadline(time.Now().Add(time.Second))
+	if _,_,err := textproto.NewConn(b).ReadCodeLine(421); err!=nil { t.Errorf("got %v, want 421",err) }
+	if n := atomic.LoadInt32(&s.nconns); n!=0 { t.Errorf("got %d connections, want 0",n) }
+}
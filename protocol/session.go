@@ -0,0 +1,249 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package protocol
+
+import (
+	"github.com/mad-day/hobbydb/lstore"
+	"errors"
+	"fmt"
+	"time"
+	jsonpatch "github.com/evanphx/json-patch"
+)
+
+/*
+An error of a Session operation. Code is the reply code of the jsondb text
+protocol, eg. 901 for invalid keys, other front ends map it to their own.
+*/
+type Error struct{
+	Code int
+	Msg string
+	Err error
+
+	// The schema validation errors of code 960.
+	Details []string
+}
+func (e *Error) Error() string {
+	if e.Err==nil { return e.Msg }
+	return fmt.Sprintf("%s: %v",e.Msg,e.Err)
+}
+func (e *Error) Unwrap() error { return e.Err }
+
+func opError(code int, msg string, err error) error { return &Error{Code:code,Msg:msg,Err:err} }
+
+/*
+Returns the error of a failed write or commit. Conflicts with concurrent
+updates have their own code 711, so that clients can tell them apart.
+*/
+func writeError(code int, msg string, err error) *Error {
+	if errors.Is(err,lstore.ErrConcurrentUpdate) { code,msg = 711,"Conflict" }
+	return &Error{Code:code,Msg:msg,Err:err}
+}
+
+var (
+	errNoTx = &Error{Code:980,Msg:"No active transaction"}
+	errActiveTx = &Error{Code:981,Msg:"Active transaction"}
+)
+
+/*
+The state of a client of the jsondb data model: its transaction and its user.
+The text protocol and other front ends perform the operations through a
+Session, so that they share their semantics. A Session must not be used
+concurrently.
+*/
+type Session struct{
+	DS lstore.UDBM
+	TX lstore.UDB
+
+	// The authenticated user, if any.
+	user *userRecord
+	userName string
+	requireAuth bool
+
+	// Whether the writes of TX take effect instantly, and the changes to
+	// publish on commit otherwise.
+	instant bool
+	changes []*change
+
+	// The limits of the session, nil means unlimited.
+	Limits *Limits
+	started time.Time
+	writes int
+	expired bool
+
+	log func(format string, args ...interface{})
+}
+
+/*
+Creates a session. If requireAuth is set, the session must be authenticated
+by Auth, before it may access any collection.
+*/
+func NewSession(ds lstore.UDBM, requireAuth bool) *Session {
+	return &Session{DS:ds,requireAuth:requireAuth}
+}
+
+func (s *Session) logf(format string, args ...interface{}) {
+	if s.log!=nil { s.log(format,args...) }
+}
+
+// Returns the name of the authenticated user, if any.
+func (s *Session) User() string { return s.userName }
+
+/*
+Starts a transaction. The record of the authenticated user is reloaded first,
+so that changed grants and quotas and deleted users take effect.
+*/
+func (s *Session) Begin(r lstore.ReadIso, w lstore.WriteIso) error {
+	if s.TX!=nil { return errActiveTx }
+	if err := s.reloadUser(); err!=nil { return err }
+	s.TX = s.DS.StartTx(r,w)
+	s.instant = w==lstore.WRITE_INSTANT || w==lstore.WRITE_INSTANT_ATOMIC
+	s.started,s.writes,s.expired = time.Now(),0,false
+	return nil
+}
+
+func (s *Session) Commit() error {
+	if s.TX==nil { return s.noTx() }
+	if err := s.checkTx(); err!=nil { return err }
+	err := s.TX.Commit()
+	s.TX = nil
+	if err!=nil {
+		s.changes = nil
+		return writeError(710,"Abort",err)
+	}
+	s.publishChanges()
+	return nil
+}
+
+func (s *Session) Rollback() error {
+	if s.TX==nil {
+		// The expired transaction is already rolled back.
+		if s.expired {
+			s.expired = false
+			return nil
+		}
+		return errNoTx
+	}
+	s.TX.Discard()
+	s.TX = nil
+	s.changes = nil
+	return nil
+}
+
+// Opens the table of the collection, checking the grants for the command.
+func (s *Session) docTable(cmd, coll string) (lstore.UTable,error) {
+	if s.TX==nil { return nil,s.noTx() }
+	if err := s.checkTx(); err!=nil { return nil,err }
+	if !ValidCollection(coll) { return nil,opError(907,"No such collection",fmt.Errorf("invalid name %q",coll)) }
+	if !s.authorize(cmd,coll) { return nil,opError(930,"Permission denied",fmt.Errorf("no access to %s",coll)) }
+	u,err := s.TX.UTable(docTable(coll))
+	if err!=nil { return nil,opError(800,"IO Error",err) }
+	return u,nil
+}
+
+// Returns the document and its ETag. The key is a JSON value.
+func (s *Session) Get(coll string, key []byte) (doc []byte, etag string, err error) {
+	u,err := s.docTable("get",coll)
+	if err!=nil { return nil,"",err }
+	if key,err = normalizeJson(key); err!=nil { return nil,"",opError(901,"Invalid Key",err) }
+	doc = u.Read(key)
+	return doc,etagOf(doc),nil
+}
+
+// The attempts of an update, whose compare-and-swap lost against concurrent writes.
+const updateAttempts = 100
+
+/*
+Performs one of the write operations put, merge (RFC 7386), patch (RFC 6902),
+update (see updateOps) or delete on the document with the JSON key. The body
+is ignored by delete. If ifMatch is not empty, the document must have this
+ETag (see etagOf).
+
+Instant transactions write the current document. Their updates are
+compare-and-swapped and retried, so that concurrent updates do not get lost.
+Other transactions read the document, that merge, patch, update and if-match
+depend on, for update: their commit fails, if it was changed concurrently,
+also in tx_batch.
+*/
+func (s *Session) Write(op, coll string, key []byte, ifMatch string, body []byte) error {
+	switch op {
+	case "put","merge","patch","update","delete":
+	default: return opError(996,"unknown command "+op,nil)
+	}
+	u,err := s.docTable(op,coll)
+	if err!=nil { return err }
+	if key,err = normalizeJson(key); err!=nil { return opError(901,"Invalid Key",err) }
+	ct,casTable := u.(lstore.CASTable)
+	retry := op=="update" && ifMatch=="" && s.instant && casTable
+	read := u.Read
+	if s.instant && casTable {
+		read = ct.ReadCurrent
+	} else if ur,ok := u.(lstore.UpdateReader); ok && (op!="put" && op!="delete" || ifMatch!="") {
+		read = ur.ReadForUpdate
+	}
+	if err = s.checkWrites(); err!=nil { return err }
+	for attempt := 1; ; attempt++ {
+		old := read(key)
+		if ifMatch!="" && ifMatch!=etagOf(old) { return opError(712,"Precondition failed: ETag="+etagOf(old),nil) }
+		cur := old
+		if len(cur)==0 { cur = []byte("{}") }
+		doc := body
+		switch op {
+		case "delete":
+			doc = nil
+		case "merge":
+			if doc,err = jsonpatch.MergePatch(cur,body); err!=nil { return opError(998,"Invalid merge patch",err) }
+		case "patch":
+			patch,err := jsonpatch.DecodePatch(body)
+			if err!=nil { return opError(997,"Invalid JSON patch",err) }
+			if doc,err = patch.Apply(cur); err!=nil { return opError(850,"Corrupted JSON in db",err) }
+		case "update":
+			if doc,err = applyUpdate(old,body); err!=nil { return opError(908,"Invalid update",err) }
+		}
+		err = s.writeDocIf(coll,u,key,old,doc,ifMatch!="" || retry)
+		if err==errPrecondition && retry && attempt<updateAttempts { continue }
+		if err==errPrecondition { return opError(712,"Precondition failed",nil) }
+		if se,ok := err.(*schemaError); ok { return &Error{Code:960,Msg:"Schema validation failed",Err:se,Details:se.errs} }
+		if e,ok := err.(*Error); ok { return e }
+		if err!=nil { return writeError(700,"write op "+op,err) }
+		s.writes++
+		return nil
+	}
+}
+
+/*
+Calls fn for the documents of the collection within the options. Returns the
+cursor, that continues the listing, if the limit cut it short.
+*/
+func (s *Session) List(coll string, o *ListOptions, fn func(key, doc []byte) error) (cursor string, err error) {
+	u,err := s.docTable("list",coll)
+	if err!=nil { return "",err }
+	if o.Limit<0 { return "",opError(906,"Invalid list options: negative limit",nil) }
+	lower,upper,err := o.bounds()
+	if err!=nil { return "",opError(906,"Invalid list options",err) }
+	limit := o.Limit
+	capped := s.capList(&limit)
+	cursor,err = listRange(u,limit,o.Reverse,lower,upper,fn)
+	if capped && cursor!="" { limitHit("list_keys") }
+	return
+}
@@ -0,0 +1,109 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package protocol
+
+import (
+	"github.com/mad-day/hobbydb/lstore"
+	"encoding/json"
+	"sync"
+	"testing"
+)
+
+func counter(t *testing.T, ds lstore.UDBM) int {
+	t.Helper()
+	s := NewSession(ds,false)
+	if err := s.Begin(lstore.READ_SNAPSHOT,lstore.WRITE_DISABLED); err!=nil { t.Fatal(err) }
+	defer s.Rollback()
+	doc,_,err := s.Get("docs",[]byte(`"n"`))
+	if err!=nil { t.Fatal(err) }
+	var v struct{ N int `json:"n"` }
+	json.Unmarshal(doc,&v)
+	return v.N
+}
+
+var inc = []byte(`{"$inc":{"/n":1}}`)
+
+// Two sessions increment the same field, before either commits. No update gets lost.
+func TestUpdateConcurrent(t *testing.T) {
+	for _,tc := range []struct{
+		name string
+		w lstore.WriteIso
+		want int
+	}{
+		{"tx_full",lstore.WRITE_CHECKED,1},
+		{"tx_batch",lstore.WRITE_COMMIT,1},
+		{"tx_auto",lstore.WRITE_INSTANT_ATOMIC,2},
+	} {
+		t.Run(tc.name,func(t *testing.T) {
+			ds := testDS(t)
+			s1,s2 := NewSession(ds,false),NewSession(ds,false)
+			for _,s := range []*Session{s1,s2} {
+				if err := s.Begin(lstore.READ_SNAPSHOT,tc.w); err!=nil { t.Fatal(err) }
+			}
+			for _,s := range []*Session{s1,s2} {
+				if err := s.Write("update","docs",[]byte(`"n"`),"",inc); err!=nil { t.Fatal(err) }
+			}
+			if err := s1.Commit(); err!=nil { t.Fatal(err) }
+			ok := 1
+			if err := s2.Commit(); err==nil {
+				ok++
+			} else if e,isErr := err.(*Error); !isErr || e.Code!=711 {
+				t.Errorf("got %v, want 711",err)
+			}
+			if n := counter(t,ds); n!=ok || n!=tc.want { t.Errorf("%d commits, n is %d, want %d",ok,n,tc.want) }
+		})
+	}
+}
+
+// Instant updates are retried, until they succeed.
+func TestUpdateInstantRetry(t *testing.T) {
+	ds := testDS(t)
+	var wg sync.WaitGroup
+	for i := 0; i<4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s := NewSession(ds,false)
+			if err := s.Begin(lstore.READ_SNAPSHOT,lstore.WRITE_INSTANT_ATOMIC); err!=nil { t.Error(err); return }
+			defer s.Commit()
+			for j := 0; j<25; j++ {
+				if err := s.Write("update","docs",[]byte(`"n"`),"",inc); err!=nil { t.Error(err); return }
+			}
+		}()
+	}
+	wg.Wait()
+	if n := counter(t,ds); n!=100 { t.Errorf("n is %d, want 100",n) }
+}
+
+// Sessions reject the collection names, that front ends must not pass on.
+func TestCollectionName(t *testing.T) {
+	s := NewSession(testDS(t),false)
+	if err := s.Begin(lstore.READ_SNAPSHOT,lstore.WRITE_CHECKED); err!=nil { t.Fatal(err) }
+	defer s.Rollback()
+	for _,name := range []string{"","../x","a/b","Docs","a b"} {
+		err := s.Write("put",name,[]byte(`"a"`),"",[]byte(`{}`))
+		if e,ok := err.(*Error); !ok || e.Code!=907 { t.Errorf("%q: got %v",name,err) }
+	}
+	if err := s.Write("put","my_docs2",[]byte(`"a"`),"",[]byte(`{}`)); err!=nil { t.Error(err) }
+}
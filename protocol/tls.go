@@ -0,0 +1,100 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package protocol
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/textproto"
+	"time"
+)
+
+// The time, the TLS handshake may take, if the server has no ReadTimeout.
+const handshakeTimeout = 30*time.Second
+
+// Returns the common name of the subject of the certificate.
+func CommonName(cert *x509.Certificate) string { return cert.Subject.CommonName }
+
+/*
+Returns the principal of the verified client certificate of the connection,
+as mapped by fn, or "", if the client presented no verified certificate. If fn
+is nil, the principal is the common name.
+*/
+func CertPrincipal(cs *tls.ConnectionState, fn func(*x509.Certificate) string) string {
+	if cs==nil || len(cs.VerifiedChains)==0 || len(cs.VerifiedChains[0])==0 { return "" }
+	if fn==nil { fn = CommonName }
+	return fn(cs.VerifiedChains[0][0])
+}
+
+/*
+Listens on the given network address and serves TLS connections, that are
+secured with the TLSConfig of the server from the start.
+*/
+func (s *Server) ListenAndServeTLS(network, addr string) error {
+	l,err := net.Listen(network,addr)
+	if err!=nil { return err }
+	return s.Serve(tls.NewListener(l,s.TLSConfig))
+}
+
+/*
+Completes the handshake of a TLS connection. If the client presented a
+verified certificate, whose principal is a user, the session is authenticated
+as this user.
+*/
+func (c *cctx) handshake(tc *tls.Conn) error {
+	d := handshakeTimeout
+	if c.srv.ReadTimeout>0 { d = c.srv.ReadTimeout }
+	tc.SetDeadline(time.Now().Add(d))
+	if err := tc.Handshake(); err!=nil { return err }
+	tc.SetDeadline(time.Time{})
+	cs := tc.ConnectionState()
+	c.logf("event=tls version=%x cipher=%x",cs.Version,cs.CipherSuite)
+	if name := CertPrincipal(&cs,c.srv.CertUser); name!="" { c.Login(name) }
+	return nil
+}
+
+/*
+Handles the starttls command, which upgrades a cleartext connection to TLS:
+
+	starttls
+	200 begin TLS
+
+After the reply, the client starts the TLS handshake. Everything the client
+sent after the command, but before the handshake, is discarded. STARTTLS is
+not available in binary mode or within a transaction.
+*/
+func (c *cctx) performStartTLS() error {
+	if c.srv==nil || c.srv.TLSConfig==nil || c.conn==nil { return c.C.PrintfLine("932 TLS not available") }
+	if _,ok := c.conn.(*tls.Conn); ok { return c.C.PrintfLine("932 TLS already active") }
+	if c.bin!=nil { return c.C.PrintfLine("932 TLS not available in binary mode") }
+	if c.TX!=nil { return c.C.PrintfLine("981 Active transaction") }
+	if err := c.C.PrintfLine("200 begin TLS"); err!=nil { return err }
+	tc := tls.Server(c.conn,c.srv.TLSConfig)
+	if err := c.handshake(tc); err!=nil { return err }
+	c.srv.mu.Lock()
+	c.conn,c.C = tc,textproto.NewConn(tc)
+	c.srv.mu.Unlock()
+	return nil
+}
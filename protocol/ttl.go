@@ -0,0 +1,125 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package protocol
+
+import (
+	"github.com/mad-day/hobbydb/lstore"
+	"encoding/binary"
+	"bytes"
+	"time"
+)
+
+/*
+The TTL table of a collection holds two entries per document:
+
+	'k' <key>                 -> expiry (big endian unix nanoseconds)
+	'e' <expiry> <key>        -> <key>
+
+The 'e' entries are ordered by expiry, so the sweeper finds the expired
+documents with a single seek.
+*/
+func ttlKey(key []byte) []byte { return append([]byte{'k'},key...) }
+func ttlExpiry(exp []byte, key []byte) []byte {
+	return append(append([]byte{'e'},exp...),key...)
+}
+
+// Sets the expiry of the document, or removes it, if doc is empty.
+func updateTTL(tx lstore.UDB, coll string, key, doc []byte, exp time.Time) error {
+	t,err := tx.UTable(ttlTable(coll))
+	if err!=nil { return err }
+	kk := ttlKey(key)
+	if old := t.Read(kk); len(old)==8 {
+		if err = t.Write(ttlExpiry(old,key),nil); err!=nil { return err }
+	}
+	if len(doc)==0 { return t.Write(kk,nil) }
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:],uint64(exp.UnixNano()))
+	if err = t.Write(kk,b[:]); err!=nil { return err }
+	return t.Write(ttlExpiry(b[:],key),key)
+}
+
+/*
+Deletes the documents, that expired at now, from the collections with a TTL.
+Returns the number of deleted documents. Every collection is swept by its own
+transactions of importBatch documents each.
+*/
+func SweepExpired(ds lstore.UDBM, now time.Time) (n int, err error) {
+	tx := ds.StartTx(lstore.READ_SNAPSHOT,lstore.WRITE_DISABLED)
+	var colls []string
+	err = scanCatalog(tx,func(coll string, meta *collMeta) error {
+		if meta.TTL>0 { colls = append(colls,coll) }
+		return nil
+	})
+	tx.Discard()
+	if err!=nil { return }
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:],uint64(now.UnixNano()))
+	end := ttlExpiry(b[:],nil)
+	for _,coll := range colls {
+		for {
+			m,err := sweepBatch(ds,coll,end)
+			n += m
+			if err!=nil { return n,err }
+			if m<importBatch { break }
+		}
+	}
+	return
+}
+
+func sweepBatch(ds lstore.UDBM, coll string, end []byte) (int,error) {
+	s := NewSession(ds,false)
+	if err := s.Begin(lstore.READ_SNAPSHOT,lstore.WRITE_CHECKED); err!=nil { return 0,err }
+	defer s.Rollback()
+	t,err := s.TX.UTable(ttlTable(coll))
+	if err!=nil { return 0,err }
+	var keys [][]byte
+	iter := t.Iter()
+	for ok := iter.Seek([]byte{'e'}); ok && bytes.Compare(iter.Key(),end)<0 && len(keys)<importBatch; ok = iter.Next() {
+		keys = append(keys,bclone(iter.Value()))
+	}
+	iter.Release()
+	if len(keys)==0 { return 0,nil }
+	u,err := s.TX.UTable(docTable(coll))
+	if err!=nil { return 0,err }
+	for _,key := range keys {
+		if err = s.writeDoc(coll,u,key,nil); err!=nil { return 0,err }
+	}
+	if err = s.Commit(); err!=nil { return 0,err }
+	return len(keys),nil
+}
+
+// Sweeps the expired documents every interval, until the server shuts down.
+func (s *Server) sweeper(interval time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for range tick.C {
+		if s.closing() { return }
+		n,err := SweepExpired(s.DS,time.Now())
+		if err!=nil {
+			s.logf("event=ttl-sweep error=%q",err)
+		} else if n>0 {
+			s.logf("event=ttl-sweep deleted=%d",n)
+		}
+	}
+}
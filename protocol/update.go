@@ -0,0 +1,254 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"reflect"
+	"sort"
+	"strconv"
+)
+
+/*
+The operators of the update command, in the order they are applied:
+
+	{"$set":{"/a":1}}              sets the fields
+	{"$unset":{"/a":true}}         removes the fields, array elements become null
+	{"$inc":{"/n":1}}              adds to numbers, missing fields count as 0
+	{"$min":{"/n":1}}              lowers the fields to the value
+	{"$max":{"/n":9}}              raises the fields to the value
+	{"$push":{"/l":1}}             appends to arrays, {"$each":[...]} appends several
+	{"$addToSet":{"/l":1}}         appends, unless the array contains the value, takes $each too
+	{"$pull":{"/l":{"$gt":3}}}     removes the matching elements, the conditions are those of query
+
+The fields are JSON pointers. Missing objects on the way are created, except
+by $unset and $pull, which leave the document as it is. Numbers keep their
+precision: $inc adds integers exactly, $min and $max compare exactly.
+*/
+var updateOps = []string{"$set","$unset","$inc","$min","$max","$push","$addToSet","$pull"}
+
+type updateError struct{ msg string }
+func (e *updateError) Error() string { return e.msg }
+
+func updateErrorf(format string, args ...interface{}) error {
+	return &updateError{fmt.Sprintf(format,args...)}
+}
+
+/*
+Returns the parent container of the field and the last token of its pointer.
+The parent is a map[string]interface{} or a []interface{}. Missing objects on
+the way are created, if create is set, otherwise the parent is nil.
+*/
+func fieldParent(doc map[string]interface{}, ptr string, create bool) (interface{},string,error) {
+	if ptr=="" || ptr[0]!='/' { return nil,"",updateErrorf("invalid field %q",ptr) }
+	toks := pointerTokens(ptr)
+	var cur interface{} = doc
+	for _,tok := range toks[:len(toks)-1] {
+		switch c := cur.(type) {
+		case map[string]interface{}:
+			n,ok := c[tok]
+			if !ok || n==nil {
+				if !create { return nil,"",nil }
+				n = make(map[string]interface{})
+				c[tok] = n
+			}
+			cur = n
+		case []interface{}:
+			i,err := strconv.Atoi(tok)
+			if err!=nil || i<0 || i>=len(c) { return nil,"",updateErrorf("no element %q in %s",tok,ptr) }
+			cur = c[i]
+		default:
+			return nil,"",updateErrorf("cannot traverse %s",ptr)
+		}
+	}
+	switch cur.(type) {
+	case map[string]interface{},[]interface{}:
+	default:
+		return nil,"",updateErrorf("cannot traverse %s",ptr)
+	}
+	return cur,toks[len(toks)-1],nil
+}
+
+func fieldGet(parent interface{}, tok string) (interface{},bool) {
+	switch p := parent.(type) {
+	case map[string]interface{}:
+		v,ok := p[tok]
+		return v,ok
+	case []interface{}:
+		i,err := strconv.Atoi(tok)
+		if err!=nil || i<0 || i>=len(p) { return nil,false }
+		return p[i],true
+	}
+	return nil,false
+}
+
+func fieldSet(parent interface{}, tok string, v interface{}) error {
+	switch p := parent.(type) {
+	case map[string]interface{}:
+		p[tok] = v
+		return nil
+	case []interface{}:
+		i,err := strconv.Atoi(tok)
+		if err!=nil || i<0 || i>=len(p) { return updateErrorf("no element %q",tok) }
+		p[i] = v
+		return nil
+	}
+	return updateErrorf("cannot set %q",tok)
+}
+
+// The values of $push and $addToSet, which may be {"$each":[...]}.
+func eachOf(v interface{}) []interface{} {
+	if m,ok := v.(map[string]interface{}); ok && len(m)==1 {
+		if each,ok := m["$each"].([]interface{}); ok { return each }
+	}
+	return []interface{}{v}
+}
+
+func containsValue(arr []interface{}, v interface{}) bool {
+	v = floatNumbers(v)
+	for _,e := range arr {
+		if reflect.DeepEqual(floatNumbers(e),v) { return true }
+	}
+	return false
+}
+
+// Converts the json.Numbers of the value to float64, as the conditions of query compare them.
+func floatNumbers(v interface{}) interface{} {
+	switch t := v.(type) {
+	case json.Number:
+		f,_ := t.Float64()
+		return f
+	case map[string]interface{}:
+		m := make(map[string]interface{},len(t))
+		for k,e := range t { m[k] = floatNumbers(e) }
+		return m
+	case []interface{}:
+		a := make([]interface{},len(t))
+		for i,e := range t { a[i] = floatNumbers(e) }
+		return a
+	}
+	return v
+}
+
+// Adds the numbers, exactly, if both are integers.
+func addNumbers(a, b json.Number) (json.Number,error) {
+	x,ok1 := new(big.Int).SetString(string(a),10)
+	y,ok2 := new(big.Int).SetString(string(b),10)
+	if ok1 && ok2 { return json.Number(x.Add(x,y).String()),nil }
+	fa,_ := a.Float64()
+	fb,_ := b.Float64()
+	f := fa+fb
+	if math.IsInf(f,0) || math.IsNaN(f) { return "",updateErrorf("%s + %s is out of range",a,b) }
+	return json.Number(strconv.FormatFloat(f,'g',-1,64)),nil
+}
+
+func compareNumbers(a, b json.Number) int {
+	x,_ := new(big.Float).SetPrec(256).SetString(string(a))
+	y,_ := new(big.Float).SetPrec(256).SetString(string(b))
+	return x.Cmp(y)
+}
+
+// Applies the update operators to the document, which is empty or an object.
+func applyUpdate(old, body []byte) ([]byte,error) {
+	var upd map[string]map[string]interface{}
+	if err := unmarshalNumber(body,&upd); err!=nil { return nil,updateErrorf("%v",err) }
+	if len(upd)==0 { return nil,updateErrorf("no operators") }
+	for op := range upd {
+		known := false
+		for _,o := range updateOps { known = known || o==op }
+		if !known { return nil,updateErrorf("unknown operator %s",op) }
+	}
+	doc := make(map[string]interface{})
+	if len(old)!=0 {
+		if err := unmarshalNumber(old,&doc); err!=nil || doc==nil { return nil,updateErrorf("document is no object") }
+	}
+	for _,op := range updateOps {
+		fields := upd[op]
+		ptrs := make([]string,0,len(fields))
+		for p := range fields { ptrs = append(ptrs,p) }
+		sort.Strings(ptrs)
+		for _,ptr := range ptrs {
+			arg := fields[ptr]
+			parent,tok,err := fieldParent(doc,ptr,op!="$unset" && op!="$pull")
+			if err!=nil { return nil,err }
+			if parent==nil { continue }
+			cur,exists := fieldGet(parent,tok)
+			switch op {
+			case "$set":
+				err = fieldSet(parent,tok,arg)
+			case "$unset":
+				if m,ok := parent.(map[string]interface{}); ok {
+					delete(m,tok)
+				} else if exists {
+					err = fieldSet(parent,tok,nil)
+				}
+			case "$inc":
+				d,ok := arg.(json.Number)
+				if !ok { return nil,updateErrorf("$inc of %s by a non-number",ptr) }
+				n,ok := cur.(json.Number)
+				if exists && !ok { return nil,updateErrorf("$inc of the non-number %s",ptr) }
+				if !exists { n = "0" }
+				if n,err = addNumbers(n,d); err!=nil { return nil,err }
+				err = fieldSet(parent,tok,n)
+			case "$min","$max":
+				if exists {
+					x,ok1 := arg.(json.Number)
+					y,ok2 := cur.(json.Number)
+					i,comparable := compareValues(floatNumbers(arg),floatNumbers(cur))
+					if ok1 && ok2 { i = compareNumbers(x,y) }
+					if !comparable { return nil,updateErrorf("%s of %s with an incomparable value",op,ptr) }
+					if (op=="$min" && i>=0) || (op=="$max" && i<=0) { continue }
+				}
+				err = fieldSet(parent,tok,arg)
+			case "$push","$addToSet","$pull":
+				arr,ok := cur.([]interface{})
+				if exists && cur!=nil && !ok { return nil,updateErrorf("%s to the non-array %s",op,ptr) }
+				switch op {
+				case "$push":
+					arr = append(arr,eachOf(arg)...)
+				case "$addToSet":
+					for _,v := range eachOf(arg) {
+						if !containsValue(arr,v) { arr = append(arr,v) }
+					}
+				case "$pull":
+					if !exists { continue }
+					c,err := compileCond(floatNumbers(arg))
+					if err!=nil { return nil,updateErrorf("$pull of %s: %v",ptr,err) }
+					keep := []interface{}{}
+					for _,e := range arr {
+						if !c(floatNumbers(e),true) { keep = append(keep,e) }
+					}
+					arr = keep
+				}
+				if arr==nil { arr = []interface{}{} }
+				err = fieldSet(parent,tok,arr)
+			}
+			if err!=nil { return nil,err }
+		}
+	}
+	return json.Marshal(doc)
+}
@@ -0,0 +1,59 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package protocol
+
+import (
+	"testing"
+)
+
+func TestApplyUpdate(t *testing.T) {
+	for _,tc := range []struct{ old, ops, want string }{
+		{``,`{"$inc":{"/n":2}}`,`{"n":2}`},
+		{`{"a":{"b":1}}`,`{"$set":{"/a/c":2,"/x/y":3}}`,`{"a":{"b":1,"c":2},"x":{"y":3}}`},
+		{`{"a":1,"l":[1,2]}`,`{"$unset":{"/a":true,"/l/0":true}}`,`{"l":[null,2]}`},
+		{`{"n":5}`,`{"$min":{"/n":3,"/m":1},"$max":{"/k":9}}`,`{"k":9,"m":1,"n":3}`},
+		{`{"l":[1]}`,`{"$push":{"/l":{"$each":[2,3]}}}`,`{"l":[1,2,3]}`},
+		{`{"l":[1,2]}`,`{"$addToSet":{"/l":{"$each":[2,3]}}}`,`{"l":[1,2,3]}`},
+		{`{"l":[1,5,2,7]}`,`{"$pull":{"/l":{"$gt":3}}}`,`{"l":[1,2]}`},
+		// Big integers keep their precision.
+		{`{"n":9007199254740993}`,`{"$inc":{"/n":1,"/m":0.5}}`,`{"m":0.5,"n":9007199254740994}`},
+		{`{"n":12345678901234567890}`,`{"$min":{"/n":12345678901234567891},"$max":{"/k":1e2}}`,`{"k":1e2,"n":12345678901234567890}`},
+		{`{"n":9007199254740993}`,`{"$max":{"/n":9007199254740994}}`,`{"n":9007199254740994}`},
+		{`{"l":[1,2]}`,`{"$addToSet":{"/l":1.0},"$pull":{"/l":{"$eq":2}}}`,`{"l":[1]}`},
+		// $unset and $pull do not create the objects on the way.
+		{``,`{"$unset":{"/a/b":true}}`,`{}`},
+		{`{"x":1}`,`{"$pull":{"/a/l":1}}`,`{"x":1}`},
+		// $set is applied before $inc.
+		{``,`{"$inc":{"/n":1},"$set":{"/n":10}}`,`{"n":11}`},
+	} {
+		var old []byte
+		if tc.old!="" { old = []byte(tc.old) }
+		doc,err := applyUpdate(old,[]byte(tc.ops))
+		if err!=nil { t.Errorf("%s: %v",tc.ops,err); continue }
+		if string(doc)!=tc.want { t.Errorf("%s: got %s, want %s",tc.ops,doc,tc.want) }
+	}
+	for _,bad := range []string{`{"$rename":{"/a":"/b"}}`,`{"$inc":{"/s":1}}`,`{"$push":{"/s":1}}`,`{"$set":{"a":1}}`,`[]`} {
+		if _,err := applyUpdate([]byte(`{"s":"x"}`),[]byte(bad)); err==nil { t.Errorf("%s: no error",bad) }
+	}
+}
@@ -0,0 +1,98 @@
+/*
+Copyright (c) 2018 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package protocol
+
+import (
+	"strings"
+	"testing"
+)
+
+// Reads one change of a watch.
+func (c *testConn) change() string {
+	c.t.Helper()
+	line,err := c.ReadLine()
+	if err!=nil { c.t.Fatal(err) }
+	if !strings.HasPrefix(line,"> ") { c.t.Fatalf("got %q, want a change",line) }
+	return line[2:]+" "+c.body()
+}
+
+// Ends a watch and returns the changes, that it still streamed, and the resume point.
+func (c *testConn) stopWatch() (string,string) {
+	c.t.Helper()
+	if err := c.PrintfLine("stop"); err!=nil { c.t.Fatal(err) }
+	keys,docs,next := c.items()
+	for i := range keys { keys[i] += " "+docs[i] }
+	return strings.Join(keys,";"),next
+}
+
+func TestWatch(t *testing.T) {
+	s := &Server{}
+	c := testSession(t,s)
+	w := &testConn{t,testDial(t,testServe(t,&Server{DS:s.DS,TTLInterval:-1}))}
+	w.must("203","","watch docs")
+
+	c.must("200","","tx_full snapshot")
+	c.must("201","1",`put docs "a"`)
+	c.must("201","1",`put other "b"`)
+	c.must("200","","commit")
+	if ch := w.change(); ch!=`1 put "a" 1` { t.Errorf("got %q",ch) }
+	c.must("200","","tx_full snapshot")
+	c.must("201","2",`put docs "a"`)
+	c.must("200","","rollback")
+	c.must("200","","tx_auto snapshot")
+	c.must("201","",`delete docs "a"`)
+	if ch := w.change(); ch!=`3 delete "a" ` { t.Errorf("got %q",ch) }
+	if chs,next := w.stopWatch(); chs!="" || next!="4" { t.Errorf("got %q, resume at %s",chs,next) }
+
+	// Resume from the start.
+	w.must("203","","watch docs 1")
+	if chs,next := w.stopWatch(); chs!=`1 put "a" 1;3 delete "a" ` || next!="4" { t.Errorf("got %q, resume at %s",chs,next) }
+	w.must("200","","tx_read snapshot")
+	w.must("981","","watch docs")
+	w.must("200","","rollback")
+
+	SetChangeRetention(s.DS,1)
+	c.must("201","5",`put docs "c"`)
+	w.must("203","","watch docs 1")
+	if chs,next := w.stopWatch(); chs!=`4 put "c" 5` || next!="5" { t.Errorf("retention: got %q, resume at %s",chs,next) }
+}
+
+// The change log is bounded by default, and its state is released with the UDBM.
+func TestChangeRetention(t *testing.T) {
+	defer func(n uint64){ DefaultChangeRetention = n }(DefaultChangeRetention)
+	DefaultChangeRetention = 2
+	s := &Server{}
+	c := testSession(t,s)
+	c.must("200","","tx_auto snapshot")
+	for _,k := range []string{"a","b","c"} { c.must("201","1",`put docs "%s"`,k) }
+	w := &testConn{t,testDial(t,testServe(t,&Server{DS:s.DS,TTLInterval:-1}))}
+	w.must("203","","watch docs 1")
+	if chs,next := w.stopWatch(); chs!=`2 put "b" 1;3 put "c" 1` || next!="4" { t.Errorf("got %q, resume at %s",chs,next) }
+
+	ReleaseChanges(s.DS)
+	hubsMu.Lock()
+	_,ok := hubs[s.DS]
+	hubsMu.Unlock()
+	if ok { t.Error("the change log state was not released") }
+}
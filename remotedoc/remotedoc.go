@@ -39,7 +39,8 @@ type Reader struct {
 func NewReader(br *bufio.Reader) *Reader {
 	r := new(Reader)
 	r.Reader = textproto.NewReader(br)
-	r.Decoder.Reset(br)
+	// br is an io.ByteScanner, so the decoder reads without buffering of its own.
+	r.Decoder = *msgpack.NewDecoder(br)
 	r.Decoder.UseDecodeInterfaceLoose(true)
 	return r
 }
@@ -52,7 +53,7 @@ type Writer struct {
 func NewWriter(bw *bufio.Writer) *Writer {
 	r := new(Writer)
 	r.Writer = textproto.NewWriter(bw)
-	r.Encoder.Reset(bw)
+	r.Encoder = *msgpack.NewEncoder(bw)
 	r.Encoder.UseCompactEncoding(true)
 	return r
 }